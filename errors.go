@@ -0,0 +1,81 @@
+package mbox
+
+import (
+	"errors"
+	"fmt"
+)
+
+// Errors returned by the package, check them with errors.Is
+var (
+	// ErrEmptyMessage is returned by Form.WriteTo when the message, body,
+	// HTML, subject and from are all empty
+	ErrEmptyMessage = errors.New("mbox: empty message")
+	// ErrNotOpen is returned by Save before Open
+	ErrNotOpen = errors.New("mbox: not open")
+	// ErrAlreadyOpen is returned by Open while the writer goroutine is running
+	ErrAlreadyOpen = errors.New("mbox: already open")
+	// ErrClosed is returned by Save after Close or Shutdown,
+	// or when the Open context is done
+	ErrClosed = errors.New("mbox: closed")
+	// ErrQueueFull is returned by Save when the queue is full and the overflow
+	// policy is OverflowDrop
+	ErrQueueFull = errors.New("mbox: queue is full")
+	// ErrSpillEncrypted is returned by Open with OverflowSpill and an
+	// AgeRecipient: spilled messages would be stored unencrypted
+	ErrSpillEncrypted = errors.New("mbox: OverflowSpill can not be used with AgeRecipient")
+	// ErrRelayEncrypted is returned by Open with a Relay sink and an
+	// AgeRecipient: queued messages would be stored unencrypted
+	ErrRelayEncrypted = errors.New("mbox: a Relay sink can not be used with AgeRecipient")
+	// ErrEncrypted is returned by Entry.Mail for an encrypted entry (see Entry.Decrypt)
+	ErrEncrypted = errors.New("mbox: message is encrypted")
+)
+
+// Reasons of an ErrInvalidAddress, check them with errors.Is
+var (
+	ErrNoAddress         = errors.New("missing email address")
+	ErrAddressSyntax     = errors.New("invalid email address")
+	ErrNoMailHost        = errors.New("email domain does not accept mail")
+	ErrDisposableAddress = errors.New("disposable email address")
+)
+
+// ErrInvalidAddress is a From address rejected by a validator, for a Reason
+// such as ErrNoMailHost (see errors.Is)
+type ErrInvalidAddress struct {
+	Address string // the From address, or the whole From if it is not an address
+	Reason  error  // ErrNoAddress, ErrAddressSyntax, ErrNoMailHost or ErrDisposableAddress
+	Cause   error  // optional, eg: the DNS lookup error
+}
+
+func (e *ErrInvalidAddress) Error() string {
+	if e.Cause != nil {
+		return fmt.Sprintf("%v: %q: %v", e.Reason, e.Address, e.Cause)
+	}
+	return fmt.Sprintf("%v: %q", e.Reason, e.Address)
+}
+
+func (e *ErrInvalidAddress) Unwrap() []error {
+	if e.Cause != nil {
+		return []error{e.Reason, e.Cause}
+	}
+	return []error{e.Reason}
+}
+
+// WriteError is a message the writer goroutine could not write,
+// reported to OnError. The mbox file may end with a partial message.
+type WriteError struct {
+	Mailbox string // mbox file name, empty if unknown
+	Offset  int64  // where the message begins in the file, -1 if unknown
+	Written int64  // bytes written before the error
+	Err     error
+}
+
+func (e *WriteError) Error() string {
+	if e.Mailbox == "" {
+		return fmt.Sprintf("mbox: writing message: %v", e.Err)
+	}
+	return fmt.Sprintf("mbox: writing message to %s at offset %d: %v", e.Mailbox, e.Offset, e.Err)
+}
+
+func (e *WriteError) Unwrap() error {
+	return e.Err
+}
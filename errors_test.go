@@ -0,0 +1,39 @@
+package mbox_test
+
+import (
+	"bytes"
+	"errors"
+	"path/filepath"
+	"testing"
+
+	"github.com/aerth/mbox"
+)
+
+func TestErrors(t *testing.T) {
+	m := &mbox.Mailbox{Filename: filepath.Join(t.TempDir(), "errors.mbox")}
+	if err := m.Save(&mbox.Form{Message: "hello"}); !errors.Is(err, mbox.ErrNotOpen) {
+		t.Errorf("save before open: expected ErrNotOpen, got %v", err)
+	}
+	if err := m.Open(nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := m.Open(nil); !errors.Is(err, mbox.ErrAlreadyOpen) {
+		t.Errorf("open twice: expected ErrAlreadyOpen, got %v", err)
+	}
+	if err := m.Save(&mbox.Form{Message: "  \n"}); !errors.Is(err, mbox.ErrEmptyMessage) {
+		t.Errorf("empty message: expected ErrEmptyMessage, got %v", err)
+	}
+	m.Close()
+	if err := m.Save(&mbox.Form{Message: "hello"}); !errors.Is(err, mbox.ErrClosed) {
+		t.Errorf("save after close: expected ErrClosed, got %v", err)
+	}
+
+	if _, err := new(mbox.Form).WriteTo(new(bytes.Buffer)); !errors.Is(err, mbox.ErrEmptyMessage) {
+		t.Errorf("WriteTo: expected ErrEmptyMessage, got %v", err)
+	}
+
+	entry := &mbox.Entry{Encrypted: true}
+	if _, err := entry.Mail(); !errors.Is(err, mbox.ErrEncrypted) {
+		t.Errorf("Mail: expected ErrEncrypted, got %v", err)
+	}
+}
@@ -0,0 +1,324 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"net"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/aerth/mbox"
+)
+
+// fakeMessage is a message stored in the fake server, split like RFC822.HEADER and RFC822.TEXT
+type fakeMessage struct {
+	uid    uint32
+	header []byte
+	text   []byte
+}
+
+type fakeFolder struct {
+	name        string
+	uidvalidity uint32
+	uidnext     uint32
+	messages    []fakeMessage
+}
+
+// fakeServer is a minimal in-process IMAP server, just enough for the imap example:
+// CAPABILITY, LOGIN, LIST, SELECT/EXAMINE, FETCH, UID FETCH, NOOP and LOGOUT.
+// Commands must not contain literals.
+type fakeServer struct {
+	ln    net.Listener
+	user  string
+	pass  string
+	delim string
+
+	mu      sync.Mutex
+	folders map[string]*fakeFolder
+}
+
+// newFakeServer starts a server seeded with one folder per mbox file,
+// eg: {"INBOX": "testdata/inbox.mbox"}. The server is stopped when the test ends.
+func newFakeServer(t *testing.T, seeds map[string]string) *fakeServer {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &fakeServer{
+		ln:      ln,
+		user:    "test",
+		pass:    "secret",
+		delim:   ".",
+		folders: map[string]*fakeFolder{},
+	}
+	for name, file := range seeds {
+		s.addFolder(name)
+		for _, raw := range readMbox(t, file) {
+			s.addMessage(name, raw)
+		}
+	}
+	t.Cleanup(func() { ln.Close() })
+	go s.serve()
+	return s
+}
+
+// readMbox returns the raw messages of an mbox file
+func readMbox(t *testing.T, file string) [][]byte {
+	t.Helper()
+	f, err := os.Open(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	entries, err := mbox.NewReader(f).ReadAll()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var msgs [][]byte
+	for _, entry := range entries {
+		msgs = append(msgs, entry.Raw)
+	}
+	return msgs
+}
+
+func (s *fakeServer) Addr() string {
+	return s.ln.Addr().String()
+}
+
+// addFolder creates an empty folder
+func (s *fakeServer) addFolder(name string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.folders[name] == nil {
+		s.folders[name] = &fakeFolder{name: name, uidvalidity: 1, uidnext: 1}
+	}
+}
+
+// addMessage appends a raw message to a folder, assigning the next UID
+func (s *fakeServer) addMessage(folder string, raw []byte) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	f := s.folders[folder]
+	header, text := raw, []byte(nil)
+	if i := bytes.Index(raw, []byte("\n\n")); i != -1 {
+		header, text = raw[:i+2], raw[i+2:]
+	}
+	f.messages = append(f.messages, fakeMessage{uid: f.uidnext, header: header, text: text})
+	f.uidnext++
+}
+
+// renumber assigns new UIDs to every message in a folder and changes its UIDVALIDITY
+func (s *fakeServer) renumber(folder string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	f := s.folders[folder]
+	f.uidvalidity++
+	f.uidnext = 100
+	for i := range f.messages {
+		f.messages[i].uid = f.uidnext
+		f.uidnext++
+	}
+}
+
+func (s *fakeServer) serve() {
+	for {
+		conn, err := s.ln.Accept()
+		if err != nil {
+			return
+		}
+		go s.handle(conn)
+	}
+}
+
+// session is the state of a single client connection
+type session struct {
+	w        *bufio.Writer
+	loggedin bool
+	selected *fakeFolder
+}
+
+func (ss *session) printf(format string, args ...interface{}) {
+	fmt.Fprintf(ss.w, format+"\r\n", args...)
+}
+
+func (s *fakeServer) handle(conn net.Conn) {
+	defer conn.Close()
+	r := bufio.NewReader(conn)
+	ss := &session{w: bufio.NewWriter(conn)}
+	ss.printf("* OK [CAPABILITY IMAP4rev1] fake server ready")
+	ss.w.Flush()
+	for {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			return
+		}
+		args := splitArgs(strings.TrimRight(line, "\r\n"))
+		if len(args) < 2 {
+			ss.printf("* BAD missing command")
+			ss.w.Flush()
+			continue
+		}
+		tag, cmd := args[0], strings.ToUpper(args[1])
+		args = args[2:]
+		if cmd == "UID" && len(args) != 0 {
+			cmd, args = "UID "+strings.ToUpper(args[0]), args[1:]
+		}
+		if !s.exec(ss, tag, cmd, args) {
+			ss.w.Flush()
+			return
+		}
+		ss.w.Flush()
+	}
+}
+
+// exec runs a single command, returns false when the connection should be closed
+func (s *fakeServer) exec(ss *session, tag, cmd string, args []string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	switch {
+	case cmd == "CAPABILITY":
+		ss.printf("* CAPABILITY IMAP4rev1")
+		ss.printf("%s OK CAPABILITY completed", tag)
+	case cmd == "NOOP":
+		ss.printf("%s OK NOOP completed", tag)
+	case cmd == "LOGOUT":
+		ss.printf("* BYE logging out")
+		ss.printf("%s OK LOGOUT completed", tag)
+		return false
+	case cmd == "LOGIN" && len(args) == 2:
+		if args[0] != s.user || args[1] != s.pass {
+			ss.printf("%s NO [AUTHENTICATIONFAILED] invalid credentials", tag)
+			break
+		}
+		ss.loggedin = true
+		ss.printf("%s OK [CAPABILITY IMAP4rev1] LOGIN completed", tag)
+	case !ss.loggedin:
+		ss.printf("%s BAD not authenticated", tag)
+	case cmd == "LIST" && len(args) == 2:
+		for _, name := range sortedKeys(s.folders) {
+			if args[1] == "%" && strings.Contains(name, s.delim) {
+				continue
+			}
+			ss.printf("* LIST () %q %q", s.delim, name)
+		}
+		ss.printf("%s OK LIST completed", tag)
+	case (cmd == "SELECT" || cmd == "EXAMINE") && len(args) == 1:
+		f := s.folders[args[0]]
+		if f == nil {
+			ss.selected = nil
+			ss.printf("%s NO no such mailbox", tag)
+			break
+		}
+		ss.selected = f
+		ss.printf("* FLAGS (\\Seen)")
+		ss.printf("* %d EXISTS", len(f.messages))
+		ss.printf("* 0 RECENT")
+		ss.printf("* OK [UIDVALIDITY %d] UIDs valid", f.uidvalidity)
+		ss.printf("* OK [UIDNEXT %d] predicted next UID", f.uidnext)
+		ss.printf("%s OK [READ-ONLY] %s completed", tag, cmd)
+	case (cmd == "FETCH" || cmd == "UID FETCH") && len(args) >= 2:
+		if ss.selected == nil {
+			ss.printf("%s BAD no mailbox selected", tag)
+			break
+		}
+		msgs := ss.selected.messages
+		var last uint32
+		if len(msgs) != 0 {
+			last = uint32(len(msgs))
+			if cmd == "UID FETCH" {
+				last = msgs[len(msgs)-1].uid
+			}
+		}
+		for i, msg := range msgs {
+			seq := uint32(i + 1)
+			id := seq
+			if cmd == "UID FETCH" {
+				id = msg.uid
+			}
+			if !inSet(args[0], id, last) {
+				continue
+			}
+			fmt.Fprintf(ss.w, "* %d FETCH (UID %d RFC822.HEADER {%d}\r\n%s RFC822.TEXT {%d}\r\n%s)\r\n",
+				seq, msg.uid, len(msg.header), msg.header, len(msg.text), msg.text)
+		}
+		ss.printf("%s OK %s completed", tag, cmd)
+	default:
+		ss.printf("%s BAD unknown command", tag)
+	}
+	return true
+}
+
+// splitArgs splits a command line into atoms and (unquoted) quoted strings
+func splitArgs(line string) []string {
+	var args []string
+	for line = strings.TrimSpace(line); line != ""; line = strings.TrimSpace(line) {
+		switch line[0] {
+		case '"':
+			var arg strings.Builder
+			i := 1
+			for ; i < len(line) && line[i] != '"'; i++ {
+				if line[i] == '\\' && i+1 < len(line) {
+					i++
+				}
+				arg.WriteByte(line[i])
+			}
+			args = append(args, arg.String())
+			line = line[min(i+1, len(line)):]
+		case '(':
+			i := strings.IndexByte(line, ')')
+			if i == -1 {
+				i = len(line) - 1
+			}
+			args = append(args, line[:i+1])
+			line = line[i+1:]
+		default:
+			i := strings.IndexByte(line, ' ')
+			if i == -1 {
+				i = len(line)
+			}
+			args = append(args, line[:i])
+			line = line[i:]
+		}
+	}
+	return args
+}
+
+// inSet reports whether id is in the RFC 3501 sequence set, "*" is last
+func inSet(set string, id, last uint32) bool {
+	num := func(s string) uint32 {
+		if s == "*" {
+			return last
+		}
+		n, _ := strconv.ParseUint(s, 10, 32)
+		return uint32(n)
+	}
+	for _, r := range strings.Split(set, ",") {
+		lo, hi, ok := strings.Cut(r, ":")
+		if !ok {
+			hi = lo
+		}
+		a, b := num(lo), num(hi)
+		if a > b {
+			a, b = b, a
+		}
+		if id >= a && id <= b {
+			return true
+		}
+	}
+	return false
+}
+
+func sortedKeys(m map[string]*fakeFolder) []string {
+	var keys []string
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
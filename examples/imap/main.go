@@ -1,12 +1,13 @@
 package main
 
 import (
-	"bytes"
+	"context"
 	"flag"
 	"fmt"
-	"net/mail"
 	"os"
+	"os/signal"
 	"path/filepath"
+	"syscall"
 	"time"
 
 	"github.com/aerth/mbox"
@@ -26,6 +27,10 @@ func main() {
 		user, pass              = os.Getenv("IMAP_USER"), os.Getenv("IMAP_PASS")
 		startnum, endnum string = "1", "5"
 		showversion      bool
+		syncmode         bool
+		folder           = "INBOX"
+		mirrordir        string
+		include, exclude string
 	)
 
 	flag.Usage = func() {
@@ -35,6 +40,8 @@ func main() {
 		fmt.Fprintf(os.Stderr, "\t  %s -f filename -a\n", exename)
 		fmt.Fprintf(os.Stderr, "\t  %s -f filename -seq 1:5\n", exename)
 		fmt.Fprintf(os.Stderr, "\t  %s -f filename -fetchfrom 1 -fetchto 5\n", exename)
+		fmt.Fprintf(os.Stderr, "\t  %s -f filename -sync [-folder INBOX]\n", exename)
+		fmt.Fprintf(os.Stderr, "\t  %s -mirror dir [-include 'INBOX,Work/*'] [-exclude 'Trash,Spam']\n", exename)
 		fmt.Fprintf(os.Stderr, "\n")
 		fmt.Fprintf(os.Stderr, "Environment variables:\n")
 		fmt.Fprintf(os.Stderr, "\tIMAP_USER\n")
@@ -50,6 +57,11 @@ func main() {
 	flag.StringVar(&seq, "seq", seq, "sequence of messages to fetch, eg: 1:5 or 1,2,3,4,5 or 1:*\nsee also -fetchfrom and -fetchto, comma separated RFC 3501 sequence-set ABNF rule")
 	flag.StringVar(&startnum, "fetchfrom", startnum, "start at including message number")
 	flag.StringVar(&endnum, "fetchto", endnum, "end including message number \ncan use * if your shell allows --fetchto=\\* or -fetchto=*\n")
+	flag.BoolVar(&syncmode, "sync", false, "incremental sync: fetch only messages not fetched before\nprogress is kept in the state file next to the mbox (filename.imapstate)")
+	flag.StringVar(&folder, "folder", folder, "folder to fetch from")
+	flag.StringVar(&mirrordir, "mirror", mirrordir, "sync every folder into a separate mbox file below this directory\nsubfolders become subdirectories, eg: dir/Work/Projects.mbox")
+	flag.StringVar(&include, "include", include, "with -mirror: comma separated folder patterns to sync (default all)\na pattern also matches the subfolders of a matching folder")
+	flag.StringVar(&exclude, "exclude", exclude, "with -mirror: comma separated folder patterns to skip")
 	flag.BoolVar(&showversion, "version", false, "show version and exit")
 	flag.Parse()
 	if showversion {
@@ -84,18 +96,9 @@ func main() {
 	// Remember to log out and close the connection when finished
 	defer c.Logout(30 * time.Second)
 
-	// Print server greeting (first response in the unilateral server data queue)
-	fmt.Println("Server says hello:", c.Data[0].Info)
-	c.Data = nil
-
-	// Enable encryption, if supported by the server
-	if c.Caps["STARTTLS"] {
-		c.StartTLS(nil)
-	}
-
-	// Authenticate
-	if c.State() == imap.Login {
-		c.Login(user, pass)
+	if err := login(c, user, pass); err != nil {
+		fmt.Println(err)
+		return
 	}
 
 	// List all top-level mailboxes, wait for the command to finish
@@ -105,11 +108,25 @@ func main() {
 		return
 	}
 
+	if syncmode || mirrordir != "" {
+		ctx, cancel := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+		defer cancel()
+		if mirrordir != "" {
+			err = runMirror(ctx, c, mirrordir, splitPatterns(include), splitPatterns(exclude))
+		} else {
+			err = runSync(ctx, c, filename, folder)
+		}
+		if err != nil {
+			fmt.Println(err)
+		}
+		return
+	}
+
 	// Open a mailbox (synchronous command - no need for imap.Wait)
-	c.Select("INBOX", true)
+	c.Select(folder, true)
 	fmt.Println("\nMailbox status:\n", c.Mailbox)
 
-	fmt.Println("Saving messages to mbox file: 'imap.mbox'")
+	fmt.Printf("Saving messages to mbox file: %q\n", filename)
 	// fetch all messages
 	var set *imap.SeqSet
 	if fetchAll {
@@ -142,18 +159,10 @@ func main() {
 	for cmd.InProgress() {
 		c.Recv(-1)
 		for _, rsp = range cmd.Data {
-			header := imap.AsBytes(rsp.MessageInfo().Attrs["RFC822.HEADER"])
-			if msg, _ := mail.ReadMessage(bytes.NewReader(header)); msg != nil {
-				body := imap.AsBytes(rsp.MessageInfo().Attrs["RFC822.TEXT"])
-				if len(body) > 0 {
-					var form mbox.Form
-					form.From = msg.Header.Get("Return-path")
-					form.Subject = msg.Header.Get("Subject")
-					form.Message = string(body)
-					mbox.Save(&form)
-					fmt.Printf("Message #%v saved to mbox\n", i)
-					i++
-				}
+			if form := formFromFetch(rsp.MessageInfo()); form != nil {
+				mbox.Save(form)
+				fmt.Printf("Message #%v saved to mbox\n", i)
+				i++
 			}
 		}
 		cmd.Data = nil
@@ -169,3 +178,27 @@ func main() {
 		}
 	}
 }
+
+// login prints the server greeting, enables encryption if supported and authenticates
+func login(c *imap.Client, user, pass string) error {
+	// Print server greeting (first response in the unilateral server data queue)
+	if len(c.Data) != 0 {
+		fmt.Println("Server says hello:", c.Data[0].Info)
+	}
+	c.Data = nil
+
+	// Enable encryption, if supported by the server
+	if c.Caps["STARTTLS"] {
+		if _, err := c.StartTLS(nil); err != nil {
+			return fmt.Errorf("starttls: %v", err)
+		}
+	}
+
+	// Authenticate
+	if c.State() == imap.Login {
+		if _, err := c.Login(user, pass); err != nil {
+			return fmt.Errorf("login: %v", err)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,131 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/xarg/imap"
+)
+
+// remoteFolder is a selectable folder returned by LIST
+type remoteFolder struct {
+	Name  string // server name, eg: "Work.Projects"
+	Delim string // hierarchy delimiter, eg: "." (empty for flat names)
+}
+
+// path returns the folder name with the hierarchy delimiter replaced by "/"
+func (f remoteFolder) path() string {
+	if f.Delim == "" || f.Delim == "/" {
+		return f.Name
+	}
+	return strings.Replace(f.Name, f.Delim, "/", -1)
+}
+
+// listFolders returns every selectable folder on the server (recursively)
+func listFolders(c *imap.Client) ([]remoteFolder, error) {
+	cmd, err := imap.Wait(c.List("", "*"))
+	if err != nil {
+		return nil, err
+	}
+	var folders []remoteFolder
+	for _, rsp := range cmd.Data {
+		info := rsp.MailboxInfo()
+		if info == nil || info.Attrs["\\Noselect"] || info.Attrs["\\NonExistent"] {
+			continue
+		}
+		folders = append(folders, remoteFolder{Name: info.Name, Delim: info.Delim})
+	}
+	cmd.Data = nil
+	sort.Slice(folders, func(i, j int) bool { return folders[i].Name < folders[j].Name })
+	return folders, nil
+}
+
+// splitPatterns splits a comma separated list of folder patterns
+func splitPatterns(s string) []string {
+	var patterns []string
+	for _, p := range strings.Split(s, ",") {
+		if p = strings.TrimSpace(p); p != "" {
+			patterns = append(patterns, p)
+		}
+	}
+	return patterns
+}
+
+// matchFolder reports whether a pattern (see path.Match) matches the folder
+// path or one of its parents, so "Trash" also matches "Trash/2016".
+func matchFolder(patterns []string, folderpath string) bool {
+	for _, pattern := range patterns {
+		for p := folderpath; p != "." && p != "/" && p != ""; p = path.Dir(p) {
+			if ok, _ := path.Match(pattern, p); ok {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// selectFolders applies include and exclude patterns, an empty include list includes everything
+func selectFolders(folders []remoteFolder, include, exclude []string) []remoteFolder {
+	var selected []remoteFolder
+	for _, f := range folders {
+		p := f.path()
+		if len(include) != 0 && !matchFolder(include, p) {
+			continue
+		}
+		if matchFolder(exclude, p) {
+			continue
+		}
+		selected = append(selected, f)
+	}
+	return selected
+}
+
+// mboxPath returns the mbox file for a folder inside dir,
+// each level of the folder hierarchy becomes a subdirectory.
+func mboxPath(dir string, f remoteFolder) string {
+	parts := strings.Split(f.path(), "/")
+	for i, part := range parts {
+		switch part {
+		case "", ".", "..":
+			part = "_" + part + "_"
+		}
+		parts[i] = strings.Replace(part, string(os.PathSeparator), "_", -1)
+	}
+	return filepath.Join(dir, filepath.Join(parts...)+".mbox")
+}
+
+// runMirror syncs every selected folder into its own mbox file below dir
+func runMirror(ctx context.Context, c *imap.Client, dir string, include, exclude []string) error {
+	folders, err := listFolders(c)
+	if err != nil {
+		return fmt.Errorf("list folders: %v", err)
+	}
+	folders = selectFolders(folders, include, exclude)
+	fmt.Printf("Mirroring %d folders to directory: %q\n", len(folders), dir)
+	var failed int
+	for _, f := range folders {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		filename := mboxPath(dir, f)
+		if err := os.MkdirAll(filepath.Dir(filename), 0700); err != nil {
+			return err
+		}
+		if err := runSync(ctx, c, filename, f.Name); err != nil {
+			if ctx.Err() != nil {
+				return err
+			}
+			fmt.Printf("%s: %v\n", f.Name, err)
+			failed++
+		}
+	}
+	if failed != 0 {
+		return fmt.Errorf("%d of %d folders failed", failed, len(folders))
+	}
+	return nil
+}
@@ -0,0 +1,191 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+
+	"github.com/aerth/mbox"
+	"github.com/xarg/imap"
+)
+
+// folderState is the sync position of a single IMAP folder
+type folderState struct {
+	UIDValidity uint32 `json:"uidvalidity"`
+	LastUID     uint32 `json:"lastuid"`
+}
+
+// syncState is stored next to the mbox file (see statePath) and records,
+// per folder, the UIDVALIDITY and the highest UID already written.
+type syncState struct {
+	Folders map[string]*folderState `json:"folders"`
+
+	path string
+}
+
+// statePath returns the state file name for an mbox file name
+func statePath(mboxfile string) string {
+	return mboxfile + ".imapstate"
+}
+
+// loadState reads the state file, a missing file is an empty state
+func loadState(path string) (*syncState, error) {
+	st := &syncState{Folders: map[string]*folderState{}, path: path}
+	b, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return st, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(b, st); err != nil {
+		return nil, fmt.Errorf("state file %q: %v", path, err)
+	}
+	if st.Folders == nil {
+		st.Folders = map[string]*folderState{}
+	}
+	return st, nil
+}
+
+// save writes the state file atomically (temp file + rename),
+// so an interrupted run never leaves a truncated state behind.
+func (st *syncState) save() error {
+	b, err := json.MarshalIndent(st, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(st.path), filepath.Base(st.path)+".tmp*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(b); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), st.path)
+}
+
+// folder returns the (possibly new) state for a folder name
+func (st *syncState) folder(name string) *folderState {
+	fs := st.Folders[name]
+	if fs == nil {
+		fs = &folderState{}
+		st.Folders[name] = fs
+	}
+	return fs
+}
+
+// formFromFetch builds a mbox.Form from a FETCH response, nil without a message
+func formFromFetch(info *imap.MessageInfo) *mbox.Form {
+	header := imap.AsBytes(info.Attrs["RFC822.HEADER"])
+	body := imap.AsBytes(info.Attrs["RFC822.TEXT"])
+	if len(header) == 0 || len(body) == 0 {
+		return nil
+	}
+	// a malformed MIME body still returns the parts read before the error
+	form, _ := mbox.ParseMessage(io.MultiReader(bytes.NewReader(header), bytes.NewReader(body)))
+	return form
+}
+
+// syncFolder appends the messages of folder with a UID above the last synced
+// one to out, all of them if its UIDVALIDITY changed
+func syncFolder(ctx context.Context, c *imap.Client, folder string, out *os.File, st *syncState) (int, error) {
+	if _, err := c.Select(folder, true); err != nil {
+		return 0, fmt.Errorf("select %q: %v", folder, err)
+	}
+	if c.Mailbox == nil {
+		return 0, fmt.Errorf("select %q: no such folder", folder)
+	}
+	fs := st.folder(folder)
+	if fs.UIDValidity != c.Mailbox.UIDValidity {
+		if fs.UIDValidity != 0 {
+			fmt.Printf("%s: UIDVALIDITY changed (%d -> %d), fetching all messages again\n",
+				folder, fs.UIDValidity, c.Mailbox.UIDValidity)
+		}
+		fs.UIDValidity = c.Mailbox.UIDValidity
+		fs.LastUID = 0
+		if err := st.save(); err != nil {
+			return 0, err
+		}
+	}
+	if c.Mailbox.Messages == 0 || (c.Mailbox.UIDNext != 0 && c.Mailbox.UIDNext <= fs.LastUID+1) {
+		return 0, nil // nothing new
+	}
+
+	set, err := imap.NewSeqSet(strconv.FormatUint(uint64(fs.LastUID)+1, 10) + ":*")
+	if err != nil {
+		return 0, err
+	}
+	cmd, err := c.UIDFetch(set, "RFC822.HEADER", "RFC822.TEXT")
+	if err != nil {
+		return 0, err
+	}
+	var n int
+	for cmd.InProgress() {
+		if err := ctx.Err(); err != nil {
+			return n, err
+		}
+		if err := c.Recv(-1); err != nil {
+			return n, err
+		}
+		for _, rsp := range cmd.Data {
+			info := rsp.MessageInfo()
+			// "n:*" always matches the highest UID, even if it is below n
+			if info == nil || info.UID <= fs.LastUID {
+				continue
+			}
+			if form := formFromFetch(info); form != nil {
+				if _, err := form.WriteTo(out); err != nil {
+					return n, err
+				}
+				if err := out.Sync(); err != nil {
+					return n, err
+				}
+				n++
+				fmt.Printf("%s: message UID %d saved to mbox\n", folder, info.UID)
+			}
+			fs.LastUID = info.UID
+			if err := st.save(); err != nil {
+				return n, err
+			}
+		}
+		cmd.Data = nil
+	}
+	if rsp, err := cmd.Result(imap.OK); err != nil {
+		if err == imap.ErrAborted || rsp == nil {
+			return n, fmt.Errorf("fetch: %v", err)
+		}
+		return n, fmt.Errorf("fetch error: %s", rsp.Info)
+	}
+	return n, nil
+}
+
+// runSync appends new messages of folder to the mbox file
+func runSync(ctx context.Context, c *imap.Client, filename, folder string) error {
+	st, err := loadState(statePath(filename))
+	if err != nil {
+		return err
+	}
+	out, err := os.OpenFile(filename, os.O_RDWR|os.O_CREATE|os.O_APPEND, 0600)
+	if err != nil {
+		return err
+	}
+	defer out.Close()
+	fmt.Printf("Syncing %q to mbox file: %q\n", folder, filename)
+	n, err := syncFolder(ctx, c, folder, out, st)
+	fmt.Printf("%s: %d new messages (last UID %d)\n", folder, n, st.folder(folder).LastUID)
+	return err
+}
@@ -0,0 +1,211 @@
+package main
+
+import (
+	"context"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/aerth/mbox"
+	"github.com/xarg/imap"
+)
+
+// dialFake connects and logs in to the fake server
+func dialFake(t *testing.T, s *fakeServer) *imap.Client {
+	t.Helper()
+	c, err := imap.Dial(s.Addr())
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { c.Logout(time.Second) })
+	if err := login(c, s.user, s.pass); err != nil {
+		t.Fatal(err)
+	}
+	return c
+}
+
+// readOutput returns the entries of an mbox file written by the client
+func readOutput(t *testing.T, file string) []*mbox.Entry {
+	t.Helper()
+	f, err := os.Open(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	entries, err := mbox.NewReader(f).ReadAll()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return entries
+}
+
+// checkRoundTrip compares subject and body of the fetched messages with the seed mbox
+func checkRoundTrip(t *testing.T, seedfile string, got []*mbox.Entry) {
+	t.Helper()
+	seed := readOutput(t, seedfile)
+	if len(got) != len(seed) {
+		t.Fatalf("expected %d messages, got %d", len(seed), len(got))
+	}
+	for i := range seed {
+		want, err := seed[i].Mail()
+		if err != nil {
+			t.Fatal(err)
+		}
+		msg, err := got[i].Mail()
+		if err != nil {
+			t.Fatalf("message %d: %v", i, err)
+		}
+		if w, g := want.Header.Get("Subject"), msg.Header.Get("Subject"); w != g {
+			t.Errorf("message %d: expected subject %q, got %q", i, w, g)
+		}
+		if w, g := want.Header.Get("Return-path"), msg.Header.Get("From"); !strings.Contains(g, strings.Trim(w, "<>")) {
+			t.Errorf("message %d: expected from %q, got %q", i, w, g)
+		}
+		wantbody, _ := io.ReadAll(want.Body)
+		gotbody, _ := io.ReadAll(msg.Body)
+		if w, g := strings.TrimSpace(string(wantbody)), strings.TrimSpace(string(gotbody)); w != g {
+			t.Errorf("message %d: expected body %q, got %q", i, w, g)
+		}
+	}
+}
+
+func TestSync(t *testing.T) {
+	s := newFakeServer(t, map[string]string{"INBOX": "testdata/inbox.mbox"})
+	c := dialFake(t, s)
+	filename := filepath.Join(t.TempDir(), "imap.mbox")
+	ctx := context.Background()
+
+	if err := runSync(ctx, c, filename, "INBOX"); err != nil {
+		t.Fatal(err)
+	}
+	checkRoundTrip(t, "testdata/inbox.mbox", readOutput(t, filename))
+
+	// nothing new: nothing is fetched again
+	if err := runSync(ctx, c, filename, "INBOX"); err != nil {
+		t.Fatal(err)
+	}
+	if n := len(readOutput(t, filename)); n != 3 {
+		t.Fatalf("expected 3 messages after second sync, got %d", n)
+	}
+
+	// only the new message is fetched
+	s.addMessage("INBOX", readMbox(t, "testdata/projects.mbox")[0])
+	if err := runSync(ctx, c, filename, "INBOX"); err != nil {
+		t.Fatal(err)
+	}
+	entries := readOutput(t, filename)
+	if len(entries) != 4 {
+		t.Fatalf("expected 4 messages after new message, got %d", len(entries))
+	}
+	checkRoundTrip(t, "testdata/projects.mbox", entries[3:])
+
+	// state survives a new connection
+	st, err := loadState(statePath(filename))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fs := st.Folders["INBOX"]; fs == nil || fs.LastUID != 4 || fs.UIDValidity != 1 {
+		t.Fatalf("unexpected state: %+v", fs)
+	}
+	c2 := dialFake(t, s)
+	if err := runSync(ctx, c2, filename, "INBOX"); err != nil {
+		t.Fatal(err)
+	}
+	if n := len(readOutput(t, filename)); n != 4 {
+		t.Fatalf("expected 4 messages after reconnect, got %d", n)
+	}
+
+	// UIDVALIDITY changed: everything is fetched again
+	s.renumber("INBOX")
+	if err := runSync(ctx, c2, filename, "INBOX"); err != nil {
+		t.Fatal(err)
+	}
+	if n := len(readOutput(t, filename)); n != 8 {
+		t.Fatalf("expected 8 messages after UIDVALIDITY change, got %d", n)
+	}
+}
+
+func TestSyncCanceled(t *testing.T) {
+	s := newFakeServer(t, map[string]string{"INBOX": "testdata/inbox.mbox"})
+	c := dialFake(t, s)
+	filename := filepath.Join(t.TempDir(), "imap.mbox")
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if err := runSync(ctx, c, filename, "INBOX"); err != context.Canceled {
+		t.Fatalf("expected context.Canceled, got %v", err)
+	}
+	st, err := loadState(statePath(filename))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fs := st.Folders["INBOX"]; fs == nil || fs.LastUID != 0 {
+		t.Fatalf("unexpected state: %+v", fs)
+	}
+}
+
+func TestMirror(t *testing.T) {
+	s := newFakeServer(t, map[string]string{
+		"INBOX":         "testdata/inbox.mbox",
+		"Work.Projects": "testdata/projects.mbox",
+		"Trash":         "testdata/projects.mbox",
+	})
+	c := dialFake(t, s)
+	dir := t.TempDir()
+	if err := runMirror(context.Background(), c, dir, nil, []string{"Trash"}); err != nil {
+		t.Fatal(err)
+	}
+	checkRoundTrip(t, "testdata/inbox.mbox", readOutput(t, filepath.Join(dir, "INBOX.mbox")))
+	checkRoundTrip(t, "testdata/projects.mbox", readOutput(t, filepath.Join(dir, "Work", "Projects.mbox")))
+	if _, err := os.Stat(filepath.Join(dir, "Trash.mbox")); !os.IsNotExist(err) {
+		t.Fatalf("excluded folder was mirrored: %v", err)
+	}
+}
+
+func TestLoginFailure(t *testing.T) {
+	s := newFakeServer(t, nil)
+	c, err := imap.Dial(s.Addr())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Logout(time.Second)
+	if err := login(c, s.user, "wrong"); err == nil {
+		t.Fatal("expected login error")
+	}
+}
+
+func TestSelectFolders(t *testing.T) {
+	folders := []remoteFolder{
+		{Name: "INBOX", Delim: "."},
+		{Name: "Trash", Delim: "."},
+		{Name: "Trash.2016", Delim: "."},
+		{Name: "Work.Projects", Delim: "."},
+		{Name: "Work.Clients", Delim: "."},
+	}
+	names := func(fs []remoteFolder) string {
+		var s []string
+		for _, f := range fs {
+			s = append(s, f.Name)
+		}
+		return strings.Join(s, ",")
+	}
+	for _, tc := range []struct {
+		include, exclude string
+		want             string
+	}{
+		{"", "", "INBOX,Trash,Trash.2016,Work.Projects,Work.Clients"},
+		{"", "Trash", "INBOX,Work.Projects,Work.Clients"},
+		{"Work/*", "", "Work.Projects,Work.Clients"},
+		{"Work", "Work/Clients", "Work.Projects"},
+	} {
+		got := names(selectFolders(folders, splitPatterns(tc.include), splitPatterns(tc.exclude)))
+		if got != tc.want {
+			t.Errorf("include %q exclude %q: expected %s, got %s", tc.include, tc.exclude, tc.want, got)
+		}
+	}
+	if p := mboxPath("backup", remoteFolder{Name: "Work.Projects", Delim: "."}); p != filepath.Join("backup", "Work", "Projects.mbox") {
+		t.Errorf("unexpected mbox path: %s", p)
+	}
+}
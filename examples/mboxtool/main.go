@@ -0,0 +1,273 @@
+// Command mboxtool lists, threads, flags and removes messages of a mbox file
+//
+//	mboxtool -f my.mbox list
+//	mboxtool -f my.mbox threads
+//	mboxtool -f my.mbox flag -index 3 -set read,old,replied
+//	mboxtool -f my.mbox expunge -index 0,2-4 -id '<42@localhost>'
+//	mboxtool -f my.mbox compact
+//
+// A running mbox writer waits while the file is rewritten, stop it first
+// where files can not be locked (not unix).
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/aerth/mbox"
+)
+
+func main() {
+	filename := "my.mbox"
+	flag.Usage = func() {
+		exename := filepath.Base(os.Args[0])
+		fmt.Fprintf(os.Stderr, "Usage of %s:\n", exename)
+		fmt.Fprintf(os.Stderr, "\t  %s -f filename list\n", exename)
+		fmt.Fprintf(os.Stderr, "\t  %s -f filename threads\n", exename)
+		fmt.Fprintf(os.Stderr, "\t  %s -f filename flag [-n] [-index 0,2-4] [-id message-id,...] [-deleted] [-set flags] [-clear flags]\n", exename)
+		fmt.Fprintf(os.Stderr, "\t  %s -f filename expunge [-n] [-index 0,2-4] [-id message-id,...] [-deleted]\n", exename)
+		fmt.Fprintf(os.Stderr, "\t  %s -f filename compact [-n]\n", exename)
+		fmt.Fprintf(os.Stderr, "\n")
+		fmt.Fprintf(os.Stderr, "Command line flags:\n")
+		flag.PrintDefaults()
+	}
+	flag.StringVar(&filename, "f", filename, "mbox filename")
+	flag.Parse()
+	if err := run(filename, flag.Args(), os.Stdout); err != nil {
+		if errors.Is(err, flag.ErrHelp) {
+			flag.Usage()
+			os.Exit(2)
+		}
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+}
+
+// run runs a command on the mbox file, writing its output to stdout
+func run(filename string, args []string, stdout io.Writer) error {
+	if len(args) == 0 {
+		return flag.ErrHelp
+	}
+	switch args[0] {
+	case "list":
+		return list(filename, stdout)
+	case "threads":
+		return threads(filename, stdout)
+	case "expunge", "compact":
+		return expunge(filename, args[0], args[1:], stdout)
+	case "flag":
+		return setFlags(filename, args[1:], stdout)
+	default:
+		return fmt.Errorf("unknown command %q: %w", args[0], flag.ErrHelp)
+	}
+}
+
+// list writes the index, flags, Message-ID, date, sender and subject of each message
+func list(filename string, stdout io.Writer) error {
+	entries, err := readEntries(filename)
+	if err != nil {
+		return err
+	}
+	tw := tabwriter.NewWriter(stdout, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(tw, "INDEX\tFLAGS\tMESSAGE-ID\tDATE\tFROM\tSUBJECT")
+	for i, e := range entries {
+		fmt.Fprintln(tw, strconv.Itoa(i)+"\t"+summary(e))
+	}
+	return tw.Flush()
+}
+
+// threads writes the conversations, the replies indented below the message
+// they reply to, "-" for a message missing from the file
+func threads(filename string, stdout io.Writer) error {
+	entries, err := readEntries(filename)
+	if err != nil {
+		return err
+	}
+	tw := tabwriter.NewWriter(stdout, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(tw, "INDEX\tFLAGS\tDATE\tFROM\tSUBJECT")
+	for _, thread := range mbox.Threads(entries) {
+		thread.Walk(func(t *mbox.Thread, depth int) {
+			index, flags, date, subject := "-", "", "", t.Subject
+			if t.Entry != nil {
+				index, flags = strconv.Itoa(t.Index), t.Entry.Flags().String()
+			}
+			if !t.Date.IsZero() {
+				date = t.Date.Format("2006-01-02 15:04")
+			}
+			switch {
+			case t.Entry == nil:
+				subject = t.MessageID
+			case t.Entry.Encrypted:
+				subject = "(encrypted)"
+			}
+			fmt.Fprintln(tw, strings.Join([]string{index, flags, date, t.From, strings.Repeat("  ", depth) + subject}, "\t"))
+		})
+	}
+	return tw.Flush()
+}
+
+// summary returns the tab separated flags, Message-ID, date, sender and subject of e
+func summary(e *mbox.Entry) string {
+	msg, err := e.Mail()
+	if err != nil {
+		return "\t\t\t\t(" + err.Error() + ")"
+	}
+	h := msg.Header
+	return strings.Join([]string{e.Flags().String(), h.Get("Message-Id"), h.Get("Date"), h.Get("From"), h.Get("Subject")}, "\t")
+}
+
+// selection is the messages selected by the command line flags
+type selection struct {
+	flags   *flag.FlagSet
+	dryrun  *bool
+	indexes *string
+	ids     *string
+	deleted *bool
+}
+
+// newSelection adds the flags selecting messages, deleted is the -deleted default
+func newSelection(command string, deleted bool) *selection {
+	flags := flag.NewFlagSet(command, flag.ContinueOnError)
+	return &selection{
+		flags:   flags,
+		dryrun:  flags.Bool("n", false, "list the selected messages, without changing them"),
+		indexes: flags.String("index", "", "comma separated indexes (from 0, see list) or ranges, eg: 0,2-4"),
+		ids:     flags.String("id", "", "comma separated Message-IDs"),
+		deleted: flags.Bool("deleted", deleted, "messages marked deleted, eg: by a mail client (X-Status: D)"),
+	}
+}
+
+// match parses args and returns the match of the selected messages of the
+// mbox file
+func (s *selection) match(filename string, args []string) (mbox.Match, error) {
+	if err := s.flags.Parse(args); err != nil {
+		return nil, err
+	}
+	var matches []mbox.Match
+	if *s.indexes != "" {
+		entries, err := readEntries(filename)
+		if err != nil {
+			return nil, err
+		}
+		list, err := parseIndexes(*s.indexes, len(entries))
+		if err != nil {
+			return nil, err
+		}
+		matches = append(matches, mbox.ByIndex(list...))
+	}
+	if *s.ids != "" {
+		matches = append(matches, mbox.ByMessageID(strings.Split(*s.ids, ",")...))
+	}
+	if *s.deleted {
+		matches = append(matches, mbox.Deleted)
+	}
+	if len(matches) == 0 {
+		return nil, fmt.Errorf("%s: no messages selected, use -index, -id or -deleted", s.flags.Name())
+	}
+	return func(index int, e *mbox.Entry) bool {
+		for _, m := range matches {
+			if m(index, e) {
+				return true
+			}
+		}
+		return false
+	}, nil
+}
+
+// show lists the selected messages, for -n
+func show(filename string, match mbox.Match, stdout io.Writer) error {
+	entries, err := readEntries(filename)
+	if err != nil {
+		return err
+	}
+	for i, e := range entries {
+		if match(i, e) {
+			fmt.Fprintln(stdout, strconv.Itoa(i)+"\t"+summary(e))
+		}
+	}
+	return nil
+}
+
+// expunge removes the selected messages, or those marked deleted (compact).
+// With -n, it only lists them.
+func expunge(filename, command string, args []string, stdout io.Writer) error {
+	s := newSelection(command, command == "compact")
+	match, err := s.match(filename, args)
+	if err != nil {
+		return err
+	}
+	if *s.dryrun {
+		return show(filename, match, stdout)
+	}
+	removed, err := mbox.Expunge(filename, match)
+	if err != nil {
+		return err
+	}
+	fmt.Fprintf(stdout, "%d messages removed from %s\n", removed, filename)
+	return nil
+}
+
+// setFlags sets, then clears flags of the selected messages.
+// With -n, it only lists them.
+func setFlags(filename string, args []string, stdout io.Writer) error {
+	s := newSelection("flag", false)
+	var set, clear mbox.Flags
+	s.flags.TextVar(&set, "set", mbox.Flags(0), "comma separated flags to set: read, old, replied, flagged, deleted")
+	s.flags.TextVar(&clear, "clear", mbox.Flags(0), "comma separated flags to clear, eg: read,old marks messages new")
+	match, err := s.match(filename, args)
+	if err != nil {
+		return err
+	}
+	if *s.dryrun {
+		return show(filename, match, stdout)
+	}
+	changed, err := mbox.SetFlags(filename, match, set, clear)
+	if err != nil {
+		return err
+	}
+	fmt.Fprintf(stdout, "%d messages changed in %s\n", changed, filename)
+	return nil
+}
+
+// parseIndexes parses comma separated indexes and ranges, eg: 0,2-4, of a
+// mbox file with count messages
+func parseIndexes(s string, count int) ([]int, error) {
+	var indexes []int
+	for _, field := range strings.Split(s, ",") {
+		first, last, isRange := strings.Cut(strings.TrimSpace(field), "-")
+		start, err := strconv.Atoi(first)
+		if err != nil {
+			return nil, fmt.Errorf("invalid index %q", field)
+		}
+		end := start
+		if isRange {
+			if end, err = strconv.Atoi(last); err != nil || end < start {
+				return nil, fmt.Errorf("invalid range %q", field)
+			}
+		}
+		if end >= count {
+			return nil, fmt.Errorf("index out of range %q: %d messages", field, count)
+		}
+		for i := start; i <= end; i++ {
+			indexes = append(indexes, i)
+		}
+	}
+	return indexes, nil
+}
+
+// readEntries reads all the messages of the mbox file
+func readEntries(filename string) ([]*mbox.Entry, error) {
+	f, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return mbox.NewReader(f).ReadAll()
+}
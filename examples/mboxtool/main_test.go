@@ -0,0 +1,111 @@
+package main
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/aerth/mbox"
+)
+
+// writeMbox writes n messages to a new mbox file, the last one marked deleted
+func writeMbox(t *testing.T, n int) string {
+	t.Helper()
+	filename := filepath.Join(t.TempDir(), "tool.mbox")
+	var buf bytes.Buffer
+	for i := 0; i < n; i++ {
+		form := mbox.Form{From: "alice@localhost", Subject: "message " + strconv.Itoa(i), Message: "hello",
+			MessageID: "<" + strconv.Itoa(i) + "@localhost>"}
+		if i == n-1 {
+			form.Flags = mbox.FlagDeleted
+		}
+		form.WriteTo(&buf)
+	}
+	if err := os.WriteFile(filename, buf.Bytes(), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return filename
+}
+
+func TestExpunge(t *testing.T) {
+	filename := writeMbox(t, 6)
+	var out bytes.Buffer
+	if err := run(filename, []string{"expunge", "-n", "-index", "0,2-3"}, &out); err != nil {
+		t.Fatal(err)
+	}
+	if got := strings.Count(out.String(), "\n"); got != 3 {
+		t.Errorf("dry run: expected 3 messages, got:\n%s", out.String())
+	}
+	out.Reset()
+	if err := run(filename, []string{"expunge", "-index", "0,2-3", "-id", "4@localhost"}, &out); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(out.String(), "4 messages removed") {
+		t.Errorf("unexpected output: %q", out.String())
+	}
+	out.Reset()
+	if err := run(filename, []string{"compact"}, &out); err != nil {
+		t.Fatal(err)
+	}
+	out.Reset()
+	if err := run(filename, []string{"list"}, &out); err != nil {
+		t.Fatal(err)
+	}
+	lines := strings.Split(strings.TrimSpace(out.String()), "\n")
+	if len(lines) != 2 || !strings.Contains(lines[1], "message 1") {
+		t.Errorf("unexpected list:\n%s", out.String())
+	}
+	for _, args := range [][]string{{"expunge"}, {"expunge", "-index", "3-1"}, {"expunge", "-index", "0-1000000000"},
+		{"flag", "-index", "2", "-set", "read"}, {"flag", "-index", "0", "-set", "starred"}, {"unknown"}} {
+		if err := run(filename, args, &out); err == nil {
+			t.Errorf("%q: expected error", args)
+		}
+	}
+}
+
+func TestFlag(t *testing.T) {
+	filename := writeMbox(t, 3)
+	var out bytes.Buffer
+	if err := run(filename, []string{"flag", "-index", "0-1", "-set", "read,old,flagged"}, &out); err != nil {
+		t.Fatal(err)
+	}
+	if err := run(filename, []string{"flag", "-id", "<1@localhost>", "-clear", "read,old"}, &out); err != nil {
+		t.Fatal(err)
+	}
+	out.Reset()
+	if err := run(filename, []string{"list"}, &out); err != nil {
+		t.Fatal(err)
+	}
+	lines := strings.Split(strings.TrimSpace(out.String()), "\n")
+	for i, want := range []string{"read,old,flagged", "new,flagged", "new,deleted"} {
+		if fields := strings.Fields(lines[i+1]); len(fields) < 2 || fields[1] != want {
+			t.Errorf("message %d: want flags %s, got %q", i, want, lines[i+1])
+		}
+	}
+}
+
+func TestThreads(t *testing.T) {
+	var buf bytes.Buffer
+	for _, form := range []mbox.Form{
+		{From: "alice@localhost", Subject: "help", Message: "it is broken", MessageID: "<1@localhost>"},
+		{From: "bob@localhost", Subject: "contact", Message: "hello", MessageID: "<2@localhost>"},
+		{From: "support@localhost", Subject: "Re: help", Message: "try again", MessageID: "<3@localhost>", InReplyTo: "<1@localhost>"},
+	} {
+		form.WriteTo(&buf)
+	}
+	filename := filepath.Join(t.TempDir(), "threads.mbox")
+	if err := os.WriteFile(filename, buf.Bytes(), 0600); err != nil {
+		t.Fatal(err)
+	}
+	var out bytes.Buffer
+	if err := run(filename, []string{"threads"}, &out); err != nil {
+		t.Fatal(err)
+	}
+	lines := strings.Split(strings.TrimSpace(out.String()), "\n")
+	if len(lines) != 4 || !strings.HasPrefix(lines[1], "0 ") || !strings.HasPrefix(lines[2], "2 ") || !strings.HasSuffix(lines[2], "  Re: help") {
+		t.Errorf("unexpected threads:\n%s", out.String())
+	}
+}
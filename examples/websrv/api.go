@@ -0,0 +1,425 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"mime"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/aerth/mbox"
+)
+
+// RegisterAPI adds the JSON API routes to mux, with the viewer credentials
+//
+//	GET    /api/messages                      list messages, newest first
+//	GET    /api/messages/{id}                 a single message
+//	GET    /api/messages/{id}/attachments/{n} download an attachment
+//	PATCH  /api/messages/{id}                 set and clear flags, eg: {"set": "flagged", "clear": "read,old"}
+//	DELETE /api/messages/{id}                 remove a message from the mbox file
+//
+// Message ids stay the same when other messages are deleted or flagged.
+// Flags are comma separated (see mbox.Flags), "new" is neither read nor old.
+// The list accepts these query parameters:
+//
+//	q        case insensitive text in From, Subject or the text body
+//	from     case insensitive text in From
+//	subject  case insensitive text in Subject
+//	since    only messages dated at or after, RFC 3339 or 2006-01-02
+//	until    only messages dated before, RFC 3339 or 2006-01-02
+//	limit    messages per response, default 50, max 500
+//	cursor   next_cursor of the previous response
+//
+// Errors are JSON objects: {"error": "message"}
+func (v *Viewer) RegisterAPI(mux *http.ServeMux) {
+	mux.HandleFunc("GET /api/messages", v.apiAuth(v.handleAPIList))
+	mux.HandleFunc("GET /api/messages/{id}", v.apiAuth(v.handleAPIMessage))
+	mux.HandleFunc("GET /api/messages/{id}/attachments/{n}", v.apiAuth(v.handleAPIAttachment))
+	mux.HandleFunc("PATCH /api/messages/{id}", v.apiAuth(v.handleAPIFlags))
+	mux.HandleFunc("DELETE /api/messages/{id}", v.apiAuth(v.handleAPIDelete))
+}
+
+// writeJSON writes v as the JSON response body
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		slog.Error("writing json response", "error", err)
+	}
+}
+
+// jsonError writes a JSON error response
+func jsonError(w http.ResponseWriter, status int, msg string) {
+	writeJSON(w, status, map[string]string{"error": msg})
+}
+
+// apiAuth requires HTTP basic authentication, like auth, with a JSON error
+func (v *Viewer) apiAuth(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if !v.authorized(r) {
+			w.Header().Set("WWW-Authenticate", `Basic realm="mbox", charset="UTF-8"`)
+			jsonError(w, http.StatusUnauthorized, "unauthorized")
+			return
+		}
+		next(w, r)
+	}
+}
+
+// apiError writes errors returned by entry and apiEntry
+func apiError(w http.ResponseWriter, err error) {
+	switch err {
+	case errNotFound:
+		jsonError(w, http.StatusNotFound, err.Error())
+	case errEncrypted:
+		jsonError(w, http.StatusForbidden, err.Error())
+	default:
+		slog.Error("api: reading mbox", "error", err)
+		jsonError(w, http.StatusInternalServerError, "error reading mbox")
+	}
+}
+
+// entryIDs returns a function returning the ids of the entries of the mbox
+// file, called in file order (see entryID)
+func entryIDs() func(*mbox.Entry) string {
+	seen := map[string]int{}
+	return func(entry *mbox.Entry) string {
+		id := entryID(entry, 0)
+		n := seen[id]
+		seen[id]++
+		if n == 0 {
+			return id
+		}
+		return entryID(entry, n)
+	}
+}
+
+// entryID returns the id of an entry without its Status headers, and n the
+// number of identical entries before it
+func entryID(entry *mbox.Entry, n int) string {
+	h := sha256.New()
+	io.WriteString(h, entry.Envelope+"\n")
+	raw := entry.Raw
+	if !entry.Encrypted {
+		raw = withoutStatus(raw)
+	}
+	h.Write(raw)
+	if n != 0 {
+		fmt.Fprintf(h, "\n%d", n)
+	}
+	return hex.EncodeToString(h.Sum(nil))[:16]
+}
+
+// withoutStatus returns raw without its Status and X-Status header lines
+func withoutStatus(raw []byte) []byte {
+	var out []byte
+	from := 0 // raw[from:] is not copied to out yet
+	for i := 0; i < len(raw); {
+		end := len(raw)
+		if n := bytes.IndexByte(raw[i:], '\n'); n >= 0 {
+			end = i + n + 1
+		}
+		line := raw[i:end]
+		if len(bytes.TrimRight(line, "\r\n")) == 0 {
+			break // end of the header
+		}
+		name, _, _ := bytes.Cut(line, []byte(":"))
+		if bytes.EqualFold(name, []byte("Status")) || bytes.EqualFold(name, []byte("X-Status")) {
+			out = append(out, raw[from:i]...)
+			from = end
+		}
+		i = end
+	}
+	if from == 0 {
+		return raw
+	}
+	return append(out, raw[from:]...)
+}
+
+// apiItem is a stored message, decrypted and parsed if possible
+type apiItem struct {
+	ID    string
+	Entry *mbox.Entry // as stored
+	Plain *mbox.Entry // decrypted, nil if it can not be decrypted
+	Form  *mbox.Form  // parsed Plain
+	Size  int
+}
+
+// apiItems reads every message in the mbox file
+func (v *Viewer) apiItems() ([]apiItem, error) {
+	entries, err := readEntries()
+	if err != nil {
+		return nil, err
+	}
+	items := make([]apiItem, len(entries))
+	id := entryIDs()
+	for i, entry := range entries {
+		items[i] = apiItem{ID: id(entry), Entry: entry, Size: len(entry.Raw)}
+		if dec, err := v.decrypt(entry); err == nil {
+			items[i].Plain = dec
+			items[i].Form, _ = dec.Form()
+		}
+	}
+	return items, nil
+}
+
+// apiEntry returns the item with the given id
+func (v *Viewer) apiEntry(id string) (apiItem, error) {
+	items, err := v.apiItems()
+	if err != nil {
+		return apiItem{}, err
+	}
+	for _, item := range items {
+		if item.ID == id {
+			if item.Form == nil {
+				return item, errEncrypted
+			}
+			return item, nil
+		}
+	}
+	return apiItem{}, errNotFound
+}
+
+type apiSummary struct {
+	ID        string     `json:"id"`
+	From      string     `json:"from,omitempty"`
+	To        string     `json:"to,omitempty"`
+	Subject   string     `json:"subject,omitempty"`
+	Date      string     `json:"date,omitempty"`
+	Size      int        `json:"size"`
+	Encrypted bool       `json:"encrypted"`
+	Flags     mbox.Flags `json:"flags"`
+}
+
+func (item apiItem) summary() apiSummary {
+	s := apiSummary{ID: item.ID, Size: item.Size, Encrypted: item.Entry.Encrypted, Flags: item.Entry.Flags()}
+	if item.Form != nil {
+		s.From, s.To, s.Subject = item.Form.From, item.Form.Headers["To"], item.Form.Subject
+		if !item.Form.Sent.IsZero() {
+			s.Date = item.Form.Sent.Format(time.RFC3339)
+		}
+	}
+	return s
+}
+
+// listFilter is the parsed list query
+type listFilter struct {
+	q, from, subject string
+	since, until     time.Time
+}
+
+// parseFilterTime accepts RFC 3339 and 2006-01-02
+func parseFilterTime(s string) (time.Time, error) {
+	if t, err := time.Parse(time.RFC3339, s); err == nil {
+		return t, nil
+	}
+	return time.Parse("2006-01-02", s)
+}
+
+func contains(s, substr string) bool {
+	return strings.Contains(strings.ToLower(s), substr)
+}
+
+func (f listFilter) match(item apiItem) bool {
+	if f == (listFilter{}) {
+		return true
+	}
+	if item.Form == nil {
+		return false // encrypted
+	}
+	s := item.summary()
+	if f.from != "" && !contains(s.From, f.from) {
+		return false
+	}
+	if f.subject != "" && !contains(s.Subject, f.subject) {
+		return false
+	}
+	if !f.since.IsZero() || !f.until.IsZero() {
+		t := item.Form.Sent
+		if t.IsZero() || (!f.since.IsZero() && t.Before(f.since)) || (!f.until.IsZero() && !t.Before(f.until)) {
+			return false
+		}
+	}
+	if f.q != "" && !contains(s.From, f.q) && !contains(s.Subject, f.q) &&
+		!contains(item.Form.Message, f.q) && !contains(item.Form.HTML, f.q) {
+		return false
+	}
+	return true
+}
+
+func (v *Viewer) handleAPIList(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	f := listFilter{
+		q:       strings.ToLower(query.Get("q")),
+		from:    strings.ToLower(query.Get("from")),
+		subject: strings.ToLower(query.Get("subject")),
+	}
+	var err error
+	if s := query.Get("since"); s != "" {
+		if f.since, err = parseFilterTime(s); err != nil {
+			jsonError(w, http.StatusBadRequest, "invalid since: "+s)
+			return
+		}
+	}
+	if s := query.Get("until"); s != "" {
+		if f.until, err = parseFilterTime(s); err != nil {
+			jsonError(w, http.StatusBadRequest, "invalid until: "+s)
+			return
+		}
+	}
+	limit := 50
+	if s := query.Get("limit"); s != "" {
+		limit, err = strconv.Atoi(s)
+		if err != nil || limit < 1 {
+			jsonError(w, http.StatusBadRequest, "invalid limit: "+s)
+			return
+		}
+		limit = min(limit, 500)
+	}
+	items, err := v.apiItems()
+	if err != nil {
+		apiError(w, err)
+		return
+	}
+	// newest first, starting after the cursor
+	start := len(items) - 1
+	if cursor := query.Get("cursor"); cursor != "" {
+		start = -2
+		for i, item := range items {
+			if item.ID == cursor {
+				start = i - 1
+				break
+			}
+		}
+		if start == -2 {
+			jsonError(w, http.StatusBadRequest, "invalid cursor, message was deleted")
+			return
+		}
+	}
+	resp := struct {
+		Messages   []apiSummary `json:"messages"`
+		NextCursor string       `json:"next_cursor,omitempty"`
+	}{Messages: []apiSummary{}}
+	for i := start; i >= 0; i-- {
+		if !f.match(items[i]) {
+			continue
+		}
+		if len(resp.Messages) == limit {
+			resp.NextCursor = resp.Messages[limit-1].ID
+			break
+		}
+		resp.Messages = append(resp.Messages, items[i].summary())
+	}
+	writeJSON(w, http.StatusOK, resp)
+}
+
+type apiAttachment struct {
+	Index       int    `json:"index"`
+	Filename    string `json:"filename,omitempty"`
+	ContentType string `json:"content_type"`
+	Size        int    `json:"size"`
+	URL         string `json:"url"`
+}
+
+type apiMessage struct {
+	apiSummary
+	Headers     map[string][]string `json:"headers"`
+	Text        string              `json:"text"`
+	HTML        string              `json:"html,omitempty"` // sanitized
+	Attachments []apiAttachment     `json:"attachments"`
+}
+
+func (v *Viewer) handleAPIMessage(w http.ResponseWriter, r *http.Request) {
+	item, err := v.apiEntry(r.PathValue("id"))
+	if err != nil {
+		apiError(w, err)
+		return
+	}
+	resp := apiMessage{
+		apiSummary:  item.summary(),
+		Text:        item.Form.Message,
+		HTML:        htmlPolicy.Sanitize(item.Form.HTML),
+		Attachments: []apiAttachment{},
+	}
+	// the body was read by Form, parse a fresh copy for the headers
+	if msg, err := item.Plain.Mail(); err == nil {
+		resp.Headers = msg.Header
+	}
+	for i, a := range item.Form.Attachments {
+		resp.Attachments = append(resp.Attachments, apiAttachment{
+			Index:       i,
+			Filename:    a.Filename,
+			ContentType: a.ContentType,
+			Size:        len(a.Data),
+			URL:         "/api/messages/" + item.ID + "/attachments/" + strconv.Itoa(i),
+		})
+	}
+	writeJSON(w, http.StatusOK, resp)
+}
+
+func (v *Viewer) handleAPIAttachment(w http.ResponseWriter, r *http.Request) {
+	item, err := v.apiEntry(r.PathValue("id"))
+	if err != nil {
+		apiError(w, err)
+		return
+	}
+	n, err := strconv.Atoi(r.PathValue("n"))
+	if err != nil || n < 0 || n >= len(item.Form.Attachments) {
+		jsonError(w, http.StatusNotFound, "attachment not found")
+		return
+	}
+	p := item.Form.Attachments[n]
+	filename := p.Filename
+	if filename == "" {
+		filename = "attachment-" + strconv.Itoa(n)
+	}
+	w.Header().Set("Content-Type", "application/octet-stream")
+	w.Header().Set("Content-Disposition", mime.FormatMediaType("attachment", map[string]string{"filename": filename}))
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.Write(p.Data)
+}
+
+func (v *Viewer) handleAPIFlags(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		Set   mbox.Flags `json:"set"`
+		Clear mbox.Flags `json:"clear"`
+	}
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 4096)).Decode(&req); err != nil {
+		jsonError(w, http.StatusBadRequest, "invalid json: "+err.Error())
+		return
+	}
+	id, entryID := r.PathValue("id"), entryIDs()
+	if _, err := flagMbox(func(_ int, entry *mbox.Entry) bool { return entryID(entry) == id }, req.Set, req.Clear); err != nil {
+		apiError(w, err)
+		return
+	}
+	item, err := v.apiEntry(id)
+	if err != nil {
+		apiError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, item.summary())
+}
+
+func (v *Viewer) handleAPIDelete(w http.ResponseWriter, r *http.Request) {
+	id, entryID := r.PathValue("id"), entryIDs()
+	removed, err := rewriteMbox(func(entry *mbox.Entry) bool {
+		return entryID(entry) != id
+	})
+	if err != nil {
+		apiError(w, err)
+		return
+	}
+	if removed == 0 {
+		jsonError(w, http.StatusNotFound, errNotFound.Error())
+		return
+	}
+	slog.Info("api: message deleted", "id", id)
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,253 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/aerth/mbox"
+)
+
+// flushMbox waits until queued messages are written and closes the mbox file
+func flushMbox(t *testing.T) {
+	t.Helper()
+	if _, err := rewriteMbox(func(*mbox.Entry) bool { return true }); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func newTestServer(t *testing.T) *httptest.Server {
+	t.Helper()
+	mboxname = filepath.Join(t.TempDir(), "test.mbox")
+	t.Cleanup(func() { flushMbox(t) })
+	mux := http.NewServeMux()
+	mux.HandleFunc("/", Handler)
+	v := &Viewer{User: "admin", Password: "secret"}
+	v.Register(mux)
+	v.RegisterAPI(mux)
+	srv := httptest.NewServer(mux)
+	t.Cleanup(srv.Close)
+	return srv
+}
+
+func doJSON(t *testing.T, method, url, body string, auth bool, v interface{}) int {
+	t.Helper()
+	req, err := http.NewRequest(method, url, strings.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if body != "" {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	if auth {
+		req.SetBasicAuth("admin", "secret")
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if v != nil && resp.StatusCode != http.StatusNoContent {
+		if ct := resp.Header.Get("Content-Type"); ct != "application/json" {
+			t.Fatalf("%s %s: expected json response, got %q", method, url, ct)
+		}
+		if err := json.NewDecoder(resp.Body).Decode(v); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return resp.StatusCode
+}
+
+func TestAPI(t *testing.T) {
+	srv := newTestServer(t)
+	var errResp map[string]string
+
+	if code := doJSON(t, "POST", srv.URL+"/", `{"from":"alice@localhost"`, false, &errResp); code != http.StatusBadRequest || errResp["error"] == "" {
+		t.Fatalf("invalid json: expected 400 with error, got %d %v", code, errResp)
+	}
+	if code := doJSON(t, "POST", srv.URL+"/", `{}`, false, &errResp); code != http.StatusBadRequest {
+		t.Fatalf("empty message: expected 400, got %d", code)
+	}
+	for _, subject := range []string{"first", "second", "third"} {
+		body := `{"from":"alice@localhost","subject":"` + subject + `","message":"hello ` + subject + `"}`
+		if code := doJSON(t, "POST", srv.URL+"/", body, false, nil); code != http.StatusAccepted {
+			t.Fatalf("submit: expected 202, got %d", code)
+		}
+	}
+	flushMbox(t)
+
+	if code := doJSON(t, "GET", srv.URL+"/api/messages", "", false, &errResp); code != http.StatusUnauthorized {
+		t.Fatalf("expected 401 without credentials, got %d", code)
+	}
+
+	type list struct {
+		Messages []struct {
+			ID      string `json:"id"`
+			Subject string `json:"subject"`
+		} `json:"messages"`
+		NextCursor string `json:"next_cursor"`
+	}
+	var page list
+	if code := doJSON(t, "GET", srv.URL+"/api/messages?limit=2", "", true, &page); code != http.StatusOK {
+		t.Fatalf("list: expected 200, got %d", code)
+	}
+	if len(page.Messages) != 2 || page.Messages[0].Subject != "third" || page.NextCursor == "" {
+		t.Fatalf("unexpected first page: %+v", page)
+	}
+	var page2 list
+	doJSON(t, "GET", srv.URL+"/api/messages?limit=2&cursor="+page.NextCursor, "", true, &page2)
+	if len(page2.Messages) != 1 || page2.Messages[0].Subject != "first" || page2.NextCursor != "" {
+		t.Fatalf("unexpected second page: %+v", page2)
+	}
+	var found list
+	doJSON(t, "GET", srv.URL+"/api/messages?q=HELLO+SECOND", "", true, &found)
+	if len(found.Messages) != 1 || found.Messages[0].Subject != "second" {
+		t.Fatalf("unexpected search result: %+v", found)
+	}
+
+	id := found.Messages[0].ID
+	var msg struct {
+		Subject     string              `json:"subject"`
+		Text        string              `json:"text"`
+		Headers     map[string][]string `json:"headers"`
+		Attachments []interface{}       `json:"attachments"`
+	}
+	if code := doJSON(t, "GET", srv.URL+"/api/messages/"+id, "", true, &msg); code != http.StatusOK {
+		t.Fatalf("get: expected 200, got %d", code)
+	}
+	if msg.Subject != "second" || strings.TrimSpace(msg.Text) != "hello second" || len(msg.Headers["From"]) != 1 {
+		t.Fatalf("unexpected message: %+v", msg)
+	}
+
+	// flags, the id stays the same
+	var summary struct {
+		ID    string `json:"id"`
+		Flags string `json:"flags"`
+	}
+	if code := doJSON(t, "PATCH", srv.URL+"/api/messages/"+id, `{"set":"flagged,replied"}`, true, &summary); code != http.StatusOK {
+		t.Fatalf("patch: expected 200, got %d", code)
+	}
+	if summary.ID != id || summary.Flags != "new,replied,flagged" {
+		t.Fatalf("unexpected flags: %+v", summary)
+	}
+	if code := doJSON(t, "PATCH", srv.URL+"/api/messages/"+id, `{"set":"starred"}`, true, &errResp); code != http.StatusBadRequest {
+		t.Fatalf("patch unknown flag: expected 400, got %d", code)
+	}
+	req, _ := http.NewRequest("POST", srv.URL+"/messages/"+id+"/read", nil) // the viewer and API ids are the same
+	req.SetBasicAuth("admin", "secret")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if code := doJSON(t, "PATCH", srv.URL+"/api/messages/"+id, `{"clear":"replied"}`, true, &summary); code != http.StatusOK {
+		t.Fatalf("patch: expected 200, got %d", code)
+	}
+	if summary.ID != id || summary.Flags != "read,old,flagged" {
+		t.Fatalf("unexpected flags after marking read: %+v", summary)
+	}
+
+	if code := doJSON(t, "DELETE", srv.URL+"/api/messages/"+id, "", true, nil); code != http.StatusNoContent {
+		t.Fatalf("delete: expected 204, got %d", code)
+	}
+	if code := doJSON(t, "DELETE", srv.URL+"/api/messages/"+id, "", true, &errResp); code != http.StatusNotFound {
+		t.Fatalf("delete again: expected 404, got %d", code)
+	}
+	if code := doJSON(t, "GET", srv.URL+"/api/messages/"+id, "", true, &errResp); code != http.StatusNotFound {
+		t.Fatalf("get deleted: expected 404, got %d", code)
+	}
+
+	// the writer is opened again after the rewrite
+	if code := doJSON(t, "POST", srv.URL+"/", `{"subject":"fourth","message":"after delete"}`, false, nil); code != http.StatusAccepted {
+		t.Fatalf("submit after delete: expected 202, got %d", code)
+	}
+	flushMbox(t)
+	var all list
+	doJSON(t, "GET", srv.URL+"/api/messages", "", true, &all)
+	var subjects []string
+	for _, m := range all.Messages {
+		subjects = append(subjects, m.Subject)
+	}
+	if got := strings.Join(subjects, ","); got != "fourth,third,first" {
+		t.Fatalf("unexpected messages after delete: %s", got)
+	}
+}
+
+func TestThreads(t *testing.T) {
+	srv := newTestServer(t)
+	for _, body := range []string{
+		`{"from":"alice@localhost","subject":"help","message":"it is broken","messageid":"<1@localhost>"}`,
+		`{"from":"bob@localhost","subject":"other","message":"hello"}`,
+		`{"from":"support@localhost","subject":"Re: help","message":"try again","inreplyto":"<1@localhost>"}`,
+	} {
+		if code := doJSON(t, "POST", srv.URL+"/", body, false, nil); code != http.StatusAccepted {
+			t.Fatalf("submit: expected 202, got %d", code)
+		}
+	}
+	flushMbox(t)
+	req, _ := http.NewRequest("GET", srv.URL+"/threads", nil)
+	req.SetBasicAuth("admin", "secret")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	page, _ := io.ReadAll(resp.Body)
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("expected 200, got %d", resp.StatusCode)
+	}
+	// the thread with the latest message first, the reply indented
+	help, reply, other := strings.Index(string(page), ">help<"), strings.Index(string(page), `padding-left: 2em"><a href="/messages/`+viewerIDs(t)[2]+`">Re: help<`), strings.Index(string(page), ">other<")
+	if help < 0 || reply < help || other < reply || !strings.Contains(string(page), "2 threads, 3 messages") {
+		t.Errorf("unexpected page:\n%s", page)
+	}
+}
+
+// byte-identical entries, eg: a form submitted twice, have their own ids
+func TestAPIDuplicates(t *testing.T) {
+	srv := newTestServer(t)
+	opts := mbox.Options{
+		Clock:     func() time.Time { return time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC) },
+		MessageID: func() string { return "<1@localhost>" },
+	}
+	var buf bytes.Buffer
+	for i := 0; i < 2; i++ {
+		form := mbox.Form{From: "alice@localhost", Subject: "twice", Message: "hello"}
+		if _, err := form.WriteWith(&buf, opts); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := os.WriteFile(mboxname, buf.Bytes(), 0600); err != nil {
+		t.Fatal(err)
+	}
+	type list struct {
+		Messages []struct {
+			ID    string     `json:"id"`
+			Flags mbox.Flags `json:"flags"`
+		} `json:"messages"`
+	}
+	var before list
+	doJSON(t, "GET", srv.URL+"/api/messages", "", true, &before)
+	if len(before.Messages) != 2 || before.Messages[0].ID == before.Messages[1].ID {
+		t.Fatalf("expected 2 messages with different ids, got %+v", before.Messages)
+	}
+	newer, older := before.Messages[0].ID, before.Messages[1].ID
+	if code := doJSON(t, "PATCH", srv.URL+"/api/messages/"+older, `{"set":"flagged"}`, true, nil); code != http.StatusOK {
+		t.Fatalf("patch: expected 200, got %d", code)
+	}
+	if code := doJSON(t, "DELETE", srv.URL+"/api/messages/"+newer, "", true, nil); code != http.StatusNoContent {
+		t.Fatalf("delete: expected 204, got %d", code)
+	}
+	var after list
+	doJSON(t, "GET", srv.URL+"/api/messages", "", true, &after)
+	if len(after.Messages) != 1 || after.Messages[0].ID != older || after.Messages[0].Flags != mbox.FlagFlagged {
+		t.Errorf("expected the flagged older message %s only, got %+v", older, after.Messages)
+	}
+}
@@ -0,0 +1,403 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	htmltemplate "html/template"
+	"log/slog"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"text/tabwriter"
+	"text/template"
+	"time"
+
+	"github.com/aerth/mbox"
+)
+
+// Config describes the form endpoints, loaded from a JSON file (-config flag)
+//
+//	{
+//	  "mailboxes": {
+//	    "support": {"file": "support.mbox", "age": "age1..."}
+//	  },
+//	  "endpoints": [{
+//	    "path": "/support",
+//	    "mailbox": "support",
+//	    "page": "support.html",
+//	    "fields": {"name": "name", "email": "email", "subject": "topic", "message": "message"},
+//	    "headers": {"X-Order": "order"},
+//	    "table": ["phone", "order"],
+//	    "required": ["email", "message"],
+//	    "validate": {"phone": "^[0-9 +-]{6,20}$"},
+//	    "text_template": "support.txt",
+//	    "html_template": "support.tmpl.html"
+//	  }]
+//	}
+//
+// Endpoints without a mailbox write to the -mbox file.
+type Config struct {
+	Mailboxes map[string]*MailboxConfig `json:"mailboxes"`
+	Endpoints []*Endpoint               `json:"endpoints"`
+}
+
+// MailboxConfig is a named mbox file
+type MailboxConfig struct {
+	File     string `json:"file"`
+	Age      string `json:"age"`      // optional age recipient
+	Timezone string `json:"timezone"` // optional time zone of the envelope dates, default -timezone
+
+	location *time.Location
+
+	mailbox *mbox.Mailbox
+}
+
+// Endpoint is a form accepting submissions at Path
+type Endpoint struct {
+	Path     string            `json:"path"`     // eg: /contact
+	Mailbox  string            `json:"mailbox"`  // mailbox name, default the -mbox file
+	Page     string            `json:"page"`     // optional html file served on GET, relative to the config file
+	Redirect string            `json:"redirect"` // after a submission, default Path?sent
+	Fields   FieldMap          `json:"fields"`   // fields of the message
+	Headers  map[string]string `json:"headers"`  // header name: field, added to the message header
+	Table    []string          `json:"table"`    // fields listed in a table below the message
+	Required []string          `json:"required"` // fields that must not be empty
+	Validate map[string]string `json:"validate"` // field: regular expression, checked if not empty
+
+	// TextTemplate and HTMLTemplate render the message body and its HTML
+	// alternative (see TemplateData), relative to the config file
+	TextTemplate string `json:"text_template"`
+	HTMLTemplate string `json:"html_template"`
+
+	page     []byte
+	validate map[string]*regexp.Regexp
+	text     *template.Template
+	html     *htmltemplate.Template
+	mailbox  *mbox.Mailbox // nil for the -mbox file
+}
+
+// TemplateData is rendered by the endpoint templates
+type TemplateData struct {
+	Name, Email, Subject, Message string
+	Fields                        map[string]string // every submitted field
+	Table                         []TableRow        // the Table fields, in order, if not empty
+	Path                          string            // the endpoint path
+	Received                      time.Time
+}
+
+// TableRow is a field listed in the Table
+type TableRow struct {
+	Field, Value string
+}
+
+// FieldMap names the form fields of the message, the defaults are
+// name, email, subject and message
+type FieldMap struct {
+	Name    string `json:"name"`
+	Email   string `json:"email"`
+	Subject string `json:"subject"`
+	Message string `json:"message"`
+}
+
+// LoadConfig reads and checks a config file
+func LoadConfig(filename string) (*Config, error) {
+	b, err := os.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	var c Config
+	if err := json.Unmarshal(b, &c); err != nil {
+		return nil, fmt.Errorf("%s: %v", filename, err)
+	}
+	if err := c.check(filepath.Dir(filename)); err != nil {
+		return nil, fmt.Errorf("%s: %v", filename, err)
+	}
+	return &c, nil
+}
+
+// check checks the config, compiles the regular expressions and reads the
+// pages, relative to dir
+func (c *Config) check(dir string) error {
+	for name, mc := range c.Mailboxes {
+		if mc == nil || mc.File == "" {
+			return fmt.Errorf("mailbox %q: missing file", name)
+		}
+		if mc.Timezone != "" {
+			loc, err := time.LoadLocation(mc.Timezone)
+			if err != nil {
+				return fmt.Errorf("mailbox %q: %v", name, err)
+			}
+			mc.location = loc
+		}
+	}
+	paths := map[string]bool{}
+	for i, ep := range c.Endpoints {
+		if ep == nil || !strings.HasPrefix(ep.Path, "/") {
+			return fmt.Errorf("endpoint %d: path must start with /", i+1)
+		}
+		if paths[ep.Path] {
+			return fmt.Errorf("endpoint %s: duplicate path", ep.Path)
+		}
+		paths[ep.Path] = true
+		if ep.Mailbox != "" && c.Mailboxes[ep.Mailbox] == nil {
+			return fmt.Errorf("endpoint %s: unknown mailbox %q", ep.Path, ep.Mailbox)
+		}
+		if ep.Fields == (FieldMap{}) {
+			ep.Fields = FieldMap{"name", "email", "subject", "message"}
+		}
+		if ep.Redirect == "" {
+			ep.Redirect = ep.Path + "?sent"
+		}
+		ep.validate = map[string]*regexp.Regexp{}
+		for field, expr := range ep.Validate {
+			re, err := regexp.Compile(expr)
+			if err != nil {
+				return fmt.Errorf("endpoint %s: field %s: %v", ep.Path, field, err)
+			}
+			ep.validate[field] = re
+		}
+		if ep.Page != "" {
+			b, err := os.ReadFile(configPath(dir, ep.Page))
+			if err != nil {
+				return fmt.Errorf("endpoint %s: %v", ep.Path, err)
+			}
+			ep.page = b
+		}
+		var err error
+		if ep.TextTemplate != "" {
+			if ep.text, err = template.ParseFiles(configPath(dir, ep.TextTemplate)); err != nil {
+				return fmt.Errorf("endpoint %s: %v", ep.Path, err)
+			}
+		}
+		if ep.HTMLTemplate != "" {
+			if ep.html, err = htmltemplate.ParseFiles(configPath(dir, ep.HTMLTemplate)); err != nil {
+				return fmt.Errorf("endpoint %s: %v", ep.Path, err)
+			}
+		}
+	}
+	return nil
+}
+
+// configPath returns filename relative to the config file directory
+func configPath(dir, filename string) string {
+	if filepath.IsAbs(filename) {
+		return filename
+	}
+	return filepath.Join(dir, filename)
+}
+
+// Open opens the mailboxes
+func (c *Config) Open(ctx context.Context) error {
+	for name, mc := range c.Mailboxes {
+		mc.mailbox = &mbox.Mailbox{Filename: mc.File, AgeRecipient: mc.Age, Hooks: hooks, Sinks: sinks, Overflow: mbox.OverflowPolicy}
+		if mc.location != nil {
+			opts := mbox.DefaultOptions
+			opts.Location = mc.location
+			mc.mailbox.Options = &opts
+		}
+		if err := mc.mailbox.Open(ctx); err != nil {
+			c.Close()
+			return fmt.Errorf("mailbox %q: %v", name, err)
+		}
+	}
+	for _, ep := range c.Endpoints {
+		if ep.Mailbox != "" {
+			ep.mailbox = c.Mailboxes[ep.Mailbox].mailbox
+		}
+	}
+	return nil
+}
+
+// Close closes the mailboxes
+func (c *Config) Close() {
+	for _, mc := range c.Mailboxes {
+		if mc.mailbox != nil {
+			mc.mailbox.Close()
+		}
+	}
+}
+
+// Shutdown writes the queued messages and closes the mailboxes,
+// until ctx is done (see mbox.Mailbox.Shutdown)
+func (c *Config) Shutdown(ctx context.Context) error {
+	var errs []error
+	for name, mc := range c.Mailboxes {
+		if mc.mailbox == nil {
+			continue
+		}
+		if _, _, err := mc.mailbox.Shutdown(ctx); err != nil {
+			errs = append(errs, fmt.Errorf("mailbox %q: %v", name, err))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// Register adds the endpoints to mux, checked by g
+func (c *Config) Register(mux *http.ServeMux, g *Guard) {
+	for _, ep := range c.Endpoints {
+		mux.HandleFunc(ep.Path, g.Wrap(ep.ServeHTTP))
+	}
+}
+
+// hasPath reports whether an endpoint is configured at path
+func (c *Config) hasPath(path string) bool {
+	for _, ep := range c.Endpoints {
+		if ep.Path == path {
+			return true
+		}
+	}
+	return false
+}
+
+// ServeHTTP serves the page on GET and saves submitted forms on POST
+func (ep *Endpoint) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case "GET", "HEAD":
+		if len(ep.page) == 0 {
+			http.NotFound(w, r)
+			return
+		}
+		w.Write(guard.Page(ep.page))
+		return
+	case "POST":
+	default:
+		w.Header().Set("Allow", "GET, POST")
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+		return
+	}
+	if err := parseRequestForm(r); err != nil {
+		slog.Warn("invalid form", "path", ep.Path, "error", err)
+		http.Error(w, "invalid form", http.StatusBadRequest)
+		return
+	}
+	msg, err := ep.message(r)
+	if err != nil {
+		var rej *rejection
+		if !errors.As(err, &rej) {
+			rej = &rejection{http.StatusBadRequest, err.Error()}
+		}
+		slog.Warn("submission rejected", "path", ep.Path, "client", guard.clientIP(r), "status", rej.status, "reason", rej.reason)
+		countRejection(rej.status)
+		http.Error(w, rej.reason, rej.status)
+		return
+	}
+	ctx, cancel := saveContext(r)
+	defer cancel()
+	if ep.mailbox != nil {
+		err = ep.mailbox.SaveContext(ctx, msg)
+	} else {
+		err = saveMessage(ctx, msg)
+	}
+	if err != nil {
+		status, reason := saveError(w, err)
+		slog.Log(r.Context(), statusLevel(status), "saving message", "path", ep.Path, "status", status, "error", err)
+		http.Error(w, reason, status)
+		return
+	}
+	slog.Info("message received", "path", ep.Path, "type", "form", "bytes", len(msg.Message), "attachments", len(msg.Attachments))
+	http.Redirect(w, r, ep.Redirect, http.StatusFound)
+}
+
+// message checks the submitted form and builds the message
+func (ep *Endpoint) message(r *http.Request) (*mbox.Form, error) {
+	value := func(field string) string {
+		return strings.TrimSpace(r.PostFormValue(field))
+	}
+	for _, field := range ep.Required {
+		if value(field) == "" {
+			return nil, fmt.Errorf("missing field: %s", field)
+		}
+	}
+	for field, re := range ep.validate {
+		if v := value(field); v != "" && !re.MatchString(v) {
+			return nil, fmt.Errorf("invalid field: %s", field)
+		}
+	}
+	msg := mbox.NewMessage(value(ep.Fields.Name), value(ep.Fields.Email), value(ep.Fields.Subject), value(ep.Fields.Message))
+	msg.Trace = []mbox.Trace{httpTrace(r)}
+	for header, field := range ep.Headers {
+		if v := value(field); v != "" {
+			if msg.Headers == nil {
+				msg.Headers = map[string]string{}
+			}
+			msg.Headers[header] = v
+		}
+	}
+	var rows []TableRow
+	for _, field := range ep.Table {
+		if v := value(field); v != "" {
+			rows = append(rows, TableRow{field, v})
+		}
+	}
+	if ep.text == nil {
+		if table := formatTable(rows); table != "" {
+			if msg.Message != "" {
+				msg.Message += "\n\n"
+			}
+			msg.Message += table
+		}
+	}
+	if ep.text != nil || ep.html != nil {
+		data := TemplateData{
+			Name:     value(ep.Fields.Name),
+			Email:    value(ep.Fields.Email),
+			Subject:  value(ep.Fields.Subject),
+			Message:  value(ep.Fields.Message),
+			Fields:   map[string]string{},
+			Table:    rows,
+			Path:     ep.Path,
+			Received: time.Now().UTC(),
+		}
+		for field := range r.PostForm {
+			data.Fields[field] = value(field)
+		}
+		if err := ep.render(&msg, data); err != nil {
+			slog.Error("rendering template", "path", ep.Path, "error", err)
+			return nil, &rejection{http.StatusInternalServerError, "error rendering message"}
+		}
+	}
+	if msg.Message == "" && msg.Subject == "" && msg.From == "" {
+		return nil, errors.New("empty message")
+	}
+	var err error
+	msg.Attachments, err = uploads.formAttachments(r.MultipartForm)
+	if err != nil {
+		return nil, err
+	}
+	return &msg, nil
+}
+
+// render renders the message body templates
+func (ep *Endpoint) render(msg *mbox.Form, data TemplateData) error {
+	var b strings.Builder
+	if ep.text != nil {
+		if err := ep.text.Execute(&b, data); err != nil {
+			return err
+		}
+		msg.Message = b.String()
+		b.Reset()
+	}
+	if ep.html != nil {
+		if err := ep.html.Execute(&b, data); err != nil {
+			return err
+		}
+		msg.HTML = b.String()
+	}
+	return nil
+}
+
+// formatTable returns the rows, one "field: value" per line, aligned
+func formatTable(rows []TableRow) string {
+	var b strings.Builder
+	tw := tabwriter.NewWriter(&b, 0, 4, 1, ' ', 0)
+	for _, row := range rows {
+		// continuation lines are indented
+		fmt.Fprintf(tw, "%s:\t%s\n", row.Field, strings.ReplaceAll(row.Value, "\n", "\n\t"))
+	}
+	tw.Flush()
+	return strings.TrimSuffix(b.String(), "\n")
+}
@@ -0,0 +1,232 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/aerth/mbox"
+)
+
+const testConfig = `{
+  "mailboxes": {"support": {"file": "support.mbox"}},
+  "endpoints": [{
+    "path": "/support",
+    "mailbox": "support",
+    "page": "support.html",
+    "fields": {"name": "fullname", "email": "email", "subject": "topic", "message": "text"},
+    "headers": {"X-Order": "order"},
+    "table": ["phone", "order"],
+    "required": ["email", "text"],
+    "validate": {"phone": "^[0-9 +-]{6,20}$"}
+  }]
+}`
+
+func TestConfig(t *testing.T) {
+	dir := t.TempDir()
+	os.WriteFile(filepath.Join(dir, "config.json"), []byte(testConfig), 0600)
+	os.WriteFile(filepath.Join(dir, "support.html"), []byte("<form></form>"), 0600)
+	wd, _ := os.Getwd()
+	defer os.Chdir(wd)
+	os.Chdir(dir)
+
+	config, err := LoadConfig("config.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := config.Open(nil); err != nil {
+		t.Fatal(err)
+	}
+	mux := http.NewServeMux()
+	config.Register(mux, nil)
+	srv := httptest.NewServer(mux)
+	defer srv.Close()
+	client := &http.Client{CheckRedirect: func(*http.Request, []*http.Request) error { return http.ErrUseLastResponse }}
+
+	resp, err := client.Get(srv.URL + "/support")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("GET: expected 200, got %d", resp.StatusCode)
+	}
+	valid := url.Values{"fullname": {"Alice"}, "email": {"alice@localhost"}, "topic": {"broken"},
+		"text": {"it is broken"}, "phone": {"+1 555 0100"}, "order": {"A-42"}}
+	for _, tt := range []struct {
+		name   string
+		change url.Values
+		want   int
+	}{
+		{"valid", nil, http.StatusFound},
+		{"missing required", url.Values{"email": {" "}}, http.StatusBadRequest},
+		{"invalid phone", url.Values{"phone": {"call me"}}, http.StatusBadRequest},
+	} {
+		form := url.Values{}
+		for k, v := range valid {
+			form[k] = v
+		}
+		for k, v := range tt.change {
+			form[k] = v
+		}
+		resp, err := client.PostForm(srv.URL+"/support", form)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != tt.want {
+			t.Errorf("%s: expected %d, got %d", tt.name, tt.want, resp.StatusCode)
+		}
+		if tt.want == http.StatusFound && resp.Header.Get("Location") != "/support?sent" {
+			t.Errorf("%s: unexpected redirect %q", tt.name, resp.Header.Get("Location"))
+		}
+	}
+	// queued messages are written before the mailboxes are closed
+	if err := config.Shutdown(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	f, err := os.Open("support.mbox")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	entries, err := mbox.NewReader(f).ReadAll()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 1 {
+		t.Fatalf("expected 1 message, got %d", len(entries))
+	}
+	msg, err := entries[0].Mail()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.EqualFold(msg.Header.Get("From"), "Alice <alice@localhost>") || msg.Header.Get("Subject") != "broken" || msg.Header.Get("X-Order") != "A-42" {
+		t.Errorf("unexpected header: %v", msg.Header)
+	}
+	if received := msg.Header.Get("Received"); !strings.HasPrefix(received, "from [127.0.0.1] by 127.0.0.1 with HTTP; ") {
+		t.Errorf("unexpected Received header: %q", received)
+	}
+	body := string(entries[0].Raw)
+	if !strings.Contains(body, "it is broken\n\nphone: +1 555 0100\norder: A-42\n") {
+		t.Errorf("unexpected body:\n%s", body)
+	}
+}
+
+func TestConfigErrors(t *testing.T) {
+	for _, config := range []string{
+		`{"endpoints": [{"path": "nope"}]}`,
+		`{"endpoints": [{"path": "/a"}, {"path": "/a"}]}`,
+		`{"endpoints": [{"path": "/a", "mailbox": "missing"}]}`,
+		`{"endpoints": [{"path": "/a", "validate": {"x": "("}}]}`,
+		`{"endpoints": [{"path": "/a", "page": "missing.html"}]}`,
+		`{"mailboxes": {"x": {}}}`,
+		`{"mailboxes": {"x": {"file": "x.mbox", "timezone": "Mars/Olympus_Mons"}}}`,
+		`{"endpoints": {}}`,
+	} {
+		filename := filepath.Join(t.TempDir(), "config.json")
+		os.WriteFile(filename, []byte(config), 0600)
+		if _, err := LoadConfig(filename); err == nil {
+			t.Errorf("expected error for %s", config)
+		}
+	}
+}
+
+func TestConfigTemplates(t *testing.T) {
+	dir := t.TempDir()
+	mboxname = filepath.Join(dir, "default.mbox")
+	os.WriteFile(filepath.Join(dir, "config.json"), []byte(`{"endpoints": [{
+	  "path": "/contact",
+	  "table": ["phone"],
+	  "text_template": "contact.txt",
+	  "html_template": "contact.html"
+	}]}`), 0600)
+	os.WriteFile(filepath.Join(dir, "contact.txt"), []byte(
+		"New message from {{.Name}} via {{.Path}}\n\n{{.Message}}\n{{range .Table}}\n{{.Field}}: {{.Value}}{{end}}\n"), 0600)
+	os.WriteFile(filepath.Join(dir, "contact.html"), []byte(
+		"<p>{{.Message}}</p><p>{{.Fields.phone}}</p>"), 0600)
+	config, err := LoadConfig(filepath.Join(dir, "config.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	mux := http.NewServeMux()
+	config.Register(mux, nil)
+	srv := httptest.NewServer(mux)
+	defer srv.Close()
+	client := &http.Client{CheckRedirect: func(*http.Request, []*http.Request) error { return http.ErrUseLastResponse }}
+	resp, err := client.PostForm(srv.URL+"/contact", url.Values{"name": {"Alice"}, "message": {"<script>hi</script>"}, "phone": {"555"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusFound {
+		t.Fatalf("expected 302, got %d", resp.StatusCode)
+	}
+	flushMbox(t)
+
+	entries, err := readEntries()
+	if err != nil || len(entries) != 1 {
+		t.Fatalf("expected 1 message, got %d (%v)", len(entries), err)
+	}
+	msg, err := entries[0].Mail()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ct := msg.Header.Get("Content-Type"); !strings.HasPrefix(ct, "multipart/alternative;") {
+		t.Fatalf("unexpected content type: %q", ct)
+	}
+	form, err := entries[0].Form()
+	if err != nil || len(form.Attachments) != 0 {
+		t.Fatalf("expected text and html only, got %d attachments (%v)", len(form.Attachments), err)
+	}
+	if want := "New message from Alice via /contact\n\n<script>hi</script>\n\nphone: 555\n"; form.Message != want {
+		t.Errorf("unexpected text part:\n%q\nwant:\n%q", form.Message, want)
+	}
+	if strings.TrimSpace(form.HTML) != "<p>&lt;script&gt;hi&lt;/script&gt;</p><p>555</p>" {
+		t.Errorf("unexpected html part: %q", form.HTML)
+	}
+}
+
+func TestSaveError(t *testing.T) {
+	for _, tc := range []struct {
+		err    error
+		status int
+	}{
+		{mbox.ErrQueueFull, http.StatusServiceUnavailable},
+		{mbox.ErrEmptyMessage, http.StatusBadRequest},
+		{fmt.Errorf("saving: %w", context.DeadlineExceeded), http.StatusServiceUnavailable},
+		{errors.New("disk full"), http.StatusInternalServerError},
+	} {
+		rec := httptest.NewRecorder()
+		status, _ := saveError(rec, tc.err)
+		if status != tc.status {
+			t.Errorf("%v: expected status %d, got %d", tc.err, tc.status, status)
+		}
+		if retry := rec.Header().Get("Retry-After"); (retry != "") != (status == http.StatusServiceUnavailable) {
+			t.Errorf("%v: unexpected Retry-After %q", tc.err, retry)
+		}
+	}
+}
+
+func TestValidate(t *testing.T) {
+	v, err := validators("normalize, address,disposable")
+	if err != nil || len(v) != 3 {
+		t.Fatalf("unexpected validators %v, %v", v, err)
+	}
+	if _, err := validators("normalize,spf"); err == nil {
+		t.Error("expected error for an unknown check")
+	}
+	rec := httptest.NewRecorder()
+	status, reason := saveError(rec, fmt.Errorf("saving: %w", &mbox.ErrInvalidAddress{Address: "a@yopmail.com", Reason: mbox.ErrDisposableAddress}))
+	if status != http.StatusBadRequest || reason != mbox.ErrDisposableAddress.Error() {
+		t.Errorf("unexpected response %d %q", status, reason)
+	}
+}
@@ -0,0 +1,403 @@
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"html"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/aerth/mbox"
+)
+
+// Guard protects the submission endpoints from spam and abuse, the zero value
+// accepts everything. JSON and message/rfc822 submissions are checked like forms.
+type Guard struct {
+	// MaxBodySize is the maximum request body size in bytes
+	MaxBodySize int64
+
+	// Rate is the number of submissions per second allowed from a single
+	// client IP address, with bursts up to Burst submissions
+	Rate  float64
+	Burst int
+
+	// TrustProxy uses the last X-Forwarded-For address, added by the proxy,
+	// for the client address
+	TrustProxy bool
+
+	// Honeypot fields are hidden from humans by the form page,
+	// a submission filling any of them is rejected
+	Honeypot []string
+
+	// MinSubmitTime is the minimum time between loading the form page (see Page)
+	// and submitting it with its token, used once
+	MinSubmitTime time.Duration
+	// MaxSubmitTime is the maximum age of a form token, default 24 hours
+	MaxSubmitTime time.Duration
+	// Secret signs form tokens, a random secret is generated if empty
+	Secret []byte
+
+	// Score returns a spam score for a submission and a reason,
+	// submissions scoring MaxScore or more are rejected
+	Score    func(form url.Values) (float64, string)
+	MaxScore float64
+
+	// Quarantine, if set, receives rejected form submissions
+	// (except those rejected by size or rate limit)
+	Quarantine io.Writer
+
+	limiter   rateLimiter
+	qmu       sync.Mutex
+	setupOnce sync.Once
+	tmu       sync.Mutex
+	used      map[string]time.Time // accepted tokens, until they expire
+}
+
+// tokenField is the hidden form field carrying the form token
+const tokenField = "_formtoken"
+
+// rejection is a rejected submission
+type rejection struct {
+	status int
+	reason string
+}
+
+func (r *rejection) Error() string {
+	return r.reason
+}
+
+func (g *Guard) setup() {
+	g.setupOnce.Do(func() {
+		if g.MinSubmitTime > 0 && len(g.Secret) == 0 {
+			g.Secret = randomKey()
+		}
+		if g.MaxSubmitTime <= 0 {
+			g.MaxSubmitTime = 24 * time.Hour
+		}
+		g.limiter.rate, g.limiter.burst = g.Rate, float64(g.Burst)
+		if g.limiter.burst < 1 {
+			g.limiter.burst = 1
+		}
+	})
+}
+
+// Wrap checks POST requests before calling next
+func (g *Guard) Wrap(next http.HandlerFunc) http.HandlerFunc {
+	if g == nil {
+		return next
+	}
+	g.setup()
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "POST" {
+			next(w, r)
+			return
+		}
+		if err := g.check(w, r); err != nil {
+			var rej *rejection
+			if !errors.As(err, &rej) {
+				rej = &rejection{http.StatusBadRequest, err.Error()}
+			}
+			slog.Warn("submission rejected", "path", r.URL.Path, "client", g.clientIP(r), "status", rej.status, "reason", rej.reason)
+			countRejection(rej.status)
+			if rej.status == http.StatusTooManyRequests {
+				w.Header().Set("Retry-After", strconv.Itoa(int(1/g.Rate)+1))
+			}
+			if isJSON(r) || isMessage(r) {
+				jsonError(w, rej.status, rej.reason)
+			} else {
+				http.Error(w, http.StatusText(rej.status), rej.status)
+			}
+			return
+		}
+		next(w, r)
+	}
+}
+
+func (g *Guard) check(w http.ResponseWriter, r *http.Request) error {
+	if g.MaxBodySize > 0 {
+		if r.ContentLength > g.MaxBodySize {
+			return &rejection{http.StatusRequestEntityTooLarge, "request body too large"}
+		}
+		r.Body = http.MaxBytesReader(w, r.Body, g.MaxBodySize)
+	}
+	if g.Rate > 0 && !g.limiter.allow(g.clientIP(r), time.Now()) {
+		return &rejection{http.StatusTooManyRequests, "rate limit exceeded"}
+	}
+	var form url.Values
+	if isJSON(r) || isMessage(r) {
+		if len(g.Honeypot) == 0 && g.MinSubmitTime <= 0 && g.Score == nil {
+			return nil
+		}
+		var err error
+		if form, err = submissionValues(r); err != nil {
+			return err
+		}
+	} else {
+		// multipart forms also fill r.PostForm with the text fields
+		if err := parseRequestForm(r); err != nil {
+			var maxerr *http.MaxBytesError
+			if errors.As(err, &maxerr) {
+				return &rejection{http.StatusRequestEntityTooLarge, "request body too large"}
+			}
+			return &rejection{http.StatusBadRequest, "invalid form: " + err.Error()}
+		}
+		form = r.PostForm
+	}
+	rej := g.checkForm(form, time.Now())
+	if rej != nil && g.Quarantine != nil {
+		g.quarantine(r, form, rej.reason)
+	}
+	if rej != nil {
+		return rej
+	}
+	return nil
+}
+
+// submissionValues returns the fields of a JSON or message/rfc822 body,
+// which is read and kept for the handler
+func submissionValues(r *http.Request) (url.Values, error) {
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		var maxerr *http.MaxBytesError
+		if errors.As(err, &maxerr) {
+			return nil, &rejection{http.StatusRequestEntityTooLarge, "request body too large"}
+		}
+		return nil, err
+	}
+	r.Body = io.NopCloser(bytes.NewReader(body))
+	form := url.Values{}
+	if isJSON(r) {
+		var fields map[string]interface{}
+		if err := json.Unmarshal(body, &fields); err != nil {
+			return nil, &rejection{http.StatusBadRequest, "invalid json: " + err.Error()}
+		}
+		for name, value := range fields {
+			if s, ok := value.(string); ok {
+				form.Set(name, s)
+			}
+		}
+	} else {
+		msg, err := mbox.ParseMessage(bytes.NewReader(body))
+		if err != nil {
+			return nil, &rejection{http.StatusBadRequest, err.Error()}
+		}
+		form.Set("from", msg.From)
+		form.Set("subject", msg.Subject)
+		form.Set("message", msg.Message+msg.HTML)
+	}
+	if token := r.Header.Get("X-Form-Token"); token != "" && form.Get(tokenField) == "" {
+		form.Set(tokenField, token)
+	}
+	return form, nil
+}
+
+// checkForm runs the content checks on a parsed form
+func (g *Guard) checkForm(form url.Values, now time.Time) *rejection {
+	for _, field := range g.Honeypot {
+		if strings.TrimSpace(form.Get(field)) != "" {
+			return &rejection{http.StatusBadRequest, "honeypot field filled: " + field}
+		}
+	}
+	var issued time.Time
+	if g.MinSubmitTime > 0 {
+		var err error
+		issued, err = g.verifyToken(form.Get(tokenField))
+		if err != nil {
+			return &rejection{http.StatusBadRequest, err.Error()}
+		}
+		age := now.Sub(issued)
+		if age < g.MinSubmitTime {
+			return &rejection{http.StatusBadRequest, fmt.Sprintf("submitted too fast (%v)", age.Round(time.Millisecond))}
+		}
+		if age > g.MaxSubmitTime {
+			return &rejection{http.StatusBadRequest, "form token expired"}
+		}
+	}
+	if g.Score != nil {
+		if score, reason := g.Score(form); score >= g.MaxScore {
+			return &rejection{http.StatusBadRequest, fmt.Sprintf("spam score %.1f: %s", score, reason)}
+		}
+	}
+	if g.MinSubmitTime > 0 && !g.useToken(form.Get(tokenField), issued.Add(g.MaxSubmitTime), now) {
+		return &rejection{http.StatusBadRequest, "form token already used"}
+	}
+	return nil
+}
+
+// useToken reports whether the token was not used before, remembering it
+// until it expires
+func (g *Guard) useToken(token string, expires, now time.Time) bool {
+	g.tmu.Lock()
+	defer g.tmu.Unlock()
+	if g.used == nil {
+		g.used = map[string]time.Time{}
+	}
+	if _, ok := g.used[token]; ok {
+		return false
+	}
+	if len(g.used) >= 10000 {
+		for t, exp := range g.used {
+			if now.After(exp) {
+				delete(g.used, t)
+			}
+		}
+	}
+	g.used[token] = expires
+	return true
+}
+
+// quarantine saves a rejected submission to the quarantine mbox
+func (g *Guard) quarantine(r *http.Request, form url.Values, reason string) {
+	msg := mbox.NewMessage(form.Get("name"), form.Get("email"), form.Get("subject"), form.Get("message"))
+	if from := form.Get("from"); from != "" {
+		msg.From = from
+	}
+	msg.Subject = "[quarantine] " + msg.Subject
+	msg.Message = fmt.Sprintf("Rejected: %s\nClient: %s\n\n%s", reason, g.clientIP(r), msg.Message)
+	g.qmu.Lock()
+	defer g.qmu.Unlock()
+	if _, err := msg.WriteTo(g.Quarantine); err != nil {
+		slog.Error("writing quarantine mbox", "error", err)
+	}
+}
+
+// clientIP returns the client address used for rate limiting and logging
+func (g *Guard) clientIP(r *http.Request) string {
+	if g != nil && g.TrustProxy {
+		// the client sets the others
+		if fwd := r.Header.Values("X-Forwarded-For"); len(fwd) != 0 {
+			addrs := strings.Split(fwd[len(fwd)-1], ",")
+			if addr := strings.TrimSpace(addrs[len(addrs)-1]); addr != "" {
+				return addr
+			}
+		}
+	}
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+// Page returns the form page with the hidden honeypot fields and form token
+// added to each form. A nil Guard returns the page as is.
+func (g *Guard) Page(page []byte) []byte {
+	if g == nil || (len(g.Honeypot) == 0 && g.MinSubmitTime <= 0) {
+		return page
+	}
+	g.setup()
+	var fields strings.Builder
+	for _, field := range g.Honeypot {
+		fmt.Fprintf(&fields, `<div style="position:absolute;left:-10000px" aria-hidden="true"><input name="%s" tabindex="-1" autocomplete="off"></div>`, html.EscapeString(field))
+	}
+	if g.MinSubmitTime > 0 {
+		fmt.Fprintf(&fields, `<input type="hidden" name="%s" value="%s">`, tokenField, g.newToken(time.Now()))
+	}
+	return bytes.Replace(page, []byte("</form>"), []byte(fields.String()+"</form>"), -1)
+}
+
+// randomKey returns a new random form token secret
+func randomKey() []byte {
+	key := make([]byte, 32)
+	if _, err := rand.Read(key); err != nil {
+		panic(err)
+	}
+	return key
+}
+
+// newToken returns a form token: the issue time and its HMAC
+func (g *Guard) newToken(now time.Time) string {
+	ts := strconv.FormatInt(now.UnixMilli(), 10)
+	return ts + "." + g.sign(ts)
+}
+
+func (g *Guard) sign(ts string) string {
+	mac := hmac.New(sha256.New, g.Secret)
+	mac.Write([]byte(ts))
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// verifyToken returns the issue time of a valid token
+func (g *Guard) verifyToken(token string) (time.Time, error) {
+	ts, sig, ok := strings.Cut(token, ".")
+	if !ok || !hmac.Equal([]byte(sig), []byte(g.sign(ts))) {
+		return time.Time{}, errors.New("missing or invalid form token")
+	}
+	ms, err := strconv.ParseInt(ts, 10, 64)
+	if err != nil {
+		return time.Time{}, errors.New("missing or invalid form token")
+	}
+	return time.UnixMilli(ms), nil
+}
+
+// LinkScore is a Score function counting links in the submitted values
+func LinkScore(form url.Values) (float64, string) {
+	var n int
+	for _, values := range form {
+		for _, v := range values {
+			v = strings.ToLower(v)
+			n += strings.Count(v, "http://") + strings.Count(v, "https://")
+		}
+	}
+	return float64(n), strconv.Itoa(n) + " links"
+}
+
+// rateLimiter is a token bucket per client address
+type rateLimiter struct {
+	rate  float64 // tokens added per second
+	burst float64 // bucket size
+
+	mu      sync.Mutex
+	buckets map[string]*bucket
+}
+
+type bucket struct {
+	tokens float64
+	last   time.Time
+}
+
+// allow takes a token from the bucket of key
+func (l *rateLimiter) allow(key string, now time.Time) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.buckets == nil {
+		l.buckets = map[string]*bucket{}
+	}
+	b := l.buckets[key]
+	if b == nil {
+		if len(l.buckets) >= 10000 {
+			l.prune(now)
+		}
+		b = &bucket{tokens: l.burst, last: now}
+		l.buckets[key] = b
+	}
+	b.tokens = min(l.burst, b.tokens+now.Sub(b.last).Seconds()*l.rate)
+	b.last = now
+	if b.tokens < 1 {
+		return false
+	}
+	b.tokens--
+	return true
+}
+
+// prune forgets buckets that have refilled completely
+func (l *rateLimiter) prune(now time.Time) {
+	for key, b := range l.buckets {
+		if b.tokens+now.Sub(b.last).Seconds()*l.rate >= l.burst {
+			delete(l.buckets, key)
+		}
+	}
+}
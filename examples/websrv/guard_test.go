@@ -0,0 +1,213 @@
+package main
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+)
+
+// guardServer serves the form page and accepts submissions, counting them
+func guardServer(t *testing.T, g *Guard) (*httptest.Server, *int) {
+	t.Helper()
+	accepted := new(int)
+	srv := httptest.NewServer(g.Wrap(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == "POST" {
+			*accepted++
+			return
+		}
+		w.Write(g.Page(Formpage))
+	}))
+	t.Cleanup(srv.Close)
+	return srv, accepted
+}
+
+func postForm(t *testing.T, srv *httptest.Server, form url.Values) int {
+	t.Helper()
+	resp, err := http.PostForm(srv.URL, form)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	return resp.StatusCode
+}
+
+func testForm() url.Values {
+	return url.Values{"name": {"Alice"}, "email": {"alice@localhost"}, "message": {"hello"}}
+}
+
+func TestGuardRateLimit(t *testing.T) {
+	srv, accepted := guardServer(t, &Guard{Rate: 0.001, Burst: 2})
+	for i, want := range []int{200, 200, 429, 429} {
+		if code := postForm(t, srv, testForm()); code != want {
+			t.Fatalf("submission %d: expected %d, got %d", i, want, code)
+		}
+	}
+	if *accepted != 2 {
+		t.Fatalf("expected 2 accepted, got %d", *accepted)
+	}
+}
+
+func TestGuardMaxBodySize(t *testing.T) {
+	srv, _ := guardServer(t, &Guard{MaxBodySize: 100})
+	form := testForm()
+	form.Set("message", strings.Repeat("x", 200))
+	if code := postForm(t, srv, form); code != http.StatusRequestEntityTooLarge {
+		t.Fatalf("expected 413, got %d", code)
+	}
+	if code := postForm(t, srv, testForm()); code != http.StatusOK {
+		t.Fatalf("expected 200, got %d", code)
+	}
+}
+
+func TestGuardHoneypotQuarantine(t *testing.T) {
+	quarantine := new(bytes.Buffer)
+	g := &Guard{Honeypot: []string{"website"}, Quarantine: quarantine}
+	srv, accepted := guardServer(t, g)
+	if page := g.Page(Formpage); !bytes.Contains(page, []byte(`name="website"`)) {
+		t.Fatalf("honeypot field missing from form page")
+	}
+	form := testForm()
+	form.Set("website", "http://spam.example")
+	if code := postForm(t, srv, form); code != http.StatusBadRequest {
+		t.Fatalf("expected 400, got %d", code)
+	}
+	if *accepted != 0 {
+		t.Fatalf("honeypot submission accepted")
+	}
+	if !strings.Contains(quarantine.String(), "honeypot field filled: website") {
+		t.Fatalf("rejected submission not quarantined: %q", quarantine.String())
+	}
+	if code := postForm(t, srv, testForm()); code != http.StatusOK {
+		t.Fatalf("expected 200, got %d", code)
+	}
+}
+
+func TestGuardFormToken(t *testing.T) {
+	g := &Guard{MinSubmitTime: 50 * time.Millisecond}
+	srv, accepted := guardServer(t, g)
+	resp, err := http.Get(srv.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	page := new(bytes.Buffer)
+	page.ReadFrom(resp.Body)
+	resp.Body.Close()
+	m := regexp.MustCompile(`name="` + tokenField + `" value="([^"]+)"`).FindStringSubmatch(page.String())
+	if m == nil {
+		t.Fatalf("form token missing from form page: %s", page)
+	}
+	form := testForm()
+	if code := postForm(t, srv, form); code != http.StatusBadRequest {
+		t.Fatalf("no token: expected 400, got %d", code)
+	}
+	form.Set(tokenField, m[1])
+	if code := postForm(t, srv, form); code != http.StatusBadRequest {
+		t.Fatalf("too fast: expected 400, got %d", code)
+	}
+	time.Sleep(60 * time.Millisecond)
+	if code := postForm(t, srv, form); code != http.StatusOK {
+		t.Fatalf("expected 200, got %d", code)
+	}
+	if code := postForm(t, srv, form); code != http.StatusBadRequest {
+		t.Fatalf("replayed: expected 400, got %d", code)
+	}
+	form.Set(tokenField, "1"+m[1]) // different time, same signature
+	if code := postForm(t, srv, form); code != http.StatusBadRequest {
+		t.Fatalf("forged token: expected 400, got %d", code)
+	}
+	if *accepted != 1 {
+		t.Fatalf("expected 1 accepted, got %d", *accepted)
+	}
+}
+
+func TestGuardScore(t *testing.T) {
+	srv, _ := guardServer(t, &Guard{Score: LinkScore, MaxScore: 2})
+	form := testForm()
+	form.Set("message", "buy now https://a.example http://b.example")
+	if code := postForm(t, srv, form); code != http.StatusBadRequest {
+		t.Fatalf("expected 400, got %d", code)
+	}
+	form.Set("message", "see https://a.example")
+	if code := postForm(t, srv, form); code != http.StatusOK {
+		t.Fatalf("expected 200, got %d", code)
+	}
+}
+
+// JSON and message submissions get the same checks as forms
+func TestGuardContentTypes(t *testing.T) {
+	g := &Guard{Honeypot: []string{"website"}, MinSubmitTime: time.Millisecond, Score: LinkScore, MaxScore: 2}
+	srv, accepted := guardServer(t, g)
+	issued := time.Now().Add(-time.Second)
+	token := func() string {
+		issued = issued.Add(-time.Millisecond) // tokens are used once
+		return g.newToken(issued)
+	}
+	post := func(contentType, body, token string) int {
+		t.Helper()
+		req, err := http.NewRequest("POST", srv.URL, strings.NewReader(body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Header.Set("Content-Type", contentType)
+		if token != "" {
+			req.Header.Set("X-Form-Token", token)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+	const spam = "buy https://a.example https://b.example"
+	for _, tc := range []struct {
+		contentType, body, token string
+		want                     int
+	}{
+		{"application/json", `{"from": "alice@localhost", "message": "hello"}`, "", http.StatusBadRequest},
+		{"application/json; charset=utf-8", `{"from": "alice@localhost", "message": "hello"}`, "", http.StatusBadRequest},
+		{"application/json; charset=utf-8", `{"from": "alice@localhost", "message": "hello", "website": "x"}`, token(), http.StatusBadRequest},
+		{"application/json", `{"from": "alice@localhost", "message": "` + spam + `"}`, token(), http.StatusBadRequest},
+		{"application/json", `{"from": "alice@localhost", "message": "hello", "_formtoken": "` + token() + `"}`, "", http.StatusOK},
+		{"application/json; charset=utf-8", `{"from": "alice@localhost", "message": "hello"}`, token(), http.StatusOK},
+		{"message/rfc822", "From: alice@localhost\n\nhello\n", "", http.StatusBadRequest},
+		{"message/rfc822", "From: alice@localhost\n\n" + spam + "\n", token(), http.StatusBadRequest},
+		{"message/rfc822", "From: alice@localhost\n\nhello\n", token(), http.StatusOK},
+	} {
+		if code := post(tc.contentType, tc.body, tc.token); code != tc.want {
+			t.Errorf("%s %s: expected %d, got %d", tc.contentType, tc.body, tc.want, code)
+		}
+	}
+	if *accepted != 3 {
+		t.Errorf("expected 3 accepted, got %d", *accepted)
+	}
+}
+
+func TestGuardClientIP(t *testing.T) {
+	for _, tc := range []struct {
+		trust bool
+		fwd   []string
+		want  string
+	}{
+		{false, []string{"203.0.113.1"}, "192.0.2.1"},
+		{true, nil, "192.0.2.1"},
+		{true, []string{"203.0.113.1"}, "203.0.113.1"},
+		// the proxy appends the address it sees, the client sets the others
+		{true, []string{"198.51.100.7, 203.0.113.1"}, "203.0.113.1"},
+		{true, []string{"198.51.100.7", "203.0.113.1"}, "203.0.113.1"},
+	} {
+		r := httptest.NewRequest("POST", "/", nil)
+		r.RemoteAddr = "192.0.2.1:1234"
+		for _, v := range tc.fwd {
+			r.Header.Add("X-Forwarded-For", v)
+		}
+		if got := (&Guard{TrustProxy: tc.trust}).clientIP(r); got != tc.want {
+			t.Errorf("%v %q: expected %s, got %s", tc.trust, tc.fwd, tc.want, got)
+		}
+	}
+}
@@ -1,13 +1,23 @@
 package main
 
 import (
+	"context"
 	"encoding/json"
+	"errors"
 	"flag"
+	"fmt"
 	"io"
 	"log"
+	"log/slog"
+	"net"
 	"net/http"
+	"net/smtp"
 	"os"
+	"os/signal"
 	"strings"
+	"sync"
+	"syscall"
+	"time"
 
 	"filippo.io/age"
 	"github.com/aerth/mbox"
@@ -15,20 +25,207 @@ import (
 
 var mboxname = "my.mbox"
 
+// guard checks submissions, see Guard
+var guard *Guard
+
+// hooks are notified of saved messages, in every mailbox
+var hooks []mbox.Hook
+
+// sinks receive saved messages, in every mailbox
+var sinks []mbox.Sink
+
 func main() {
 	log.SetFlags(log.Lshortfile | log.LstdFlags)
+	mux := http.NewServeMux()
 	server := &http.Server{
-		Handler: http.HandlerFunc(Handler),
+		Handler: instrument(mux),
 		Addr:    ":8080",
 	}
 	inputfile := ""
 	age_recipient := ""
+	viewer := &Viewer{Password: os.Getenv("MBOX_VIEWER_PASSWORD")}
+	identityfile := ""
+	guard = &Guard{MaxBodySize: 10 << 20, Secret: []byte(os.Getenv("MBOX_FORM_SECRET"))}
+	honeypot, quarantine := "", ""
+	maxlinks := 0
+	uploads.MaxFileSize, uploads.MaxTotalSize = 5<<20, 8<<20
+	configfile := ""
+	webhook, hookcmd := "", ""
+	logformat, loglevel := "text", "info"
+	relay := &mbox.Relay{}
+	relayto := ""
+	metricsaddr := ""
+	spilldir := ""
+	shutdownTimeout := 30 * time.Second
+	checks := "normalize"
+	timezone := ""
+	extensions := ".png,.jpg,.jpeg,.gif,.pdf,.txt"
 	flag.StringVar(&server.Addr, "addr", "127.0.0.1:8080", "address to listen on")
 	flag.StringVar(&mbox.Destination, "dest", mbox.Destination, "destination email address (optional)")
 	flag.StringVar(&mboxname, "mbox", mboxname, "mbox filename")
+	flag.StringVar(&configfile, "config", configfile, "json file describing form endpoints and mailboxes (optional, see Config)")
 	flag.StringVar(&inputfile, "html", inputfile, "path to form html file (optional, - for stdin)")
 	flag.StringVar(&age_recipient, "age", age_recipient, "age recipient public key (optional, requires custom encrypted mbox reader)")
+	flag.StringVar(&viewer.User, "viewer", viewer.User, "enable the message viewer at /messages for this basic auth user\n(password from MBOX_VIEWER_PASSWORD environment variable)")
+	flag.StringVar(&identityfile, "identity", identityfile, "age identity file, to decrypt messages in the viewer (optional)")
+	flag.Int64Var(&guard.MaxBodySize, "maxbody", guard.MaxBodySize, "maximum request body size in bytes (0 for no limit)")
+	flag.Float64Var(&guard.Rate, "rate", guard.Rate, "submissions per second allowed per client IP (0 for no limit), eg: 0.1")
+	flag.IntVar(&guard.Burst, "burst", 3, "with -rate: submissions allowed in a burst per client IP")
+	flag.BoolVar(&guard.TrustProxy, "trustproxy", guard.TrustProxy, "use the last X-Forwarded-For address, added by the reverse proxy, for the client IP")
+	flag.StringVar(&honeypot, "honeypot", honeypot, "comma separated hidden form fields that must stay empty, eg: website")
+	flag.DurationVar(&guard.MinSubmitTime, "mintime", guard.MinSubmitTime, "minimum time between loading and submitting the form, eg: 3s\n(signed form tokens, set MBOX_FORM_SECRET when running multiple instances)")
+	flag.IntVar(&maxlinks, "maxlinks", maxlinks, "reject form submissions with this many links or more (0 for no limit)")
+	flag.StringVar(&quarantine, "quarantine", quarantine, "mbox file for rejected form submissions (optional)")
+	flag.Int64Var(&uploads.MaxFileSize, "maxfile", uploads.MaxFileSize, "maximum size of an attached file in bytes (0 for no limit)")
+	flag.Int64Var(&uploads.MaxTotalSize, "maxupload", uploads.MaxTotalSize, "maximum size of all files attached to a submission in bytes (0 for no limit)")
+	flag.StringVar(&extensions, "extensions", extensions, "comma separated file extensions allowed for attachments (empty for any)")
+	flag.StringVar(&webhook, "webhook", webhook, "post saved message metadata as JSON to this URL (optional)\n(signed with MBOX_WEBHOOK_SECRET environment variable, see mbox.WebHook)")
+	flag.StringVar(&hookcmd, "hook", hookcmd, "run this command for each saved message (optional, see mbox.CommandHook), eg: ./notify.sh")
+	flag.StringVar(&relay.Addr, "relay", relay.Addr, "also send saved messages through this SMTP smarthost (optional), eg: smtp.example.com:587\n(authenticates with MBOX_RELAY_USER and MBOX_RELAY_PASSWORD environment variables, if set)")
+	flag.StringVar(&relay.From, "relayfrom", relay.From, "with -relay: envelope sender address")
+	flag.StringVar(&relayto, "relayto", relayto, "with -relay: comma separated recipient addresses")
+	flag.StringVar(&relay.Dir, "relayqueue", relay.Dir, "with -relay: queue directory (default: mbox filename + \".relay\")")
+	flag.StringVar(&checks, "validate", checks, "comma separated checks of the sender address: normalize, address (valid syntax),\nmx (domain accepts mail) and disposable (blocks disposable email domains)")
+	flag.TextVar(&mbox.DefaultOptions.Dialect, "dialect", mbox.DefaultOptions.Dialect, "how message lines beginning with \"From \" are quoted: mboxo or mboxrd")
+	flag.BoolVar(&mbox.DefaultOptions.Status, "status", true, "write Status and X-Status headers with room for the flags, so the viewer marks\nmessages read in place instead of rewriting the mbox file")
+	flag.StringVar(&timezone, "timezone", timezone, "time zone of the mbox envelope and delivery dates, eg: UTC or Europe/Paris (default: local time)")
+	flag.TextVar(&mbox.OverflowPolicy, "overflow", mbox.OverflowPolicy, "when the queue of messages waiting to be written is full: block, drop (503 response) or spill to -spilldir")
+	flag.StringVar(&spilldir, "spilldir", spilldir, "with -overflow spill: directory of messages waiting to be written (default: mbox filename + \".spill\")")
+	flag.DurationVar(&saveTimeout, "savetimeout", saveTimeout, "with -overflow block: maximum time a request waits for room in the queue (503 response), eg: 5s")
+	flag.DurationVar(&shutdownTimeout, "shutdowntimeout", shutdownTimeout, "on SIGTERM or interrupt: maximum time to finish requests and write queued messages")
+	flag.StringVar(&metricsaddr, "metrics", metricsaddr, "serve Prometheus metrics at /metrics on this address (optional), eg: 127.0.0.1:9090")
+	flag.StringVar(&logformat, "log", logformat, "log format: text or json")
+	flag.StringVar(&loglevel, "loglevel", loglevel, "log level: debug, info, warn or error")
 	flag.Parse()
+	var level slog.Level
+	if err := level.UnmarshalText([]byte(loglevel)); err != nil {
+		log.Printf("invalid -loglevel: %v", err)
+		os.Exit(1)
+	}
+	logopts := &slog.HandlerOptions{Level: level}
+	switch logformat {
+	case "text":
+		slog.SetDefault(slog.New(slog.NewTextHandler(os.Stderr, logopts)))
+	case "json":
+		slog.SetDefault(slog.New(slog.NewJSONHandler(os.Stderr, logopts)))
+	default:
+		log.Printf("invalid -log format: %q", logformat)
+		os.Exit(1)
+	}
+	mbox.Logger = slog.Default()
+	mbox.SpillDir = spilldir
+	v, err := validators(checks)
+	if err != nil {
+		log.Printf("invalid -validate: %v", err)
+		os.Exit(1)
+	}
+	mbox.Validators = v
+	if timezone != "" {
+		loc, err := time.LoadLocation(timezone)
+		if err != nil {
+			log.Printf("invalid -timezone: %v", err)
+			os.Exit(1)
+		}
+		mbox.DefaultOptions.Location = loc
+	}
+	if metricsaddr != "" {
+		registry = newRegistry()
+		mbox.Metrics = registry
+		metricsmux := http.NewServeMux()
+		metricsmux.Handle("/metrics", registry)
+		go func() {
+			if err := http.ListenAndServe(metricsaddr, metricsmux); err != nil {
+				log.Printf("metrics: %v", err)
+				os.Exit(1)
+			}
+		}()
+		println("metrics at http://" + metricsaddr + "/metrics")
+	}
+	if webhook != "" {
+		hooks = append(hooks, &mbox.WebHook{URL: webhook, Secret: []byte(os.Getenv("MBOX_WEBHOOK_SECRET"))})
+	}
+	if args := strings.Fields(hookcmd); len(args) != 0 {
+		hooks = append(hooks, &mbox.CommandHook{Command: args[0], Args: args[1:]})
+	}
+	mbox.Hooks = hooks
+	if relay.Addr != "" {
+		for _, to := range strings.Split(relayto, ",") {
+			if to = strings.TrimSpace(to); to != "" {
+				relay.To = append(relay.To, to)
+			}
+		}
+		if relay.Dir == "" {
+			relay.Dir = mboxname + ".relay"
+		}
+		if user := os.Getenv("MBOX_RELAY_USER"); user != "" {
+			host, _, _ := net.SplitHostPort(relay.Addr)
+			relay.Auth = smtp.PlainAuth("", user, os.Getenv("MBOX_RELAY_PASSWORD"), host)
+		}
+		if err := relay.Start(nil); err != nil {
+			log.Printf("starting relay: %v", err)
+			os.Exit(1)
+		}
+		defer relay.Close()
+		sinks = append(sinks, relay)
+	}
+	mbox.Sinks = sinks
+	for _, ext := range strings.Split(extensions, ",") {
+		if ext = strings.TrimSpace(ext); ext != "" {
+			uploads.Extensions = append(uploads.Extensions, "."+strings.TrimPrefix(ext, "."))
+		}
+	}
+	for _, field := range strings.Split(honeypot, ",") {
+		if field = strings.TrimSpace(field); field != "" {
+			guard.Honeypot = append(guard.Honeypot, field)
+		}
+	}
+	if maxlinks > 0 {
+		guard.Score, guard.MaxScore = LinkScore, float64(maxlinks)
+	}
+	if quarantine != "" {
+		f, err := os.OpenFile(quarantine, os.O_RDWR|os.O_CREATE|os.O_APPEND, 0600)
+		if err != nil {
+			log.Printf("opening quarantine mbox: %v", err)
+			os.Exit(1)
+		}
+		defer f.Close()
+		guard.Quarantine = f
+	}
+	config := &Config{}
+	if configfile != "" {
+		var err error
+		config, err = LoadConfig(configfile)
+		if err != nil {
+			log.Printf("reading config: %v", err)
+			os.Exit(1)
+		}
+		if err := config.Open(nil); err != nil {
+			log.Printf("opening mailboxes: %v", err)
+			os.Exit(1)
+		}
+		defer config.Close()
+		config.Register(mux, guard)
+	}
+	if !config.hasPath("/") {
+		mux.HandleFunc("/", guard.Wrap(Handler))
+	}
+	if viewer.User != "" {
+		if viewer.Password == "" {
+			log.Printf("viewer: MBOX_VIEWER_PASSWORD is not set")
+			os.Exit(1)
+		}
+		if identityfile != "" {
+			ids, err := LoadIdentities(identityfile)
+			if err != nil {
+				log.Printf("reading age identity file: %v", err)
+				os.Exit(1)
+			}
+			viewer.Identities = ids
+		}
+		viewer.Register(mux)
+		viewer.RegisterAPI(mux)
+		println("viewer enabled at /messages, json api at /api/messages")
+	}
 	if age_recipient != "" {
 		// quick check to see if the recipient is valid
 		_, err := age.ParseX25519Recipient(age_recipient)
@@ -56,61 +253,137 @@ func main() {
 	}
 	println("listening on", server.Addr)
 	println("example: curl -d 'name=me&email=me@localhost&subject=hello&message=world' http://localhost:8080/")
+	println("or a message: curl -H 'Content-Type: message/rfc822' --data-binary @message.eml http://localhost:8080/")
 	println("or use json: curl -H 'Content-Type: application/json' -d '{\"from\":\"me@localhost\",\"subject\":\"hello\",\"message\":\"world\"}' http://localhost:8080/")
-	if err := server.ListenAndServe(); err != nil {
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	errc := make(chan error, 1)
+	go func() { errc <- server.ListenAndServe() }()
+	select {
+	case err := <-errc:
 		println(err.Error())
 		os.Exit(1)
+	case <-ctx.Done():
+	}
+	stop()
+	slog.Info("shutting down", "timeout", shutdownTimeout)
+	ctx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+	defer cancel()
+	if err := server.Shutdown(ctx); err != nil {
+		slog.Error("stopping http server", "error", err)
+	}
+	if err := shutdownMbox(ctx); err != nil {
+		slog.Error("closing mbox file", "error", err)
+	}
+	if err := config.Shutdown(ctx); err != nil {
+		slog.Error("closing mailboxes", "error", err)
+	}
+	for _, h := range hooks {
+		if w, ok := h.(interface{ Wait() }); ok {
+			w.Wait() // pending webhook deliveries and commands
+		}
 	}
 }
 
 func Handler(w http.ResponseWriter, r *http.Request) {
-	if r.Method == "POST" && r.Header.Get("Content-Type") == "application/json" {
+	if r.Method == "POST" && isJSON(r) {
 		HandleMboxJsonApi(w, r)
 		return
+	} else if r.Method == "POST" && isMessage(r) {
+		HandleMboxMessage(w, r)
+		return
 	} else if r.Method == "POST" {
 		HandleMboxForm(w, r)
 		return
 	}
 	if len(Formpage) != 0 {
-		w.Write(Formpage)
+		w.Write(guard.Page(Formpage))
 	} else {
 		w.WriteHeader(http.StatusNotFound)
 	}
 }
 
+// HandleMboxJsonApi saves a JSON encoded mbox.Form
+// Responds 202 Accepted, or a JSON error: {"error": "message"}
 func HandleMboxJsonApi(w http.ResponseWriter, r *http.Request) {
 	var msg mbox.Form
-	if mbox.MailWriteCloser == nil {
-		if err := mbox.Open(nil, mboxname); err != nil {
-			w.WriteHeader(http.StatusInternalServerError)
-			log.Printf("error opening mbox file: %v", err)
-			return
-		}
-	}
 	if err := json.NewDecoder(r.Body).Decode(&msg); err != nil {
-		w.WriteHeader(http.StatusBadRequest)
-		log.Printf("error decoding json: %v", err)
+		slog.Warn("invalid json", "error", err)
+		jsonError(w, http.StatusBadRequest, "invalid json: "+err.Error())
 		return
 	}
 	if msg.From == "" && msg.Message == "" && msg.Subject == "" {
-		w.WriteHeader(http.StatusBadRequest)
-		log.Printf("empty message")
+		slog.Warn("empty message", "type", "json")
+		jsonError(w, http.StatusBadRequest, "empty message")
+		return
+	}
+	msg.Trace = []mbox.Trace{httpTrace(r)} // not from the client
+	if err := uploads.check(msg.Attachments); err != nil {
+		slog.Warn("attachment rejected", "type", "json", "error", err)
+		var rej *rejection
+		if !errors.As(err, &rej) {
+			rej = &rejection{http.StatusBadRequest, err.Error()}
+		}
+		countRejection(rej.status)
+		jsonError(w, rej.status, rej.reason)
 		return
 	}
-	err := mbox.Save(&msg)
+	ctx, cancel := saveContext(r)
+	defer cancel()
+	if err := saveMessage(ctx, &msg); err != nil {
+		status, reason := saveError(w, err)
+		slog.Log(r.Context(), statusLevel(status), "saving message", "type", "json", "status", status, "error", err)
+		jsonError(w, status, reason)
+		return
+	}
+	slog.Info("message received", "path", r.URL.Path, "type", "json", "bytes", len(msg.Message), "attachments", len(msg.Attachments))
+	writeJSON(w, http.StatusAccepted, map[string]string{"status": "queued"})
+}
+
+// HandleMboxMessage saves a RFC 5322 message (Content-Type: message/rfc822),
+// responds like HandleMboxJsonApi
+func HandleMboxMessage(w http.ResponseWriter, r *http.Request) {
+	msg, err := mbox.ParseMessage(r.Body)
 	if err != nil {
-		w.WriteHeader(http.StatusInternalServerError)
-		log.Printf("error saving message: %v", err)
+		slog.Warn("invalid message", "error", err)
+		status := http.StatusBadRequest
+		var maxerr *http.MaxBytesError
+		if errors.As(err, &maxerr) {
+			status = http.StatusRequestEntityTooLarge
+		}
+		jsonError(w, status, err.Error())
+		return
+	}
+	msg.Trace = append([]mbox.Trace{httpTrace(r)}, msg.Trace...)
+	if err := uploads.check(msg.Attachments); err != nil {
+		slog.Warn("attachment rejected", "type", "message", "error", err)
+		var rej *rejection
+		if !errors.As(err, &rej) {
+			rej = &rejection{http.StatusBadRequest, err.Error()}
+		}
+		countRejection(rej.status)
+		jsonError(w, rej.status, rej.reason)
+		return
+	}
+	ctx, cancel := saveContext(r)
+	defer cancel()
+	if err := saveMessage(ctx, msg); err != nil {
+		status, reason := saveError(w, err)
+		slog.Log(r.Context(), statusLevel(status), "saving message", "type", "message", "status", status, "error", err)
+		jsonError(w, status, reason)
 		return
 	}
-	log.Printf("message received (json, %d bytes)", len(msg.Message))
+	slog.Info("message received", "path", r.URL.Path, "type", "message", "bytes", len(msg.Message), "attachments", len(msg.Attachments))
+	writeJSON(w, http.StatusAccepted, map[string]string{"status": "queued"})
 }
 
+// HandleMboxForm saves a submitted form, multipart/form-data file uploads
+// become attachments (see Uploads)
 func HandleMboxForm(w http.ResponseWriter, r *http.Request) {
-	err := r.ParseForm()
+	err := parseRequestForm(r)
 	if err != nil {
 		w.WriteHeader(http.StatusBadRequest)
-		log.Printf("error parsing form: %v", err)
+		slog.Warn("invalid form", "path", r.URL.Path, "error", err)
 		return
 	}
 	name, email := r.FormValue("name"), r.FormValue("email")
@@ -120,33 +393,190 @@ func HandleMboxForm(w http.ResponseWriter, r *http.Request) {
 		HandleMboxJsonApi(w, r)
 		return
 	}
-	if mbox.MailWriteCloser == nil {
-		if err := mbox.Open(nil, mboxname); err != nil {
-			w.WriteHeader(http.StatusInternalServerError)
-			log.Printf("error opening mbox file: %v", err)
-			return
-		}
-	}
 
 	msg := mbox.NewMessage(name, email, subject, message)
-	err = mbox.Save(&msg)
+	msg.Trace = []mbox.Trace{httpTrace(r)}
+	msg.Attachments, err = uploads.formAttachments(r.MultipartForm)
+	if err != nil {
+		var rej *rejection
+		if !errors.As(err, &rej) {
+			rej = &rejection{http.StatusBadRequest, err.Error()}
+		}
+		slog.Warn("attachment rejected", "type", "form", "client", guard.clientIP(r), "status", rej.status, "reason", rej.reason)
+		countRejection(rej.status)
+		http.Error(w, rej.reason, rej.status)
+		return
+	}
+	ctx, cancel := saveContext(r)
+	defer cancel()
+	err = saveMessage(ctx, &msg)
 	if err != nil {
-		log.Printf("error saving message: %v", err)
-		http.Error(w, "error saving message", http.StatusInternalServerError)
+		status, reason := saveError(w, err)
+		slog.Log(r.Context(), statusLevel(status), "saving message", "type", "form", "status", status, "error", err)
+		http.Error(w, reason, status)
 		return
 	} else {
-		log.Printf("message received (form, %d bytes)", len(msg.Message))
+		slog.Info("message received", "path", r.URL.Path, "type", "form", "bytes", len(msg.Message), "attachments", len(msg.Attachments))
 		http.Redirect(w, r, "/?sent", http.StatusFound)
 	}
 
 }
 
+// httpTrace describes the request for the Received header of its message
+func httpTrace(r *http.Request) mbox.Trace {
+	t := mbox.Trace{IP: guard.clientIP(r), With: "HTTP"}
+	if r.TLS != nil {
+		t.With = "HTTPS"
+	}
+	if host, _, err := net.SplitHostPort(r.Host); err == nil {
+		t.By = host
+	} else if r.Host != "" {
+		t.By = r.Host
+	}
+	return t
+}
+
+// parseRequestForm parses urlencoded and multipart/form-data bodies
+func parseRequestForm(r *http.Request) error {
+	if isMultipart(r) {
+		return r.ParseMultipartForm(maxMemory)
+	}
+	return r.ParseForm()
+}
+
+// maxMemory is the part of a multipart form kept in memory, the rest in temporary files
+const maxMemory = 1 << 20
+
+var (
+	openMu   sync.Mutex   // serializes opening and closing the mbox file
+	mboxOpen bool         // mbox.Open was called, and not closed since
+	mboxMu   sync.RWMutex // locked for writing while the mbox file is rewritten
+)
+
+// openMbox opens the mbox file on first use
+func openMbox() error {
+	openMu.Lock()
+	defer openMu.Unlock()
+	if mboxOpen {
+		return nil
+	}
+	if err := mbox.Open(nil, mboxname); err != nil {
+		return fmt.Errorf("opening mbox file: %v", err)
+	}
+	mboxOpen = true
+	return nil
+}
+
+// shutdownMbox writes the queued messages and closes the mbox file,
+// until ctx is done (see mbox.Shutdown)
+func shutdownMbox(ctx context.Context) error {
+	openMu.Lock()
+	defer openMu.Unlock()
+	if !mboxOpen {
+		return nil
+	}
+	mboxOpen = false
+	_, _, err := mbox.Shutdown(ctx)
+	return err
+}
+
+// saveMessage queues a message for writing to the mbox file
+func saveMessage(ctx context.Context, msg mbox.Writable) error {
+	mboxMu.RLock()
+	defer mboxMu.RUnlock()
+	if err := openMbox(); err != nil {
+		return err
+	}
+	return mbox.SaveContext(ctx, msg)
+}
+
+// statusLevel returns the log level of an error response
+func statusLevel(status int) slog.Level {
+	if status < 500 {
+		return slog.LevelWarn
+	}
+	return slog.LevelError
+}
+
+// validators returns the validators of a comma separated list of checks
+// (see the -validate flag)
+func validators(checks string) ([]mbox.Validator, error) {
+	v := []mbox.Validator{}
+	for _, check := range strings.Split(checks, ",") {
+		switch strings.TrimSpace(check) {
+		case "":
+		case "normalize":
+			v = append(v, mbox.NormalizeAddress{})
+		case "address":
+			v = append(v, mbox.RequireAddress{})
+		case "mx":
+			v = append(v, mbox.CheckMailHost{})
+		case "disposable":
+			v = append(v, mbox.BlockDomains{})
+		default:
+			return nil, fmt.Errorf("unknown check %q", check)
+		}
+	}
+	return v, nil
+}
+
+// saveTimeout limits how long a request waits for room in a full queue
+// (see mbox.OverflowBlock), 0 waits as long as the client
+var saveTimeout time.Duration
+
+// saveContext returns the context of saving a message submitted by r
+func saveContext(r *http.Request) (context.Context, context.CancelFunc) {
+	if saveTimeout > 0 {
+		return context.WithTimeout(r.Context(), saveTimeout)
+	}
+	return context.WithCancel(r.Context())
+}
+
+// saveError returns the response status and reason for a message not saved
+func saveError(w http.ResponseWriter, err error) (int, string) {
+	var addrErr *mbox.ErrInvalidAddress
+	switch {
+	case errors.As(err, &addrErr):
+		return http.StatusBadRequest, addrErr.Reason.Error()
+	case errors.Is(err, mbox.ErrEmptyMessage):
+		return http.StatusBadRequest, "empty message"
+	case errors.Is(err, mbox.ErrQueueFull), errors.Is(err, context.DeadlineExceeded):
+		w.Header().Set("Retry-After", "30")
+		return http.StatusServiceUnavailable, "server busy, try again later"
+	case errors.Is(err, mbox.ErrClosed):
+		return http.StatusServiceUnavailable, "server shutting down"
+	}
+	return http.StatusInternalServerError, "error saving message"
+}
+
+// rewriteMbox stops the writer and rewrites the mbox file (see mbox.Rewrite)
+func rewriteMbox(keep func(*mbox.Entry) bool) (int, error) {
+	mboxMu.Lock()
+	defer mboxMu.Unlock()
+	openMu.Lock()
+	defer openMu.Unlock()
+	if mboxOpen {
+		mbox.Close() // returns after the queued messages are written
+		mboxOpen = false
+	}
+	return mbox.Rewrite(mboxname, keep)
+}
+
+// flagMbox sets and clears flags of the matching messages (see mbox.SetFlags),
+// the writer goroutine keeps running
+func flagMbox(match mbox.Match, set, clear mbox.Flags) (int, error) {
+	mboxMu.RLock()
+	defer mboxMu.RUnlock()
+	return mbox.SetFlags(mboxname, match, set, clear)
+}
+
 var Formpage = []byte(`<html>
-  <form method="POST">
+  <form method="POST" enctype="multipart/form-data">
     Your Name: <input name="name"><br>
     Your Email: <input name="email"><br>
     Subject: <input name="subject"><br>
-    Message: <input name="message"><br><br>
+    Message: <input name="message"><br>
+    Attachment: <input type="file" name="attachment" multiple><br><br>
     <input type="submit" value="send mail">
   </form>
   </html>
@@ -0,0 +1,81 @@
+package main
+
+import (
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/aerth/mbox"
+)
+
+// registry keeps the mbox and websrv metrics, nil unless -metrics is set
+var registry *mbox.Registry
+
+// newRegistry returns a Registry with the mbox and websrv metrics described
+func newRegistry() *mbox.Registry {
+	r := mbox.NewRegistry()
+	r.Describe("websrv_http_requests_total", "counter", "HTTP requests by handler pattern, method and status code.")
+	r.Describe("websrv_http_request_duration_seconds", "histogram", "Time to serve HTTP requests.")
+	r.Describe("websrv_rejected_total", "counter", "Submissions rejected, by status code.")
+	return r
+}
+
+// instrument counts the requests served by mux and their duration
+func instrument(mux *http.ServeMux) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if registry == nil {
+			mux.ServeHTTP(w, r)
+			return
+		}
+		start := time.Now()
+		sw := &statusWriter{ResponseWriter: w, status: http.StatusOK}
+		_, pattern := mux.Handler(r)
+		if pattern == "" {
+			pattern = "unmatched"
+		}
+		mux.ServeHTTP(sw, r)
+		registry.Add("websrv_http_requests_total", 1, "handler", pattern, "method", method(r.Method), "code", strconv.Itoa(sw.status))
+		registry.Observe("websrv_http_request_duration_seconds", time.Since(start).Seconds(), "handler", pattern)
+	})
+}
+
+// countRejection counts a submission rejected with status
+func countRejection(status int) {
+	if registry != nil {
+		registry.Add("websrv_rejected_total", 1, "code", strconv.Itoa(status))
+	}
+}
+
+// method returns the request method, or "other" for uncommon methods,
+// so clients can not add labels
+func method(m string) string {
+	switch m {
+	case "GET", "HEAD", "POST", "PUT", "DELETE", "OPTIONS", "PATCH":
+		return m
+	}
+	return "other"
+}
+
+// statusWriter records the response status code
+type statusWriter struct {
+	http.ResponseWriter
+	status int
+	wrote  bool
+}
+
+func (w *statusWriter) WriteHeader(code int) {
+	if !w.wrote {
+		w.status, w.wrote = code, true
+	}
+	w.ResponseWriter.WriteHeader(code)
+}
+
+func (w *statusWriter) Write(b []byte) (int, error) {
+	w.wrote = true
+	return w.ResponseWriter.Write(b)
+}
+
+// Unwrap allows http.ResponseController to reach the underlying ResponseWriter
+func (w *statusWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
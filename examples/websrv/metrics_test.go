@@ -0,0 +1,55 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestMetrics(t *testing.T) {
+	registry = newRegistry()
+	defer func() { registry = nil }()
+	g := &Guard{Honeypot: []string{"website"}}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/contact", g.Wrap(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusAccepted)
+	}))
+	srv := httptest.NewServer(instrument(mux))
+	defer srv.Close()
+
+	form := testForm()
+	for i := 0; i < 2; i++ {
+		resp, err := http.PostForm(srv.URL+"/contact", form)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+	}
+	form.Set("website", "http://spam.example")
+	resp, err := http.PostForm(srv.URL+"/contact", form)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	resp, err = http.Get(srv.URL + "/nothing")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+
+	var b strings.Builder
+	registry.WriteTo(&b)
+	out := b.String()
+	for _, want := range []string{
+		`websrv_http_requests_total{handler="/contact",method="POST",code="202"} 2` + "\n",
+		`websrv_http_requests_total{handler="/contact",method="POST",code="400"} 1` + "\n",
+		`websrv_http_requests_total{handler="unmatched",method="GET",code="404"} 1` + "\n",
+		`websrv_http_request_duration_seconds_count{handler="/contact"} 3` + "\n",
+		`websrv_rejected_total{code="400"} 1` + "\n",
+	} {
+		if !strings.Contains(out, want) {
+			t.Errorf("expected %q in:\n%s", want, out)
+		}
+	}
+}
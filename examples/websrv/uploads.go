@@ -0,0 +1,143 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"mime"
+	"mime/multipart"
+	"net/http"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/aerth/mbox"
+)
+
+// Uploads limits the files attached to submissions.
+// Every check is optional, the zero value accepts any file.
+type Uploads struct {
+	MaxFileSize  int64    // maximum size of a single file in bytes
+	MaxTotalSize int64    // maximum size of all files of a submission in bytes
+	Extensions   []string // allowed file name extensions, eg: .png
+}
+
+// uploads checks attached files, see Uploads
+var uploads = &Uploads{}
+
+// isMultipart reports whether the request body is multipart/form-data
+func isMultipart(r *http.Request) bool {
+	mediatype, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	return mediatype == "multipart/form-data"
+}
+
+// isJSON reports whether the request body is application/json
+func isJSON(r *http.Request) bool {
+	mediatype, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	return mediatype == "application/json"
+}
+
+// isMessage reports whether the request body is a message/rfc822 message
+func isMessage(r *http.Request) bool {
+	mediatype, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	return mediatype == "message/rfc822"
+}
+
+// formAttachments returns the files uploaded with a parsed multipart form,
+// in order of the form field names
+func (u *Uploads) formAttachments(form *multipart.Form) ([]mbox.Attachment, error) {
+	if form == nil {
+		return nil, nil
+	}
+	fields := make([]string, 0, len(form.File))
+	for field := range form.File {
+		fields = append(fields, field)
+	}
+	sort.Strings(fields)
+	var attachments []mbox.Attachment
+	var total int64
+	for _, field := range fields {
+		for _, fh := range form.File[field] {
+			if fh.Filename == "" && fh.Size == 0 {
+				continue // empty file input
+			}
+			if u.MaxFileSize > 0 && fh.Size > u.MaxFileSize {
+				return nil, &rejection{http.StatusRequestEntityTooLarge, "file too large: " + fh.Filename}
+			}
+			if total += fh.Size; u.MaxTotalSize > 0 && total > u.MaxTotalSize {
+				return nil, &rejection{http.StatusRequestEntityTooLarge, "attachments too large"}
+			}
+			f, err := fh.Open()
+			if err != nil {
+				return nil, err
+			}
+			data, err := io.ReadAll(f)
+			f.Close()
+			if err != nil {
+				return nil, err
+			}
+			a, err := u.attachment(fh.Filename, data)
+			if err != nil {
+				return nil, err
+			}
+			attachments = append(attachments, a)
+		}
+	}
+	return attachments, nil
+}
+
+// check checks attachments submitted as JSON or in a message, setting their content type
+func (u *Uploads) check(attachments []mbox.Attachment) error {
+	var total int64
+	for i, a := range attachments {
+		size := int64(len(a.Data))
+		if u.MaxFileSize > 0 && size > u.MaxFileSize {
+			return &rejection{http.StatusRequestEntityTooLarge, "file too large: " + a.Filename}
+		}
+		if total += size; u.MaxTotalSize > 0 && total > u.MaxTotalSize {
+			return &rejection{http.StatusRequestEntityTooLarge, "attachments too large"}
+		}
+		checked, err := u.attachment(a.Filename, a.Data)
+		if err != nil {
+			return err
+		}
+		attachments[i] = checked
+	}
+	return nil
+}
+
+// attachment checks that the extension of a single file agrees with its
+// content (see http.DetectContentType)
+func (u *Uploads) attachment(filename string, data []byte) (mbox.Attachment, error) {
+	filename = filepath.Base(strings.ReplaceAll(filename, `\`, "/"))
+	if filename == "." || filename == "/" {
+		filename = ""
+	}
+	ext := strings.ToLower(filepath.Ext(filename))
+	if len(u.Extensions) != 0 && !u.allowed(ext) {
+		return mbox.Attachment{}, &rejection{http.StatusUnsupportedMediaType, "file type not allowed: " + filename}
+	}
+	sniffed, _, _ := mime.ParseMediaType(http.DetectContentType(data))
+	contenttype, _, err := mime.ParseMediaType(mime.TypeByExtension(ext))
+	switch {
+	case err != nil:
+		// unknown extension, never trust the sniffed type for rendering
+		contenttype = "application/octet-stream"
+	case strings.HasPrefix(contenttype, "text/"):
+		if !strings.HasPrefix(sniffed, "text/plain") {
+			return mbox.Attachment{}, &rejection{http.StatusUnsupportedMediaType, fmt.Sprintf("%s: content is %s, not text", filename, sniffed)}
+		}
+		contenttype += "; charset=utf-8"
+	case sniffed != contenttype:
+		return mbox.Attachment{}, &rejection{http.StatusUnsupportedMediaType, fmt.Sprintf("%s: content is %s, not %s", filename, sniffed, contenttype)}
+	}
+	return mbox.Attachment{Filename: filename, ContentType: contenttype, Data: data}, nil
+}
+
+func (u *Uploads) allowed(ext string) bool {
+	for _, allowed := range u.Extensions {
+		if ext != "" && strings.EqualFold(ext, allowed) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,153 @@
+package main
+
+import (
+	"bytes"
+	"mime/multipart"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+// postMultipart posts the fields and files (name -> content) as multipart/form-data
+func postMultipart(t *testing.T, url string, fields map[string]string, files map[string]string) int {
+	t.Helper()
+	body := new(bytes.Buffer)
+	mw := multipart.NewWriter(body)
+	for k, v := range fields {
+		mw.WriteField(k, v)
+	}
+	for name, content := range files {
+		fw, err := mw.CreateFormFile("attachment", name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		fw.Write([]byte(content))
+	}
+	mw.Close()
+	client := &http.Client{CheckRedirect: func(*http.Request, []*http.Request) error { return http.ErrUseLastResponse }}
+	resp, err := client.Post(url, mw.FormDataContentType(), body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	return resp.StatusCode
+}
+
+func TestUploads(t *testing.T) {
+	saved := *uploads
+	defer func() { *uploads = saved }()
+	*uploads = Uploads{MaxFileSize: 1000, MaxTotalSize: 1500, Extensions: []string{".png", ".txt"}}
+	srv := newTestServer(t)
+
+	png := "\x89PNG\r\n\x1a\n" + strings.Repeat("\x00", 100)
+	fields := map[string]string{"name": "Alice", "email": "alice@localhost", "subject": "screenshot", "message": "see attached"}
+	for _, tt := range []struct {
+		name  string
+		files map[string]string
+		want  int
+	}{
+		{"no files", nil, http.StatusFound},
+		{"png and text", map[string]string{"shot.png": png, "notes.txt": "some notes"}, http.StatusFound},
+		{"extension not allowed", map[string]string{"run.exe": "MZ"}, http.StatusUnsupportedMediaType},
+		{"no extension", map[string]string{"README": "text"}, http.StatusUnsupportedMediaType},
+		{"content is not png", map[string]string{"shot.png": "<html><script></script>"}, http.StatusUnsupportedMediaType},
+		{"content is not text", map[string]string{"notes.txt": png}, http.StatusUnsupportedMediaType},
+		{"file too large", map[string]string{"big.txt": strings.Repeat("x", 1001)}, http.StatusRequestEntityTooLarge},
+		{"total too large", map[string]string{"a.txt": strings.Repeat("x", 800), "b.txt": strings.Repeat("x", 800)}, http.StatusRequestEntityTooLarge},
+	} {
+		if code := postMultipart(t, srv.URL, fields, tt.files); code != tt.want {
+			t.Errorf("%s: expected %d, got %d", tt.name, tt.want, code)
+		}
+	}
+	flushMbox(t)
+
+	var list struct{ Messages []apiSummary }
+	doJSON(t, "GET", srv.URL+"/api/messages", "", true, &list)
+	if len(list.Messages) != 2 {
+		t.Fatalf("expected 2 messages, got %d", len(list.Messages))
+	}
+	var msg apiMessage
+	doJSON(t, "GET", srv.URL+"/api/messages/"+list.Messages[0].ID, "", true, &msg)
+	if strings.TrimSpace(msg.Text) != "see attached" {
+		t.Errorf("unexpected text: %q", msg.Text)
+	}
+	types := map[string]string{}
+	for _, a := range msg.Attachments {
+		types[a.Filename] = a.ContentType
+	}
+	if len(types) != 2 || types["shot.png"] != "image/png" || !strings.HasPrefix(types["notes.txt"], "text/plain") {
+		t.Errorf("unexpected attachments: %+v", msg.Attachments)
+	}
+}
+
+func TestGuardMultipart(t *testing.T) {
+	srv, accepted := guardServer(t, &Guard{Honeypot: []string{"website"}})
+	fields := map[string]string{"name": "Alice", "message": "hello", "website": "http://spam"}
+	if code := postMultipart(t, srv.URL, fields, map[string]string{"a.txt": "a"}); code != http.StatusBadRequest {
+		t.Fatalf("expected 400, got %d", code)
+	}
+	delete(fields, "website")
+	if code := postMultipart(t, srv.URL, fields, map[string]string{"a.txt": "a"}); code != http.StatusOK {
+		t.Fatalf("expected 200, got %d", code)
+	}
+	if *accepted != 1 {
+		t.Fatalf("expected 1 accepted, got %d", *accepted)
+	}
+}
+
+func TestMessageUpload(t *testing.T) {
+	saved := *uploads
+	defer func() { *uploads = saved }()
+	*uploads = Uploads{Extensions: []string{".txt"}}
+	srv := newTestServer(t)
+
+	eml := "From: =?utf-8?q?J=C3=B6rg?= <jorg@localhost>\r\n" +
+		"Subject: report\r\n" +
+		"MIME-Version: 1.0\r\n" +
+		"Content-Type: multipart/mixed; boundary=b\r\n" +
+		"\r\n" +
+		"--b\r\n" +
+		"Content-Type: text/plain; charset=iso-8859-1\r\n" +
+		"Content-Transfer-Encoding: quoted-printable\r\n" +
+		"\r\n" +
+		"see the r=E9sum=E9\r\n" +
+		"--b\r\n" +
+		"Content-Type: text/plain\r\n" +
+		"Content-Disposition: attachment; filename=notes.txt\r\n" +
+		"Content-Transfer-Encoding: base64\r\n" +
+		"\r\n" +
+		"c29tZSBub3Rlcw==\r\n" +
+		"--b--\r\n"
+	for _, tt := range []struct {
+		name, body string
+		want       int
+	}{
+		{"message", eml, http.StatusAccepted},
+		{"attachment not allowed", strings.Replace(eml, "notes.txt", "run.exe", 1), http.StatusUnsupportedMediaType},
+		{"not a message", "no header", http.StatusBadRequest},
+	} {
+		resp, err := http.Post(srv.URL, "message/rfc822", strings.NewReader(tt.body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != tt.want {
+			t.Errorf("%s: expected %d, got %d", tt.name, tt.want, resp.StatusCode)
+		}
+	}
+	flushMbox(t)
+
+	var list struct{ Messages []apiSummary }
+	doJSON(t, "GET", srv.URL+"/api/messages", "", true, &list)
+	if len(list.Messages) != 1 {
+		t.Fatalf("expected 1 message, got %d", len(list.Messages))
+	}
+	var msg apiMessage
+	doJSON(t, "GET", srv.URL+"/api/messages/"+list.Messages[0].ID, "", true, &msg)
+	if msg.From != "Jörg <jorg@localhost>" || strings.TrimSpace(msg.Text) != "see the résumé" {
+		t.Errorf("unexpected message: %q %q", msg.From, msg.Text)
+	}
+	if len(msg.Attachments) != 1 || msg.Attachments[0].Filename != "notes.txt" {
+		t.Errorf("unexpected attachments: %+v", msg.Attachments)
+	}
+}
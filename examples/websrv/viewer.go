@@ -0,0 +1,459 @@
+package main
+
+import (
+	"crypto/subtle"
+	"errors"
+	"html/template"
+	"log/slog"
+	"mime"
+	"net/http"
+	"os"
+	"sort"
+	"strconv"
+	"time"
+
+	"filippo.io/age"
+	"github.com/aerth/mbox"
+	"github.com/microcosm-cc/bluemonday"
+)
+
+// Viewer is the authenticated read side of the mbox file
+//
+// Routes:
+//
+//	GET /messages?page=N                  list messages, newest first
+//	GET /messages/{id}                    view a message
+//	POST /messages/{id}/read              mark a message read
+//	GET /messages/{id}/parts/{n}          download an attachment
+//	GET /threads?page=N                   list conversations, latest first
+//
+// Message ids are those of the JSON API (see entryIDs), the read state is
+// kept in the mbox file (see mbox.SetFlags).
+type Viewer struct {
+	User       string         // basic auth user name
+	Password   string         // basic auth password
+	Identities []age.Identity // optional, decrypts age encrypted messages
+	PerPage    int            // messages per page, default 20
+}
+
+// Register adds the viewer routes to mux
+func (v *Viewer) Register(mux *http.ServeMux) {
+	mux.HandleFunc("GET /messages", v.auth(v.handleList))
+	mux.HandleFunc("GET /messages/{id}", v.auth(v.handleMessage))
+	mux.HandleFunc("POST /messages/{id}/read", v.auth(v.handleRead))
+	mux.HandleFunc("GET /messages/{id}/parts/{n}", v.auth(v.handlePart))
+	mux.HandleFunc("GET /threads", v.auth(v.handleThreads))
+}
+
+// authorized checks the HTTP basic authentication credentials
+func (v *Viewer) authorized(r *http.Request) bool {
+	user, pass, ok := r.BasicAuth()
+	userok := subtle.ConstantTimeCompare([]byte(user), []byte(v.User)) == 1
+	passok := subtle.ConstantTimeCompare([]byte(pass), []byte(v.Password)) == 1
+	return ok && userok && passok && v.Password != ""
+}
+
+// auth requires HTTP basic authentication
+func (v *Viewer) auth(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if !v.authorized(r) {
+			w.Header().Set("WWW-Authenticate", `Basic realm="mbox", charset="UTF-8"`)
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		next(w, r)
+	}
+}
+
+// LoadIdentities reads an age identity file (see age-keygen)
+func LoadIdentities(filename string) ([]age.Identity, error) {
+	f, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return age.ParseIdentities(f)
+}
+
+// readEntries reads every message in the mbox file, for each request
+func readEntries() ([]*mbox.Entry, error) {
+	f, err := os.Open(mboxname)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return mbox.NewReader(f).ReadAll()
+}
+
+var errNotFound = errors.New("message not found")
+var errEncrypted = errors.New("message is encrypted and cannot be decrypted")
+
+// entry returns the message with the given id, decrypted if possible, and
+// whether it was encrypted
+func (v *Viewer) entry(id string) (entry *mbox.Entry, encrypted bool, err error) {
+	entries, err := readEntries()
+	if err != nil {
+		return nil, false, err
+	}
+	for i, entryID := range listIDs(entries) {
+		if entryID == id {
+			entry, err = v.decrypt(entries[i])
+			return entry, entries[i].Encrypted, err
+		}
+	}
+	return nil, false, errNotFound
+}
+
+// listIDs returns the ids of the entries of the mbox file (see entryIDs)
+func listIDs(entries []*mbox.Entry) []string {
+	id := entryIDs()
+	ids := make([]string, len(entries))
+	for i, entry := range entries {
+		ids[i] = id(entry)
+	}
+	return ids
+}
+
+func (v *Viewer) decrypt(entry *mbox.Entry) (*mbox.Entry, error) {
+	if !entry.Encrypted {
+		return entry, nil
+	}
+	if len(v.Identities) == 0 {
+		return nil, errEncrypted
+	}
+	dec, err := entry.Decrypt(v.Identities...)
+	if err != nil {
+		slog.Warn("viewer: decrypting message", "offset", entry.Offset, "error", err)
+		return nil, errEncrypted
+	}
+	return dec, nil
+}
+
+// viewError writes an error page for errors returned by entry
+func viewError(w http.ResponseWriter, err error) {
+	switch err {
+	case errNotFound:
+		http.Error(w, err.Error(), http.StatusNotFound)
+	case errEncrypted:
+		http.Error(w, err.Error(), http.StatusForbidden)
+	default:
+		slog.Error("viewer: reading mbox", "error", err)
+		http.Error(w, "error reading mbox", http.StatusInternalServerError)
+	}
+}
+
+// listItem is a single row of the message list
+type listItem struct {
+	ID        string
+	From      string
+	Subject   string
+	Date      string
+	Flags     string // see flagMarks
+	Encrypted bool   // and not decrypted
+}
+
+// flagMarks returns the flags as shown by mutt: N new, r replied,
+// ! flagged and D deleted
+func flagMarks(f mbox.Flags) string {
+	marks := ""
+	for _, m := range []struct {
+		set  bool
+		mark string
+	}{
+		{f.New(), "N"},
+		{f&mbox.FlagReplied != 0, "r"},
+		{f&mbox.FlagFlagged != 0, "!"},
+		{f&mbox.FlagDeleted != 0, "D"},
+	} {
+		if m.set {
+			marks += m.mark
+		}
+	}
+	return marks
+}
+
+func (v *Viewer) handleList(w http.ResponseWriter, r *http.Request) {
+	entries, err := readEntries()
+	if err != nil {
+		viewError(w, err)
+		return
+	}
+	perPage := v.PerPage
+	if perPage <= 0 {
+		perPage = 20
+	}
+	page, _ := strconv.Atoi(r.URL.Query().Get("page"))
+	if page < 1 {
+		page = 1
+	}
+	pages := (len(entries) + perPage - 1) / perPage
+	ids := listIDs(entries)
+	var items []listItem
+	// newest first
+	for i := len(entries) - 1 - (page-1)*perPage; i >= 0 && len(items) < perPage; i-- {
+		item := listItem{ID: ids[i], Flags: flagMarks(entries[i].Flags())}
+		entry, err := v.decrypt(entries[i])
+		if err != nil {
+			item.Encrypted = true
+			items = append(items, item)
+			continue
+		}
+		if form, _ := entry.Form(); form != nil {
+			item.From, item.Subject = form.From, form.Subject
+			if !form.Sent.IsZero() {
+				item.Date = form.Sent.Format(time.RFC1123Z)
+			}
+		}
+		items = append(items, item)
+	}
+	data := map[string]interface{}{
+		"Items": items,
+		"Page":  page,
+		"Pages": pages,
+		"Total": len(entries),
+		"Prev":  page - 1,
+		"Next":  page + 1,
+	}
+	if err := listTemplate.Execute(w, data); err != nil {
+		slog.Error("viewer: rendering page", "error", err)
+	}
+}
+
+// threadItem is a message of the thread list, indented below the one it replies to
+type threadItem struct {
+	listItem
+	Indent  int  // depth of the reply
+	Missing bool // referenced by replies, not in the mbox file
+}
+
+// handleThreads lists the conversations of the decrypted messages, latest first
+func (v *Viewer) handleThreads(w http.ResponseWriter, r *http.Request) {
+	entries, err := readEntries()
+	if err != nil {
+		viewError(w, err)
+		return
+	}
+	ids := listIDs(entries)
+	flags := make([]mbox.Flags, len(entries))
+	for i, entry := range entries {
+		flags[i] = entry.Flags()
+		if dec, err := v.decrypt(entry); err == nil {
+			entries[i] = dec
+		}
+	}
+	threads := mbox.Threads(entries)
+	latest := map[*mbox.Thread]int{}
+	for _, thread := range threads {
+		thread.Walk(func(t *mbox.Thread, _ int) { latest[thread] = max(latest[thread], t.Index) })
+	}
+	sort.SliceStable(threads, func(i, j int) bool { return latest[threads[i]] > latest[threads[j]] })
+
+	perPage := v.PerPage
+	if perPage <= 0 {
+		perPage = 20
+	}
+	page, _ := strconv.Atoi(r.URL.Query().Get("page"))
+	if page < 1 {
+		page = 1
+	}
+	pages := (len(threads) + perPage - 1) / perPage
+	var items []threadItem
+	for _, thread := range threads[min(len(threads), (page-1)*perPage):min(len(threads), page*perPage)] {
+		thread.Walk(func(t *mbox.Thread, depth int) {
+			item := threadItem{listItem: listItem{From: t.From, Subject: t.Subject}, Indent: 2 * depth, Missing: t.Entry == nil}
+			if t.Entry != nil {
+				item.ID = ids[t.Index]
+				item.Flags = flagMarks(flags[t.Index])
+				item.Encrypted = t.Entry.Encrypted
+			}
+			if !t.Date.IsZero() {
+				item.Date = t.Date.Format(time.RFC1123Z)
+			}
+			items = append(items, item)
+		})
+	}
+	data := map[string]interface{}{
+		"Items":   items,
+		"Page":    page,
+		"Pages":   pages,
+		"Threads": len(threads),
+		"Total":   len(entries),
+		"Prev":    page - 1,
+		"Next":    page + 1,
+	}
+	if err := threadsTemplate.Execute(w, data); err != nil {
+		slog.Error("viewer: rendering page", "error", err)
+	}
+}
+
+// viewPart is a message part as shown in the message page
+type viewPart struct {
+	N           int // of the attachment in Form.Attachments
+	ContentType string
+	Filename    string
+	Size        int
+	Text        string        // text/plain parts
+	HTML        template.HTML // sanitized text/html parts
+	Attachment  bool
+}
+
+// htmlPolicy sanitizes HTML message parts before they are shown
+var htmlPolicy = bluemonday.UGCPolicy()
+
+func (v *Viewer) handleMessage(w http.ResponseWriter, r *http.Request) {
+	entry, encrypted, err := v.entry(r.PathValue("id"))
+	if err != nil {
+		viewError(w, err)
+		return
+	}
+	form, err := entry.Form()
+	if form == nil {
+		viewError(w, err)
+		return
+	}
+	if err != nil {
+		slog.Warn("viewer: parsing message", "id", r.PathValue("id"), "error", err)
+	}
+	var vparts []viewPart
+	if form.Message != "" {
+		vparts = append(vparts, viewPart{ContentType: "text/plain", Size: len(form.Message), Text: form.Message})
+	}
+	if form.HTML != "" {
+		vparts = append(vparts, viewPart{ContentType: "text/html", Size: len(form.HTML), HTML: template.HTML(htmlPolicy.Sanitize(form.HTML))})
+	}
+	for i, a := range form.Attachments {
+		vparts = append(vparts, viewPart{N: i, ContentType: a.ContentType, Filename: a.Filename, Size: len(a.Data), Attachment: true})
+	}
+	headers := [][2]string{{"From", form.From}}
+	if to := form.Headers["To"]; to != "" {
+		headers = append(headers, [2]string{"To", to})
+	}
+	if !form.Sent.IsZero() {
+		headers = append(headers, [2]string{"Date", form.Sent.Format(time.RFC1123Z)})
+	}
+	headers = append(headers, [2]string{"Subject", form.Subject})
+	data := map[string]interface{}{
+		"ID":        r.PathValue("id"),
+		"Flags":     entry.Flags(),
+		"Read":      encrypted || entry.Flags()&mbox.FlagRead != 0, // encrypted entries have no flags
+		"Headers":   headers,
+		"Parts":     vparts,
+		"Encrypted": encrypted,
+	}
+	if err := messageTemplate.Execute(w, data); err != nil {
+		slog.Error("viewer: rendering page", "error", err)
+	}
+}
+
+// handleRead marks the message read, by its id: not another message if the
+// mbox file changed since it was shown
+func (v *Viewer) handleRead(w http.ResponseWriter, r *http.Request) {
+	if site := r.Header.Get("Sec-Fetch-Site"); site != "" && site != "same-origin" {
+		http.Error(w, "cross-site request", http.StatusForbidden)
+		return
+	}
+	id, entryID := r.PathValue("id"), entryIDs()
+	if _, err := flagMbox(func(_ int, entry *mbox.Entry) bool { return entryID(entry) == id }, mbox.FlagRead|mbox.FlagOld, 0); err != nil {
+		slog.Error("viewer: marking message read", "id", id, "error", err)
+		http.Error(w, "error writing mbox", http.StatusInternalServerError)
+		return
+	}
+	http.Redirect(w, r, "/messages/"+id, http.StatusSeeOther)
+}
+
+func (v *Viewer) handlePart(w http.ResponseWriter, r *http.Request) {
+	entry, _, err := v.entry(r.PathValue("id"))
+	if err != nil {
+		viewError(w, err)
+		return
+	}
+	form, err := entry.Form()
+	if form == nil {
+		viewError(w, err)
+		return
+	}
+	n, err := strconv.Atoi(r.PathValue("n"))
+	if err != nil || n < 0 || n >= len(form.Attachments) {
+		http.Error(w, "part not found", http.StatusNotFound)
+		return
+	}
+	p := form.Attachments[n]
+	filename := p.Filename
+	if filename == "" {
+		filename = "part-" + strconv.Itoa(n)
+	}
+	// always download, never render attachments in the viewer origin
+	w.Header().Set("Content-Type", "application/octet-stream")
+	w.Header().Set("Content-Disposition", mime.FormatMediaType("attachment", map[string]string{"filename": filename}))
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.Write(p.Data)
+}
+
+var listTemplate = template.Must(template.New("list").Parse(`<!DOCTYPE html>
+<html>
+<head><meta charset="utf-8"><title>mbox ({{.Total}} messages)</title></head>
+<body>
+<h1>{{.Total}} messages</h1>
+<p><a href="/threads">threads</a></p>
+<table>
+<tr><th>#</th><th></th><th>Date</th><th>From</th><th>Subject</th></tr>
+{{range .Items}}<tr>
+  <td>{{.ID}}</td><td>{{.Flags}}</td>
+  {{if .Encrypted}}<td colspan="3"><a href="/messages/{{.ID}}">[encrypted]</a></td>
+  {{else}}<td>{{.Date}}</td><td>{{.From}}</td><td><a href="/messages/{{.ID}}">{{or .Subject "[No Subject]"}}</a></td>{{end}}
+</tr>
+{{end}}</table>
+<p>
+{{if gt .Page 1}}<a href="/messages?page={{.Prev}}">newer</a>{{end}}
+page {{.Page}} of {{.Pages}}
+{{if lt .Page .Pages}}<a href="/messages?page={{.Next}}">older</a>{{end}}
+</p>
+</body>
+</html>
+`))
+
+var threadsTemplate = template.Must(template.New("threads").Parse(`<!DOCTYPE html>
+<html>
+<head><meta charset="utf-8"><title>mbox ({{.Threads}} threads)</title></head>
+<body>
+<h1>{{.Threads}} threads, {{.Total}} messages</h1>
+<p><a href="/messages">messages</a></p>
+<table>
+<tr><th>#</th><th></th><th>Date</th><th>From</th><th>Subject</th></tr>
+{{range .Items}}<tr>
+  {{if .Missing}}<td></td><td></td><td colspan="2"></td><td style="padding-left: {{.Indent}}em">[not in the mbox file]</td>
+  {{else}}<td>{{.ID}}</td><td>{{.Flags}}</td>
+  {{if .Encrypted}}<td colspan="2"></td><td style="padding-left: {{.Indent}}em"><a href="/messages/{{.ID}}">[encrypted]</a></td>
+  {{else}}<td>{{.Date}}</td><td>{{.From}}</td><td style="padding-left: {{.Indent}}em"><a href="/messages/{{.ID}}">{{or .Subject "[No Subject]"}}</a></td>{{end}}{{end}}
+</tr>
+{{end}}</table>
+<p>
+{{if gt .Page 1}}<a href="/threads?page={{.Prev}}">newer</a>{{end}}
+page {{.Page}} of {{.Pages}}
+{{if lt .Page .Pages}}<a href="/threads?page={{.Next}}">older</a>{{end}}
+</p>
+</body>
+</html>
+`))
+
+var messageTemplate = template.Must(template.New("message").Parse(`<!DOCTYPE html>
+<html>
+<head><meta charset="utf-8"><title>message {{.ID}}</title></head>
+<body>
+<p><a href="/messages">back to list</a></p>
+<table>
+{{range .Headers}}<tr><th align="left">{{index . 0}}:</th><td>{{index . 1}}</td></tr>
+{{end}}<tr><th align="left">Flags:</th><td>{{.Flags}}{{if not .Read}} <form method="post" action="/messages/{{.ID}}/read" style="display:inline"><button>mark read</button></form>{{end}}</td></tr>
+{{if .Encrypted}}<tr><th align="left">Encrypted:</th><td>yes (decrypted by server)</td></tr>{{end}}
+</table>
+<hr>
+{{range .Parts}}{{if .Attachment}}<p>Attachment: <a href="/messages/{{$.ID}}/parts/{{.N}}">{{or .Filename "unnamed"}}</a> ({{.ContentType}}, {{.Size}} bytes)</p>
+{{else if .HTML}}<div>{{.HTML}}</div>
+{{else}}<pre>{{.Text}}</pre>
+{{end}}{{end}}
+</body>
+</html>
+`))
@@ -0,0 +1,255 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"testing"
+
+	"filippo.io/age"
+	"github.com/aerth/mbox"
+)
+
+// appendMbox saves the forms to the mbox file, encrypted to recipient if set
+func appendMbox(t *testing.T, recipient string, forms ...mbox.Form) {
+	t.Helper()
+	m := &mbox.Mailbox{Filename: mboxname, AgeRecipient: recipient}
+	if err := m.Open(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	for i := range forms {
+		if err := m.Save(&forms[i]); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, _, err := m.Shutdown(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// viewerIDs returns the ids of the messages of the mbox file, in file order
+func viewerIDs(t *testing.T) []string {
+	t.Helper()
+	entries, err := readEntries()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return listIDs(entries)
+}
+
+// newViewerServer serves a new mbox file with v
+func newViewerServer(t *testing.T, v *Viewer) *httptest.Server {
+	t.Helper()
+	mboxname = filepath.Join(t.TempDir(), "viewer.mbox")
+	v.User, v.Password = "admin", "secret"
+	mux := http.NewServeMux()
+	v.Register(mux)
+	srv := httptest.NewServer(mux)
+	t.Cleanup(srv.Close)
+	return srv
+}
+
+// get requests url, with the viewer credentials if auth
+func get(t *testing.T, url string, auth bool) (*http.Response, string) {
+	t.Helper()
+	req, err := http.NewRequest("GET", url, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if auth {
+		req.SetBasicAuth("admin", "secret")
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return resp, string(body)
+}
+
+func TestViewerAuth(t *testing.T) {
+	srv := newViewerServer(t, &Viewer{})
+	appendMbox(t, "", mbox.Form{From: "alice@localhost", Subject: "hello", Message: "hello",
+		Attachments: []mbox.Attachment{{Filename: "notes.txt", Data: []byte("notes")}}})
+	id := viewerIDs(t)[0]
+	for _, path := range []string{"/messages", "/messages/" + id, "/messages/" + id + "/parts/0", "/threads"} {
+		if resp, _ := get(t, srv.URL+path, false); resp.StatusCode != http.StatusUnauthorized || resp.Header.Get("WWW-Authenticate") == "" {
+			t.Errorf("%s: expected 401 with WWW-Authenticate, got %d", path, resp.StatusCode)
+		}
+		if resp, _ := get(t, srv.URL+path, true); resp.StatusCode != http.StatusOK {
+			t.Errorf("%s: expected 200 with credentials, got %d", path, resp.StatusCode)
+		}
+	}
+}
+
+func TestViewerPages(t *testing.T) {
+	srv := newViewerServer(t, &Viewer{PerPage: 2})
+	for _, subject := range []string{"one", "two", "three", "four", "five"} {
+		appendMbox(t, "", mbox.Form{From: "alice@localhost", Subject: subject, Message: "hello"})
+	}
+	for _, tc := range []struct {
+		query string
+		page  string
+		want  []string
+	}{
+		{"", "page 1 of 3", []string{"five", "four"}},
+		{"?page=0", "page 1 of 3", []string{"five", "four"}},
+		{"?page=-1", "page 1 of 3", []string{"five", "four"}},
+		{"?page=x", "page 1 of 3", []string{"five", "four"}},
+		{"?page=3", "page 3 of 3", []string{"one"}},
+		{"?page=99", "page 99 of 3", nil},
+	} {
+		resp, body := get(t, srv.URL+"/messages"+tc.query, true)
+		if resp.StatusCode != http.StatusOK || !strings.Contains(body, tc.page) {
+			t.Errorf("%q: expected 200 and %q, got %d:\n%s", tc.query, tc.page, resp.StatusCode, body)
+		}
+		if got := regexp.MustCompile(`<a href="/messages/\w+">(\w+)</a>`).FindAllStringSubmatch(body, -1); len(got) != len(tc.want) {
+			t.Errorf("%q: expected %v, got %v", tc.query, tc.want, got)
+		} else {
+			for i, m := range got {
+				if m[1] != tc.want[i] {
+					t.Errorf("%q: expected %v, got %v", tc.query, tc.want, got)
+				}
+			}
+		}
+	}
+	id := viewerIDs(t)[0]
+	for _, path := range []string{"/messages/1", "/messages/0123456789abcdef", "/messages/" + id + "/parts/9", "/messages/" + id + "/parts/-1"} {
+		if resp, _ := get(t, srv.URL+path, true); resp.StatusCode != http.StatusNotFound {
+			t.Errorf("%s: expected 404, got %d", path, resp.StatusCode)
+		}
+	}
+}
+
+func TestViewerParts(t *testing.T) {
+	srv := newViewerServer(t, &Viewer{})
+	appendMbox(t, "", mbox.Form{From: "alice@localhost", Subject: "html", Message: "hello",
+		HTML:        `<p onclick="steal()">hello <b>world</b></p><script>alert(1)</script>`,
+		Attachments: []mbox.Attachment{{Filename: "page.html", ContentType: "text/html", Data: []byte("<script>alert(2)</script>")}}})
+	resp, body := get(t, srv.URL+"/messages/"+viewerIDs(t)[0], true)
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("expected 200, got %d", resp.StatusCode)
+	}
+	if !strings.Contains(body, "<b>world</b>") || strings.Contains(body, "alert") || strings.Contains(body, "onclick") {
+		t.Errorf("HTML part not sanitized:\n%s", body)
+	}
+	link := regexp.MustCompile(`href="(/messages/\w+/parts/\d+)">page.html<`).FindStringSubmatch(body)
+	if link == nil {
+		t.Fatalf("no attachment link:\n%s", body)
+	}
+	resp, body = get(t, srv.URL+link[1], true)
+	if got := resp.Header.Get("Content-Disposition"); got != "attachment; filename=page.html" {
+		t.Errorf("Content-Disposition: %q", got)
+	}
+	if got := resp.Header.Get("Content-Type"); got != "application/octet-stream" {
+		t.Errorf("Content-Type: %q", got)
+	}
+	if got := resp.Header.Get("X-Content-Type-Options"); got != "nosniff" {
+		t.Errorf("X-Content-Type-Options: %q", got)
+	}
+	if body != "<script>alert(2)</script>" {
+		t.Errorf("attachment: %q", body)
+	}
+}
+
+func TestViewerEncrypted(t *testing.T) {
+	id, err := age.GenerateX25519Identity()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, tc := range []struct {
+		name       string
+		identities []age.Identity
+		status     int
+	}{
+		{"without identity", nil, http.StatusForbidden},
+		{"with identity", []age.Identity{id}, http.StatusOK},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			srv := newViewerServer(t, &Viewer{Identities: tc.identities})
+			appendMbox(t, id.Recipient().String(), mbox.Form{From: "alice@localhost", Subject: "secret subject", Message: "secret text",
+				Attachments: []mbox.Attachment{{Filename: "secret.txt", Data: []byte("secret file")}}})
+			_, list := get(t, srv.URL+"/messages", true)
+			if shown := strings.Contains(list, "secret subject"); shown != (tc.identities != nil) || shown == strings.Contains(list, "[encrypted]") {
+				t.Errorf("list:\n%s", list)
+			}
+			message := "/messages/" + viewerIDs(t)[0]
+			resp, body := get(t, srv.URL+message, true)
+			if resp.StatusCode != tc.status || strings.Contains(body, "secret text") != (tc.status == http.StatusOK) {
+				t.Errorf("message: expected %d, got %d:\n%s", tc.status, resp.StatusCode, body)
+			}
+			if tc.status == http.StatusOK && !strings.Contains(body, "decrypted by server") {
+				t.Errorf("message not shown as encrypted:\n%s", body)
+			}
+			link := regexp.MustCompile(`/messages/\w+/parts/\d+`).FindString(body)
+			if link == "" {
+				link = message + "/parts/0"
+			}
+			if resp, body := get(t, srv.URL+link, true); resp.StatusCode != tc.status || strings.Contains(body, "secret file") != (tc.status == http.StatusOK) {
+				t.Errorf("part: expected %d, got %d: %q", tc.status, resp.StatusCode, body)
+			}
+		})
+	}
+}
+
+// viewing does not change the mbox file, marking read changes the message
+// shown even after others were removed
+func TestViewerRead(t *testing.T) {
+	srv := newViewerServer(t, &Viewer{})
+	for _, subject := range []string{"one", "two", "three"} {
+		appendMbox(t, "", mbox.Form{From: "alice@localhost", Subject: subject, Message: "hello"})
+	}
+	ids := viewerIDs(t)
+	before, err := os.ReadFile(mboxname)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, body := get(t, srv.URL+"/messages/"+ids[2], true); !strings.Contains(body, `action="/messages/`+ids[2]+`/read"`) {
+		t.Fatalf("no mark read button:\n%s", body)
+	}
+	if after, _ := os.ReadFile(mboxname); !bytes.Equal(before, after) {
+		t.Fatal("viewing changed the mbox file")
+	}
+	if _, err := mbox.Expunge(mboxname, mbox.ByIndex(0)); err != nil {
+		t.Fatal(err)
+	}
+	post := func(path, site string) int {
+		t.Helper()
+		req, _ := http.NewRequest("POST", srv.URL+path, nil)
+		req.SetBasicAuth("admin", "secret")
+		if site != "" {
+			req.Header.Set("Sec-Fetch-Site", site)
+		}
+		resp, err := (&http.Client{CheckRedirect: func(*http.Request, []*http.Request) error { return http.ErrUseLastResponse }}).Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+	if code := post("/messages/"+ids[2]+"/read", "cross-site"); code != http.StatusForbidden {
+		t.Errorf("cross-site: expected 403, got %d", code)
+	}
+	if code := post("/messages/"+ids[2]+"/read", "same-origin"); code != http.StatusSeeOther {
+		t.Errorf("expected 303, got %d", code)
+	}
+	entries, err := readEntries()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i, want := range []mbox.Flags{0, mbox.FlagRead | mbox.FlagOld} {
+		if got := entries[i].Flags(); got != want {
+			t.Errorf("message %d: expected %v, got %v", i, want, got)
+		}
+	}
+}
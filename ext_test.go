@@ -118,3 +118,64 @@ func TestGzip(t *testing.T) {
 		//fmt.Printf("%s\n", gzipped.String())
 	}
 }
+
+// TestReaderEncrypted reads back age encrypted messages, written like Loop does when AgeRecipient is set
+func TestReaderEncrypted(t *testing.T) {
+	id, err := age.GenerateX25519Identity()
+	if err != nil {
+		t.Fatal(err)
+	}
+	outfile := new(bytes.Buffer)
+	plain := mbox.Form{From: "Alice <alice@localhost>", Subject: "plain", Message: "not encrypted"}
+	plain.WriteTo(outfile)
+	for i := 0; i < 5; i++ {
+		msg := mbox.Form{
+			From:    "Alice <alice@localhost>",
+			Subject: fmt.Sprintf("secret %d", i),
+			Message: "From here on, everything is encrypted.\n\nFrom the start.",
+		}
+		fmt.Fprint(outfile, "# Encrypted message (age+aerth/mbox):\n")
+		encrypter, err := age.Encrypt(outfile, id.Recipient())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := msg.WriteTo(encrypter); err != nil {
+			t.Fatal(err)
+		}
+		if err := encrypter.Close(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	entries, err := mbox.NewReader(outfile).ReadAll()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 6 {
+		t.Fatalf("expected 6 entries, got %d", len(entries))
+	}
+	if entries[0].Encrypted {
+		t.Fatalf("first entry should not be encrypted")
+	}
+	for i, entry := range entries[1:] {
+		if !entry.Encrypted {
+			t.Fatalf("entry %d should be encrypted", i+1)
+		}
+		if _, err := entry.Mail(); err == nil {
+			t.Fatalf("entry %d: expected error parsing encrypted message", i+1)
+		}
+		dec, err := entry.Decrypt(id)
+		if err != nil {
+			t.Fatalf("entry %d: %v", i+1, err)
+		}
+		if dec.Offset != entry.Offset || dec.Encrypted {
+			t.Fatalf("entry %d: unexpected decrypted entry: %+v", i+1, dec)
+		}
+		msg, err := dec.Mail()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if want := fmt.Sprintf("secret %d", i); msg.Header.Get("Subject") != want {
+			t.Errorf("entry %d: expected subject %q, got %q", i+1, want, msg.Header.Get("Subject"))
+		}
+	}
+}
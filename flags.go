@@ -0,0 +1,260 @@
+package mbox
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+)
+
+// Flags are the state of a message kept by mail clients, eg: mutt, in its
+// Status and X-Status headers. A message is new without FlagRead or FlagOld.
+type Flags uint8
+
+const (
+	FlagRead    Flags = 1 << iota // Status: R, the message was read
+	FlagOld                       // Status: O, seen by a mail client, not new
+	FlagReplied                   // X-Status: A, answered
+	FlagFlagged                   // X-Status: F, marked important
+	FlagDeleted                   // X-Status: D, removed by Compact
+)
+
+// flagNames are the names of the flags, in their bit order
+var flagNames = []string{"read", "old", "replied", "flagged", "deleted"}
+
+// New reports whether the message was not seen yet
+func (f Flags) New() bool {
+	return f&(FlagRead|FlagOld) == 0
+}
+
+// String returns the comma separated flag names, eg: "read,replied",
+// with "new" for a new message
+func (f Flags) String() string {
+	var names []string
+	if f.New() {
+		names = append(names, "new")
+	}
+	for i, name := range flagNames {
+		if f&(1<<i) != 0 {
+			names = append(names, name)
+		}
+	}
+	return strings.Join(names, ",")
+}
+
+// MarshalText returns the flag names (see String)
+func (f Flags) MarshalText() ([]byte, error) {
+	return []byte(f.String()), nil
+}
+
+// UnmarshalText parses comma separated flag names, "new" sets no flag
+func (f *Flags) UnmarshalText(text []byte) error {
+	var flags Flags
+	for _, name := range strings.Split(string(text), ",") {
+		name = strings.ToLower(strings.TrimSpace(name))
+		if name == "" || name == "new" {
+			continue
+		}
+		i := 0
+		for i < len(flagNames) && flagNames[i] != name {
+			i++
+		}
+		if i == len(flagNames) {
+			return fmt.Errorf("unknown flag %q", name)
+		}
+		flags |= 1 << i
+	}
+	*f = flags
+	return nil
+}
+
+// status returns the Status header letters of the flags
+func (f Flags) status() string {
+	return f.letters("RO", FlagRead, FlagOld)
+}
+
+// xstatus returns the X-Status header letters of the flags
+func (f Flags) xstatus() string {
+	return f.letters("AFD", FlagReplied, FlagFlagged, FlagDeleted)
+}
+
+// letters returns the letters of the flags that are set
+func (f Flags) letters(letters string, flags ...Flags) string {
+	var b strings.Builder
+	for i, flag := range flags {
+		if f&flag != 0 {
+			b.WriteByte(letters[i])
+		}
+	}
+	return b.String()
+}
+
+// parseFlags reads the Status and X-Status header values.
+// A D in Status is also read as deleted.
+func parseFlags(status, xstatus string) Flags {
+	var f Flags
+	for _, c := range status + xstatus {
+		switch c {
+		case 'R':
+			f |= FlagRead
+		case 'O':
+			f |= FlagOld
+		case 'A':
+			f |= FlagReplied
+		case 'F':
+			f |= FlagFlagged
+		case 'D':
+			f |= FlagDeleted
+		}
+	}
+	return f
+}
+
+// Flags returns the flags of the entry, from its Status and X-Status
+// headers. Encrypted entries have no flags.
+func (e *Entry) Flags() Flags {
+	msg, err := e.Mail()
+	if err != nil {
+		return 0
+	}
+	return parseFlags(msg.Header.Get("Status"), msg.Header.Get("X-Status"))
+}
+
+// SetFlags sets, then clears, flags of the entries selected by match, and
+// returns the number changed. Encrypted entries are not changed.
+func SetFlags(filename string, match Match, set, clear Flags) (changed int, err error) {
+	return edit(filename, os.O_RDWR, func(index int, e *Entry) *change {
+		if e.Encrypted || !match(index, e) {
+			return nil
+		}
+		return flagsChange(e.Raw, set, clear)
+	})
+}
+
+// headerField is a header field of a raw message, with its continuation lines
+type headerField struct {
+	name            string // lower case
+	start, end      int    // the field, with its line ending
+	valueStart, eol int    // the value after the colon, up to the line ending
+	multiline       bool
+}
+
+// flagsChange returns the change of the Status and X-Status headers of raw
+// setting, then clearing flags, nil if the flags stay the same
+func flagsChange(raw []byte, set, clear Flags) *change {
+	var fields []headerField
+	headerEnd := -1
+	newline := "\n"
+	for i := 0; i < len(raw); {
+		j := bytes.IndexByte(raw[i:], '\n')
+		if j < 0 {
+			break
+		}
+		line := raw[i : i+j+1]
+		eol := i + len(bytes.TrimRight(line, "\r\n"))
+		if i == 0 && bytes.HasSuffix(line, []byte("\r\n")) {
+			newline = "\r\n"
+		}
+		switch {
+		case eol == i:
+			headerEnd = i
+		case line[0] == ' ' || line[0] == '\t':
+			if len(fields) != 0 {
+				fields[len(fields)-1].end, fields[len(fields)-1].eol = i+j+1, eol
+				fields[len(fields)-1].multiline = true
+			}
+		default:
+			name, _, ok := bytes.Cut(line, []byte(":"))
+			if !ok {
+				return nil // not a header
+			}
+			fields = append(fields, headerField{name: strings.ToLower(string(name)), start: i, end: i + j + 1,
+				valueStart: i + len(name) + 1, eol: eol})
+		}
+		if headerEnd >= 0 {
+			break
+		}
+		i += j + 1
+	}
+	if headerEnd < 0 {
+		return nil // no body, or not a message
+	}
+	find := func(name string) *headerField {
+		for i := range fields {
+			if fields[i].name == name {
+				return &fields[i]
+			}
+		}
+		return nil
+	}
+	value := func(f *headerField) string {
+		if f == nil {
+			return ""
+		}
+		return string(raw[f.valueStart:f.eol])
+	}
+	status, xstatus := find("status"), find("x-status")
+	old := parseFlags(value(status), value(xstatus))
+	flags := (old | set) &^ clear
+	if flags == old {
+		return nil
+	}
+
+	type replacement struct {
+		start, end int
+		data       string
+	}
+	headers := []struct {
+		name    string
+		field   *headerField
+		letters string
+		known   string // the letters of all the flags, the room written for them
+	}{
+		{"Status", status, flags.status(), "RO"},
+		{"X-Status", xstatus, flags.xstatus(), "AFD"},
+	}
+	// the headers without room for their letters are written again, with the
+	// missing ones: the file is rewritten anyway, later changes are in place
+	grow := false
+	for i := range headers {
+		h := &headers[i]
+		// letters of other flags, eg: T in a mutt X-Status, are kept
+		h.letters += strings.Map(func(c rune) rune {
+			if c == ' ' || c == '\t' || strings.ContainsRune(h.known, c) {
+				return -1
+			}
+			return c
+		}, value(h.field))
+		if f := h.field; f == nil && h.letters != "" || f != nil && (f.multiline || f.eol-f.valueStart < len(h.letters)+1) {
+			grow = true
+		}
+	}
+	var edits []replacement
+	for _, h := range headers {
+		f := h.field
+		padded := h.letters + strings.Repeat(" ", max(0, len(h.known)-len(h.letters)))
+		switch {
+		case f == nil && grow:
+			edits = append(edits, replacement{headerEnd, headerEnd, h.name + ": " + padded + newline})
+		case f == nil, strings.TrimSpace(value(f)) == h.letters:
+		case !f.multiline && f.eol-f.valueStart >= len(h.letters)+1:
+			room := f.eol - f.valueStart - 1
+			edits = append(edits, replacement{f.valueStart, f.eol, " " + h.letters + strings.Repeat(" ", room-len(h.letters))})
+		default:
+			edits = append(edits, replacement{f.start, f.end, h.name + ": " + padded + newline})
+		}
+	}
+	if len(edits) == 0 {
+		return nil
+	}
+	sort.SliceStable(edits, func(i, j int) bool { return edits[i].start < edits[j].start })
+	c := &change{start: edits[0].start, end: edits[len(edits)-1].end}
+	at := c.start
+	for _, e := range edits {
+		c.data = append(c.data, raw[at:e.start]...)
+		c.data = append(c.data, e.data...)
+		at = e.end
+	}
+	return c
+}
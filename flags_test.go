@@ -0,0 +1,173 @@
+package mbox_test
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/aerth/mbox"
+)
+
+func TestFlagsText(t *testing.T) {
+	for _, tc := range []struct {
+		flags mbox.Flags
+		text  string
+	}{
+		{0, "new"},
+		{mbox.FlagRead | mbox.FlagOld, "read,old"},
+		{mbox.FlagReplied | mbox.FlagDeleted, "new,replied,deleted"},
+	} {
+		text, _ := tc.flags.MarshalText()
+		if string(text) != tc.text {
+			t.Errorf("%d: got %q, want %q", tc.flags, text, tc.text)
+		}
+		var got mbox.Flags
+		if err := got.UnmarshalText(text); err != nil || got != tc.flags {
+			t.Errorf("%s: got %v, %v", text, got, err)
+		}
+	}
+	var f mbox.Flags
+	if err := f.UnmarshalText([]byte("read,starred")); err == nil || !strings.Contains(err.Error(), "starred") {
+		t.Errorf("expected error for starred, got %v", err)
+	}
+}
+
+// flagsMbox writes messages to a new mbox file with opts
+func flagsMbox(t *testing.T, opts mbox.Options, forms ...mbox.Form) string {
+	t.Helper()
+	var buf bytes.Buffer
+	for _, form := range forms {
+		if _, err := form.WriteWith(&buf, opts); err != nil {
+			t.Fatal(err)
+		}
+	}
+	filename := filepath.Join(t.TempDir(), "flags.mbox")
+	if err := os.WriteFile(filename, buf.Bytes(), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return filename
+}
+
+// readFlags returns the flags of the entries of a mbox file
+func readFlags(t *testing.T, filename string) []mbox.Flags {
+	t.Helper()
+	f, err := os.Open(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	entries, err := mbox.NewReader(f).ReadAll()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var flags []mbox.Flags
+	for _, e := range entries {
+		flags = append(flags, e.Flags())
+	}
+	return flags
+}
+
+// setFlags calls SetFlags, checking whether the file was rewritten
+func setFlags(t *testing.T, filename string, match mbox.Match, set, clear mbox.Flags, rewritten bool) {
+	t.Helper()
+	before, err := os.Stat(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if changed, err := mbox.SetFlags(filename, match, set, clear); err != nil || changed != 1 {
+		t.Fatalf("expected 1 message changed, got %d, %v", changed, err)
+	}
+	after, err := os.Stat(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := !os.SameFile(before, after); got != rewritten {
+		t.Errorf("rewritten: got %v, want %v", got, rewritten)
+	}
+	if !rewritten && before.Size() != after.Size() {
+		t.Errorf("size changed in place: %d, then %d", before.Size(), after.Size())
+	}
+}
+
+func TestSetFlagsInPlace(t *testing.T) {
+	opts := *goldenOptions(mbox.MboxO)
+	opts.Status = true
+	var forms []mbox.Form
+	for i := 0; i < 3; i++ {
+		forms = append(forms, mbox.Form{From: "alice@localhost", Subject: "message " + strconv.Itoa(i), Message: "hello"})
+	}
+	filename := flagsMbox(t, opts, forms...)
+	setFlags(t, filename, mbox.ByIndex(1), mbox.FlagRead|mbox.FlagOld, 0, false)
+	setFlags(t, filename, mbox.ByIndex(1), mbox.FlagReplied|mbox.FlagFlagged|mbox.FlagDeleted, mbox.FlagRead, false)
+	want := []mbox.Flags{0, mbox.FlagOld | mbox.FlagReplied | mbox.FlagFlagged | mbox.FlagDeleted, 0}
+	if got := readFlags(t, filename); !slices.Equal(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+	if changed, err := mbox.SetFlags(filename, mbox.ByIndex(1), mbox.FlagOld, 0); changed != 0 || err != nil {
+		t.Errorf("expected no change, got %d, %v", changed, err)
+	}
+	if removed, err := mbox.Compact(filename); removed != 1 || err != nil {
+		t.Errorf("expected 1 removed, got %d, %v", removed, err)
+	}
+}
+
+func TestSetFlagsRewrite(t *testing.T) {
+	filename := flagsMbox(t, *goldenOptions(mbox.MboxO),
+		mbox.Form{From: "alice@localhost", Subject: "no status", Message: "hello"},
+		mbox.Form{From: "bob@localhost", Subject: "reply", Message: "Status: R\n\nnot a header"})
+	setFlags(t, filename, mbox.ByIndex(1), mbox.FlagRead, 0, true)
+	// written with room for the other flags
+	setFlags(t, filename, mbox.ByIndex(1), mbox.FlagOld|mbox.FlagReplied|mbox.FlagFlagged|mbox.FlagDeleted, 0, false)
+	f, err := os.Open(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	entries, err := mbox.NewReader(f).ReadAll()
+	if err != nil {
+		t.Fatal(err)
+	}
+	form, err := entries[1].Form()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := mbox.FlagRead | mbox.FlagOld | mbox.FlagReplied | mbox.FlagFlagged | mbox.FlagDeleted; form.Flags != want {
+		t.Errorf("got %v, want %v", form.Flags, want)
+	}
+	if form.Message != "Status: R\n\nnot a header\n" {
+		t.Errorf("body changed: %q", form.Message)
+	}
+	if entries[0].Flags() != 0 {
+		t.Errorf("first message changed: %v", entries[0].Flags())
+	}
+}
+
+// the Status and X-Status headers of mail clients are kept, with their
+// line endings and the flags this package does not know
+func TestSetFlagsMutt(t *testing.T) {
+	filename := filepath.Join(t.TempDir(), "mutt.mbox")
+	mutt := "From alice@localhost Wed May  1 12:30:05 2024\r\n" +
+		"From: alice@localhost\r\n" +
+		"Status: O\r\n" +
+		"X-Status: T\r\n" +
+		"Subject: tagged\r\n" +
+		"\r\n" +
+		"hello\r\n"
+	if err := os.WriteFile(filename, []byte(mutt), 0600); err != nil {
+		t.Fatal(err)
+	}
+	setFlags(t, filename, mbox.ByIndex(0), mbox.FlagReplied, 0, true)
+	setFlags(t, filename, mbox.ByIndex(0), 0, mbox.FlagOld, false)
+	got, err := os.ReadFile(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := strings.Replace(strings.Replace(mutt, "X-Status: T\r\n", "X-Status: AT \r\n", 1), "Status: O", "Status:  ", 1)
+	if string(got) != want {
+		t.Errorf("got:\n%q\nwant:\n%q", got, want)
+	}
+}
@@ -0,0 +1,164 @@
+package mbox_test
+
+import (
+	"bytes"
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/aerth/mbox"
+)
+
+var update = flag.Bool("update", false, "update the golden files in testdata/golden")
+
+// goldenOptions returns options giving the same output on every run
+func goldenOptions(dialect mbox.Dialect) *mbox.Options {
+	ids, boundaries := 0, 0
+	return &mbox.Options{
+		Clock: func() time.Time { return time.Date(2024, 5, 1, 12, 30, 5, 250000000, time.UTC) },
+		MessageID: func() string {
+			ids++
+			return fmt.Sprintf("<%d.golden@localhost>", ids)
+		},
+		Boundary: func() string {
+			boundaries++
+			return fmt.Sprintf("golden-%d", boundaries)
+		},
+		Dialect: dialect,
+	}
+}
+
+// checkGolden compares got with testdata/golden/name, or updates it with -update
+func checkGolden(t *testing.T, name string, got []byte) {
+	t.Helper()
+	filename := filepath.Join("testdata", "golden", name)
+	if *update {
+		if err := os.MkdirAll(filepath.Dir(filename), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(filename, got, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	want, err := os.ReadFile(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, want) {
+		t.Errorf("%s differs, run go test -update to update it\ngot:\n%s\nwant:\n%s", filename, got, want)
+	}
+}
+
+const quotedLines = "From the contact form:\n>From a reply\n>>From an older reply\nFrom\nFromage\n\nFrom the end"
+
+func TestGolden(t *testing.T) {
+	for _, tc := range []struct {
+		name        string
+		dialect     mbox.Dialect
+		destination string
+		location    *time.Location
+		form        mbox.Form
+	}{
+		{name: "plain.mbox", form: mbox.Form{From: "Alice <alice@localhost>", Subject: "hello", Message: "world\n\n"}},
+		{name: "defaults.mbox", form: mbox.Form{Message: "no from and no subject"}},
+		{name: "received.mbox", form: mbox.Form{From: "alice@localhost", Subject: "hello", Message: "world",
+			Received: time.Date(2023, 12, 31, 23, 59, 59, 0, time.FixedZone("", -5*3600)), MessageID: "<fixed@localhost>"}},
+		{name: "mboxo.mbox", dialect: mbox.MboxO, form: mbox.Form{From: "alice@localhost", Subject: "quoting", Message: quotedLines}},
+		{name: "mboxrd.mbox", dialect: mbox.MboxRD, form: mbox.Form{From: "alice@localhost", Subject: "quoting", Message: quotedLines}},
+		{name: "headers.mbox", destination: "support@localhost", form: mbox.Form{From: "alice@localhost", Subject: "order",
+			Message: "where is it?", Headers: map[string]string{"x-order": "A-42", "X-Phone": "555\r\n 0100", "Content-Type": "text/html", "To": "ignored"}}},
+		{name: "trace.mbox", form: mbox.Form{From: "alice@localhost", Subject: "trace", Message: "hello",
+			Sent: time.Date(2024, 5, 1, 14, 29, 0, 0, time.FixedZone("CEST", 2*3600)),
+			Trace: []mbox.Trace{
+				{IP: "192.0.2.1", By: "forms.example.com", With: "HTTPS"},
+				{From: "mail.example.com", IP: "2001:db8::1", By: "mx.example.com", With: "ESMTPS", ID: "42", For: "me@example.com",
+					Time: time.Date(2024, 5, 1, 12, 29, 30, 0, time.UTC)},
+				{Text: "from old.example.net by mail.example.com with SMTP; Wed, 01 May 2024 12:28:00 +0000"},
+			}}},
+		{name: "timezone.mbox", location: time.FixedZone("EST", -5*3600), form: mbox.Form{From: "alice@localhost", Subject: "time zones",
+			Message: "sent from Tokyo, delivered in New York", Sent: time.Date(2024, 5, 1, 21, 29, 0, 0, time.FixedZone("JST", 9*3600)),
+			Trace: []mbox.Trace{{IP: "192.0.2.1", By: "forms.example.com", With: "HTTP"}}}},
+		{name: "date-header.mbox", form: mbox.Form{From: "alice@localhost", Subject: "client date", Message: "hello",
+			Headers: map[string]string{"date": "Wed, 1 May 2024 08:29:00 -0400"}}},
+		{name: "flags.mbox", form: mbox.Form{From: "alice@localhost", Subject: "flags", Message: "read and replied",
+			Flags: mbox.FlagRead | mbox.FlagOld | mbox.FlagReplied}},
+		{name: "reply.mbox", form: mbox.Form{From: "support@localhost", Subject: "Re: help", Message: "try again",
+			InReplyTo: "<3@localhost>", References: []string{"<1@localhost>", "<2@localhost>", "<3@localhost>"}}},
+		{name: "body.mbox", form: mbox.Form{From: "alice@localhost", Subject: "body", Message: "text", Body: []byte("From the body\n")}},
+		{name: "html.mbox", form: mbox.Form{From: "alice@localhost", Subject: "html", Message: "hello", HTML: "<p>hello</p>"}},
+		{name: "attachments.mbox", dialect: mbox.MboxRD, form: mbox.Form{From: "alice@localhost", Subject: "attachments",
+			Message: "see attached\nFrom me", HTML: "<p>see attached</p>",
+			Attachments: []mbox.Attachment{
+				{Filename: "notes.txt", ContentType: "text/plain; charset=utf-8", Data: []byte("From the notes\n")},
+				{Filename: "data.bin", Data: bytes.Repeat([]byte{0, 1, 2, 3, 0xff}, 40)},
+			}}},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			mbox.Destination = tc.destination
+			defer func() { mbox.Destination = "" }()
+			var buf bytes.Buffer
+			opts := goldenOptions(tc.dialect)
+			opts.Location = tc.location
+			n, err := tc.form.WriteWith(&buf, *opts)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if n != int64(buf.Len()) {
+				t.Errorf("WriteWith returned %d, wrote %d bytes", n, buf.Len())
+			}
+			checkGolden(t, tc.name, buf.Bytes())
+		})
+	}
+}
+
+// quoted "From " lines must not start a new message
+func TestGoldenQuoting(t *testing.T) {
+	for _, name := range []string{"mboxo.mbox", "mboxrd.mbox", "attachments.mbox"} {
+		f, err := os.Open(filepath.Join("testdata", "golden", name))
+		if err != nil {
+			t.Fatal(err)
+		}
+		entries, err := mbox.NewReader(f).ReadAll()
+		f.Close()
+		if err != nil || len(entries) != 1 {
+			t.Errorf("%s: expected 1 message, got %d (%v)", name, len(entries), err)
+		}
+	}
+}
+
+func TestMailboxOptions(t *testing.T) {
+	filename := filepath.Join(t.TempDir(), "golden.mbox")
+	m := &mbox.Mailbox{Filename: filename, Options: goldenOptions(mbox.MboxRD), Validators: []mbox.Validator{}}
+	if err := m.Open(nil); err != nil {
+		t.Fatal(err)
+	}
+	m.Save(&mbox.Form{From: "alice@localhost", Subject: "first", Message: "From me"})
+	m.Save(&mbox.Form{From: "bob@localhost", Subject: "second", Message: ">From you"})
+	m.Close()
+	got, err := os.ReadFile(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkGolden(t, "mailbox.mbox", got)
+}
+
+func TestDialectText(t *testing.T) {
+	for _, d := range []mbox.Dialect{mbox.MboxO, mbox.MboxRD} {
+		text, err := d.MarshalText()
+		if err != nil {
+			t.Fatal(err)
+		}
+		var got mbox.Dialect
+		if err := got.UnmarshalText(text); err != nil || got != d {
+			t.Errorf("%s: got %v, %v", text, got, err)
+		}
+	}
+	var d mbox.Dialect
+	if err := d.UnmarshalText([]byte("mboxcl2")); err == nil || !strings.Contains(err.Error(), "mboxcl2") {
+		t.Errorf("expected error for mboxcl2, got %v", err)
+	}
+}
@@ -0,0 +1,247 @@
+package mbox
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"os/exec"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Saved describes a message written to an mbox file, see Hook
+type Saved struct {
+	Mailbox   string        `json:"mailbox"`              // mbox file name, empty if unknown (eg: os.Stdout)
+	Offset    int64         `json:"offset"`               // where the message begins in the file, -1 if unknown
+	Size      int64         `json:"size"`                 // bytes written, including the encrypted marker and separator
+	MessageID string        `json:"message_id,omitempty"` // Message-ID header, if known
+	From      string        `json:"from,omitempty"`       // From header, if known and not Encrypted
+	Subject   string        `json:"subject,omitempty"`    // Subject header, if known and not Encrypted
+	Encrypted bool          `json:"encrypted"`
+	Time      time.Time     `json:"time"`     // when the message was written
+	Duration  time.Duration `json:"duration"` // time spent writing, in nanoseconds
+}
+
+// Hook is notified by the writer goroutine after a message is written,
+// it should return quickly
+type Hook interface {
+	Saved(Saved)
+}
+
+// HookFunc is a function used as a Hook
+type HookFunc func(Saved)
+
+// Saved calls f
+func (f HookFunc) Saved(s Saved) {
+	f(s)
+}
+
+// Hooks are called after Loop writes a message (see Hook).
+// Set before calling Open function.
+var Hooks []Hook
+
+// runHooks calls each hook
+func runHooks(hooks []Hook, s Saved) {
+	for _, h := range hooks {
+		h.Saved(s)
+	}
+}
+
+// newSaved returns the metadata of a message written by the writer goroutine
+func newSaved(filename string, offset, size int64, form Writable, encrypted bool, start time.Time) Saved {
+	now := time.Now()
+	s := Saved{
+		Mailbox:   filename,
+		Offset:    offset,
+		Size:      size,
+		Encrypted: encrypted,
+		Time:      now.UTC(),
+		Duration:  now.Sub(start),
+	}
+	switch f := form.(type) {
+	case *Form:
+		s.MessageID, s.From, s.Subject = f.MessageID, f.From, f.Subject
+	case *StreamForm:
+		s.MessageID, s.From, s.Subject = f.MessageID, f.From, f.Subject
+	case *spilledMessage:
+		s.MessageID, s.From, s.Subject = f.messageID, f.from, f.subject
+	}
+	if encrypted {
+		s.From, s.Subject = "", ""
+	}
+	return s
+}
+
+// fileOffset returns the end of the file, where the next message is appended,
+// or -1 if w is not a seekable file
+func fileOffset(w io.Writer) int64 {
+	seeker, ok := w.(io.Seeker)
+	if !ok {
+		return -1
+	}
+	offset, err := seeker.Seek(0, io.SeekEnd)
+	if err != nil {
+		return -1
+	}
+	return offset
+}
+
+// fileName returns the name of w if it is a file, other than os.Stdout
+func fileName(w io.Writer) string {
+	if f, ok := w.(*os.File); ok && f != os.Stdout {
+		return f.Name()
+	}
+	return ""
+}
+
+// WebHook posts the Saved metadata as JSON to URL, retrying failed deliveries,
+// signed with Secret in a X-Mbox-Signature header: "sha256=" and the hex HMAC-SHA256
+type WebHook struct {
+	URL     string
+	Secret  []byte        // optional, signs the request body
+	Retries int           // retries after the first attempt, default 3
+	Backoff time.Duration // delay before the first retry, doubled after each retry, default 1s
+	Client  *http.Client  // default: http.Client with a 10s timeout
+
+	wg sync.WaitGroup
+}
+
+// Saved posts s in a new goroutine
+func (h *WebHook) Saved(s Saved) {
+	h.wg.Add(1)
+	go func() {
+		defer h.wg.Done()
+		if err := h.Deliver(context.Background(), s); err != nil {
+			logger(nil).Error("webhook failed", "url", h.URL, "message_id", s.MessageID, "error", err)
+		}
+	}()
+}
+
+// Wait waits for pending deliveries
+func (h *WebHook) Wait() {
+	h.wg.Wait()
+}
+
+// Deliver posts s, retrying until a 2xx response, the retries are used up or ctx is done
+func (h *WebHook) Deliver(ctx context.Context, s Saved) error {
+	body, err := json.Marshal(s)
+	if err != nil {
+		return err
+	}
+	client := h.Client
+	if client == nil {
+		client = &http.Client{Timeout: 10 * time.Second}
+	}
+	retries, backoff := h.Retries, h.Backoff
+	if retries <= 0 {
+		retries = 3
+	}
+	if backoff <= 0 {
+		backoff = time.Second
+	}
+	for attempt := 0; ; attempt++ {
+		err = h.post(ctx, client, body)
+		if err == nil || attempt == retries {
+			return err
+		}
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(backoff):
+		}
+		backoff *= 2
+	}
+}
+
+func (h *WebHook) post(ctx context.Context, client *http.Client, body []byte) error {
+	req, err := http.NewRequestWithContext(ctx, "POST", h.URL, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", "aerth/mbox/"+Version)
+	if len(h.Secret) != 0 {
+		req.Header.Set("X-Mbox-Signature", Signature(h.Secret, body))
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	io.Copy(io.Discard, io.LimitReader(resp.Body, 4096))
+	resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("unexpected response: %s", resp.Status)
+	}
+	return nil
+}
+
+// Signature returns the X-Mbox-Signature header value for a WebHook request body
+func Signature(secret, body []byte) string {
+	mac := hmac.New(sha256.New, secret)
+	mac.Write(body)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+// CommandHook runs a command for each saved message, with the Saved metadata as
+// JSON on stdin and in MBOX_ environment variables (eg: MBOX_FILE, MBOX_MESSAGE_ID)
+type CommandHook struct {
+	Command string
+	Args    []string
+	Timeout time.Duration // default 30s
+
+	wg sync.WaitGroup
+}
+
+// Saved runs the command in a new goroutine
+func (h *CommandHook) Saved(s Saved) {
+	h.wg.Add(1)
+	go func() {
+		defer h.wg.Done()
+		if err := h.Run(s); err != nil {
+			logger(nil).Error("hook command failed", "command", h.Command, "message_id", s.MessageID, "error", err)
+		}
+	}()
+}
+
+// Wait waits for running commands
+func (h *CommandHook) Wait() {
+	h.wg.Wait()
+}
+
+// Run runs the command and waits for it to finish
+func (h *CommandHook) Run(s Saved) error {
+	timeout := h.Timeout
+	if timeout <= 0 {
+		timeout = 30 * time.Second
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	body, err := json.Marshal(s)
+	if err != nil {
+		return err
+	}
+	cmd := exec.CommandContext(ctx, h.Command, h.Args...)
+	cmd.Stdin = bytes.NewReader(body)
+	cmd.Env = append(os.Environ(),
+		"MBOX_FILE="+s.Mailbox,
+		"MBOX_OFFSET="+strconv.FormatInt(s.Offset, 10),
+		"MBOX_SIZE="+strconv.FormatInt(s.Size, 10),
+		"MBOX_MESSAGE_ID="+s.MessageID,
+		"MBOX_FROM="+s.From,
+		"MBOX_SUBJECT="+s.Subject,
+		"MBOX_ENCRYPTED="+strconv.FormatBool(s.Encrypted),
+	)
+	out, err := cmd.CombinedOutput()
+	if err != nil && len(out) != 0 {
+		return fmt.Errorf("%v: %s", err, bytes.TrimSpace(out))
+	}
+	return err
+}
@@ -0,0 +1,162 @@
+package mbox_test
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"filippo.io/age"
+	"github.com/aerth/mbox"
+)
+
+func TestHooks(t *testing.T) {
+	var mu sync.Mutex
+	var saved []mbox.Saved
+	m := &mbox.Mailbox{
+		Filename: filepath.Join(t.TempDir(), "hooks.mbox"),
+		Hooks: []mbox.Hook{mbox.HookFunc(func(s mbox.Saved) {
+			mu.Lock()
+			saved = append(saved, s)
+			mu.Unlock()
+		})},
+	}
+	if err := m.Open(nil); err != nil {
+		t.Fatal(err)
+	}
+	for _, subject := range []string{"one", "two", "three"} {
+		m.Save(&mbox.Form{From: "alice@localhost", Subject: subject, Message: "hello"})
+	}
+	for m.Queued() != 0 {
+		time.Sleep(10 * time.Millisecond)
+	}
+	m.Close()
+
+	f, err := os.Open(m.Filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	entries, err := mbox.NewReader(f).ReadAll()
+	if err != nil {
+		t.Fatal(err)
+	}
+	info, _ := f.Stat()
+	mu.Lock()
+	defer mu.Unlock()
+	if len(saved) != 3 || len(entries) != 3 {
+		t.Fatalf("expected 3 saved messages, got %d hooks and %d entries", len(saved), len(entries))
+	}
+	var total int64
+	for i, s := range saved {
+		msg, err := entries[i].Mail()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if s.Mailbox != m.Filename || s.Offset != entries[i].Offset || s.Encrypted {
+			t.Errorf("message %d: unexpected metadata %+v", i, s)
+		}
+		if s.MessageID == "" || s.MessageID != msg.Header.Get("Message-ID") || s.Subject != msg.Header.Get("Subject") {
+			t.Errorf("message %d: expected Message-ID %q, got %q", i, msg.Header.Get("Message-ID"), s.MessageID)
+		}
+		total += s.Size
+	}
+	if total != info.Size() {
+		t.Errorf("expected total size %d, got %d", info.Size(), total)
+	}
+}
+
+func TestWebHook(t *testing.T) {
+	secret := []byte("hook secret")
+	var mu sync.Mutex
+	var attempts int
+	var got mbox.Saved
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		attempts++
+		body, _ := io.ReadAll(r.Body)
+		if r.Header.Get("X-Mbox-Signature") != mbox.Signature(secret, body) {
+			http.Error(w, "bad signature", http.StatusUnauthorized)
+			return
+		}
+		if attempts == 1 {
+			http.Error(w, "try again", http.StatusServiceUnavailable)
+			return
+		}
+		json.Unmarshal(body, &got)
+	}))
+	defer srv.Close()
+
+	hook := &mbox.WebHook{URL: srv.URL, Secret: secret, Backoff: time.Millisecond}
+	hook.Saved(mbox.Saved{Mailbox: "test.mbox", Offset: 42, Size: 100, MessageID: "<1@localhost>"})
+	hook.Wait()
+	mu.Lock()
+	if attempts != 2 {
+		t.Fatalf("expected 2 attempts, got %d", attempts)
+	}
+	if got.Mailbox != "test.mbox" || got.Offset != 42 || got.Size != 100 || got.MessageID != "<1@localhost>" {
+		t.Fatalf("unexpected delivery: %+v", got)
+	}
+	mu.Unlock()
+
+	bad := &mbox.WebHook{URL: srv.URL, Secret: []byte("wrong"), Retries: 2, Backoff: time.Millisecond}
+	err := bad.Deliver(context.Background(), mbox.Saved{})
+	mu.Lock()
+	defer mu.Unlock()
+	if err == nil || attempts != 5 {
+		t.Fatalf("expected error after 3 attempts, got %v after %d", err, attempts-2)
+	}
+}
+
+func TestCommandHook(t *testing.T) {
+	sh, err := exec.LookPath("sh")
+	if err != nil {
+		t.Skip("no sh")
+	}
+	out := filepath.Join(t.TempDir(), "out")
+	hook := &mbox.CommandHook{Command: sh, Args: []string{"-c", `cat > "$0"; echo " $MBOX_OFFSET $MBOX_MESSAGE_ID" >> "$0"`, out}}
+	if err := hook.Run(mbox.Saved{Mailbox: "test.mbox", Offset: 42, MessageID: "<1@localhost>"}); err != nil {
+		t.Fatal(err)
+	}
+	b, _ := os.ReadFile(out)
+	if !strings.HasPrefix(string(b), `{"mailbox":"test.mbox","offset":42,`) || !strings.HasSuffix(string(b), "} 42 <1@localhost>\n") {
+		t.Fatalf("unexpected output: %s", b)
+	}
+	fail := &mbox.CommandHook{Command: sh, Args: []string{"-c", "echo oops; exit 1"}}
+	if err := fail.Run(mbox.Saved{}); err == nil || !strings.Contains(err.Error(), "oops") {
+		t.Fatalf("expected error with output, got %v", err)
+	}
+}
+
+// the metadata protected by encryption is not given to hooks
+func TestHooksEncrypted(t *testing.T) {
+	id, err := age.GenerateX25519Identity()
+	if err != nil {
+		t.Fatal(err)
+	}
+	saved := make(chan mbox.Saved, 1)
+	m := &mbox.Mailbox{
+		Filename:     filepath.Join(t.TempDir(), "secret.mbox"),
+		AgeRecipient: id.Recipient().String(),
+		Hooks:        []mbox.Hook{mbox.HookFunc(func(s mbox.Saved) { saved <- s })},
+	}
+	if err := m.Open(nil); err != nil {
+		t.Fatal(err)
+	}
+	defer m.Close()
+	if err := m.Save(&mbox.Form{From: "alice@localhost", Subject: "secret subject", Message: "hello", MessageID: "<1@localhost>"}); err != nil {
+		t.Fatal(err)
+	}
+	if s := <-saved; !s.Encrypted || s.From != "" || s.Subject != "" || s.MessageID != "<1@localhost>" {
+		t.Errorf("unexpected metadata %+v", s)
+	}
+}
@@ -0,0 +1,36 @@
+package mbox
+
+import (
+	"os"
+	"sync"
+)
+
+// rewriting is read locked while a message is written, and locked by
+// Rewrite: in this process, and where files can not be locked (see flock)
+var rewriting sync.RWMutex
+
+// lockPath locks f, the file at path, opened again with flag if path was
+// replaced meanwhile (eg: by Rewrite)
+func lockPath(f *os.File, path string, flag int) (*os.File, error) {
+	for {
+		if err := flock(f); err != nil {
+			return f, err
+		}
+		current, err := f.Stat()
+		if err != nil {
+			funlock(f)
+			return f, err
+		}
+		if info, err := os.Stat(path); err == nil && os.SameFile(info, current) {
+			return f, nil
+		}
+		opened, err := os.OpenFile(path, flag, 0600)
+		if err != nil {
+			funlock(f)
+			return f, err
+		}
+		funlock(f)
+		f.Close()
+		f = opened
+	}
+}
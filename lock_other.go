@@ -0,0 +1,12 @@
+//go:build !unix
+
+package mbox
+
+import "os"
+
+// flock does nothing, only the writers of this process are locked out
+// (see rewriting)
+func flock(f *os.File) error { return nil }
+
+// funlock does nothing
+func funlock(f *os.File) error { return nil }
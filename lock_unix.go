@@ -0,0 +1,23 @@
+//go:build unix
+
+package mbox
+
+import (
+	"os"
+	"syscall"
+)
+
+// flock waits for an exclusive lock of f, shared with other processes
+func flock(f *os.File) error {
+	for {
+		err := syscall.Flock(int(f.Fd()), syscall.LOCK_EX)
+		if err != syscall.EINTR {
+			return err
+		}
+	}
+}
+
+// funlock unlocks f
+func funlock(f *os.File) error {
+	return syscall.Flock(int(f.Fd()), syscall.LOCK_UN)
+}
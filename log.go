@@ -0,0 +1,44 @@
+package mbox
+
+import (
+	"context"
+	"log/slog"
+)
+
+// Logger receives the writer events, default (nil) slog.Default() for warnings and errors.
+// Set before calling Open function.
+var Logger *slog.Logger
+
+// OnError, if set, is called when a message can not be written.
+// Set before calling Open function.
+var OnError func(err error, form Writable)
+
+// logger returns l, or the package Logger, or slog.Default() for warnings
+// and errors
+func logger(l *slog.Logger) *slog.Logger {
+	if l != nil {
+		return l
+	}
+	if Logger != nil {
+		return Logger
+	}
+	return slog.New(minLevel{Handler: slog.Default().Handler(), level: slog.LevelWarn})
+}
+
+// minLevel drops the records of h below level
+type minLevel struct {
+	slog.Handler
+	level slog.Level
+}
+
+func (h minLevel) Enabled(ctx context.Context, level slog.Level) bool {
+	return level >= h.level && h.Handler.Enabled(ctx, level)
+}
+
+func (h minLevel) WithAttrs(attrs []slog.Attr) slog.Handler {
+	return minLevel{h.Handler.WithAttrs(attrs), h.level}
+}
+
+func (h minLevel) WithGroup(name string) slog.Handler {
+	return minLevel{h.Handler.WithGroup(name), h.level}
+}
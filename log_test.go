@@ -0,0 +1,155 @@
+package mbox_test
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/aerth/mbox"
+)
+
+// syncBuffer is a bytes.Buffer safe for the writer goroutine and the test
+type syncBuffer struct {
+	mu sync.Mutex
+	b  bytes.Buffer
+}
+
+func (b *syncBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.b.Write(p)
+}
+
+// events returns the decoded JSON log lines
+func (b *syncBuffer) events(t *testing.T) []map[string]interface{} {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	var events []map[string]interface{}
+	for _, line := range bytes.Split(bytes.TrimSpace(b.b.Bytes()), []byte("\n")) {
+		var ev map[string]interface{}
+		if err := json.Unmarshal(line, &ev); err != nil {
+			t.Fatalf("%v: %s", err, line)
+		}
+		events = append(events, ev)
+	}
+	return events
+}
+
+// failingWritable is a message the writer goroutine fails to write
+type failingWritable struct{}
+
+func (failingWritable) WriteTo(w io.Writer) (int64, error) {
+	n, _ := io.WriteString(w, "From ")
+	return int64(n), errors.New("disk full")
+}
+
+func TestLogger(t *testing.T) {
+	logs := new(syncBuffer)
+	var mu sync.Mutex
+	var failed []mbox.Writable
+	var errs []error
+	m := &mbox.Mailbox{
+		Filename: filepath.Join(t.TempDir(), "log.mbox"),
+		Logger:   slog.New(slog.NewJSONHandler(logs, &slog.HandlerOptions{Level: slog.LevelDebug})),
+		OnError: func(err error, form mbox.Writable) {
+			mu.Lock()
+			failed, errs = append(failed, form), append(errs, err)
+			mu.Unlock()
+		},
+	}
+	if err := m.Open(nil); err != nil {
+		t.Fatal(err)
+	}
+	m.Save(&mbox.Form{From: "alice@localhost", Message: "hello"})
+	var bad mbox.Writable = &failingWritable{}
+	m.Save(bad)
+	for m.Queued() != 0 {
+		time.Sleep(10 * time.Millisecond)
+	}
+	m.Close()
+
+	byMsg := map[string][]map[string]interface{}{}
+	for _, ev := range logs.events(t) {
+		msg := ev["msg"].(string)
+		byMsg[msg] = append(byMsg[msg], ev)
+	}
+	if len(byMsg["message queued"]) != 2 || len(byMsg["message written"]) != 1 || len(byMsg["message not written"]) != 1 {
+		t.Fatalf("unexpected events: %v", byMsg)
+	}
+	queued, written, failedev := byMsg["message queued"][0], byMsg["message written"][0], byMsg["message not written"][0]
+	if queued["level"] != "DEBUG" || queued["mailbox"] != m.Filename {
+		t.Errorf("unexpected event: %v", queued)
+	}
+	if written["offset"] != 0.0 || written["bytes"].(float64) <= 0 ||
+		written["encrypted"] != false || written["message_id"] == "" || written["duration"] == nil {
+		t.Errorf("unexpected event: %v", written)
+	}
+	if failedev["level"] != "ERROR" || failedev["error"] == "" {
+		t.Errorf("unexpected event: %v", failedev)
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	if len(failed) != 1 || failed[0] != bad {
+		t.Fatalf("expected OnError for the failing message, got %v", failed)
+	}
+	var werr *mbox.WriteError
+	if !errors.As(errs[0], &werr) || werr.Offset <= 0 || werr.Written != 5 || werr.Mailbox != m.Filename {
+		t.Errorf("unexpected error: %#v", errs[0])
+	}
+}
+
+// without a Logger, only failures are logged, to slog.Default()
+func TestDefaultLogger(t *testing.T) {
+	defer slog.SetDefault(slog.Default())
+	logs := new(syncBuffer)
+	slog.SetDefault(slog.New(slog.NewJSONHandler(logs, &slog.HandlerOptions{Level: slog.LevelDebug})))
+	m := &mbox.Mailbox{Filename: filepath.Join(t.TempDir(), "log.mbox"), OnError: func(error, mbox.Writable) {}}
+	if err := m.Open(nil); err != nil {
+		t.Fatal(err)
+	}
+	m.Save(&mbox.Form{From: "alice@localhost", Message: "hello"})
+	m.Save(&failingWritable{})
+	for m.Queued() != 0 {
+		time.Sleep(10 * time.Millisecond)
+	}
+	m.Close()
+	events := logs.events(t)
+	if len(events) != 1 || events[0]["msg"] != "message not written" {
+		t.Errorf("expected only message not written, got %v", events)
+	}
+}
+
+// an invalid AgeRecipient must not panic, or write the message unencrypted
+func TestInvalidAgeRecipient(t *testing.T) {
+	defer func(recipient string) { mbox.AgeRecipient, mbox.OnError, mbox.Logger = recipient, nil, nil }(mbox.AgeRecipient)
+	mbox.AgeRecipient = "age1invalid"
+	mbox.Logger = slog.New(slog.NewTextHandler(new(syncBuffer), nil))
+	errs := make(chan error, 1)
+	mbox.OnError = func(err error, form mbox.Writable) { errs <- err }
+	filename := filepath.Join(t.TempDir(), "age.mbox")
+	if err := mbox.Open(nil, filename); err != nil {
+		t.Fatal(err)
+	}
+	defer mbox.Close()
+	if err := mbox.Save(&mbox.Form{From: "alice@localhost", Message: "secret"}); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case err := <-errs:
+		if err == nil || errors.Unwrap(err) == nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("timeout waiting for OnError")
+	}
+	if b, _ := os.ReadFile(filename); len(b) != 0 {
+		t.Fatalf("expected empty mbox, got %q", b)
+	}
+}
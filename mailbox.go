@@ -0,0 +1,222 @@
+package mbox
+
+import (
+	"context"
+	"io"
+	"log/slog"
+	"os"
+	"sync"
+
+	"filippo.io/age"
+)
+
+// Mailbox is an mbox file with its own writer goroutine, unlike the package
+// level Open, Save and Close functions. Set the fields, then call Open.
+type Mailbox struct {
+	Filename     string   // mbox file name, os.Stdout if empty
+	AgeRecipient string   // optional, encrypts messages (see AgeRecipient)
+	Buffer       int      // messages queued for writing, default 100
+	Overflow     Overflow // what Save does when the queue is full, default OverflowBlock
+	SpillDir     string   // with OverflowSpill, default Filename + ".spill"
+	Hooks        []Hook   // optional, called after each message is written
+	Sinks        []Sink   // optional, receive each message after it is written, eg: a Relay
+
+	// Logger receives the mailbox events, default the package Logger
+	Logger *slog.Logger
+	// OnError, if set, is called when a message can not be written,
+	// default the package OnError
+	OnError func(err error, form Writable)
+	// Metrics receives the mailbox measurements, default the package Metrics
+	Metrics Recorder
+	// Validators check messages in Save, default the package Validators
+	// (or ValidationLevel)
+	Validators []Validator
+	// Options control how messages are written, default the package DefaultOptions
+	Options *Options
+
+	writer     chan Writable
+	validators []Validator
+	spool      *spool
+	out        *output
+	file       io.WriteCloser
+	recip      age.Recipient
+	ctx        context.Context
+	cancel     context.CancelFunc
+	wg         sync.WaitGroup
+	saving     sync.RWMutex // read locked by Save, while sending to the writer goroutine
+
+	stopMu    sync.Mutex
+	stop      context.Context // Shutdown deadline
+	written   int             // by the last Shutdown
+	abandoned int
+	closeErr  error
+}
+
+// Open opens the mbox file (rw+create+append mode) and starts the writer
+// goroutine. It is stopped by Close, or when ctx is done.
+func (m *Mailbox) Open(ctx context.Context) error {
+	if m.ctx != nil && m.ctx.Err() == nil {
+		return ErrAlreadyOpen
+	}
+	if ctx == nil {
+		ctx = context.Background()
+	}
+	m.recip = nil
+	if m.AgeRecipient != "" {
+		recip, err := age.ParseX25519Recipient(m.AgeRecipient)
+		if err != nil {
+			return err
+		}
+		m.recip = recip
+	}
+	m.spool = nil
+	if m.Overflow == OverflowSpill && m.recip != nil {
+		return ErrSpillEncrypted
+	}
+	if hasRelay(m.Sinks) && m.recip != nil {
+		return ErrRelayEncrypted
+	}
+	if m.Overflow == OverflowSpill {
+		dir := m.SpillDir
+		if dir == "" && m.Filename != "" {
+			dir = m.Filename + ".spill"
+		}
+		spool, err := openSpool(dir)
+		if err != nil {
+			return err
+		}
+		m.spool = spool
+	}
+	if m.Filename == "" {
+		m.file = os.Stdout
+	} else {
+		f, err := os.OpenFile(m.Filename, os.O_RDWR|os.O_CREATE|os.O_APPEND, 0600)
+		if err != nil {
+			return err
+		}
+		m.file = f
+	}
+	buffer := m.Buffer
+	if buffer <= 0 {
+		buffer = 100
+	}
+	m.writer = make(chan Writable, buffer)
+	m.out = &output{name: m.Filename, file: m.file, hooks: m.Hooks, sinks: m.Sinks, logger: logger(m.Logger), onError: m.OnError}
+	if m.out.onError == nil {
+		m.out.onError = OnError
+	}
+	m.out.metrics, m.out.queued, m.out.opts = m.Metrics, m.Queued, m.Options
+	m.out.replaced = func(f *os.File) { m.file = f }
+	if m.out.opts == nil {
+		opts := DefaultOptions
+		m.out.opts = &opts
+	}
+	if m.out.metrics == nil {
+		m.out.metrics = Metrics
+	}
+	m.validators = m.Validators
+	if m.validators == nil {
+		m.validators = packageValidators()
+	}
+	m.stop, m.written, m.abandoned, m.closeErr = nil, 0, 0, nil
+	m.ctx, m.cancel = context.WithCancel(ctx)
+	m.wg.Add(1)
+	go m.loop()
+	return nil
+}
+
+// loop writes queued messages until the mailbox is closed
+func (m *Mailbox) loop() {
+	defer m.wg.Done()
+	for {
+		select {
+		case <-m.ctx.Done():
+			m.finish(nil)
+			return
+		case form := <-m.writer:
+			if m.ctx.Err() != nil {
+				m.finish(form)
+				return
+			}
+			m.out.deliver(form, m.recip)
+		case <-m.spool.wakeup():
+			m.spool.drain(m.ctx, m.out, m.recipient)
+		}
+	}
+}
+
+// finish writes pending (if not nil) and the queued messages,
+// until the Shutdown deadline, then closes the file
+func (m *Mailbox) finish(pending Writable) {
+	m.saving.Lock() // wait for Save calls in progress, new ones fail
+	m.saving.Unlock()
+	m.stopMu.Lock()
+	deadline := m.stop
+	m.stopMu.Unlock()
+	if deadline == nil {
+		deadline = context.Background()
+	}
+	m.written, m.abandoned = m.out.finish(deadline, pending, m.writer, m.spool, m.recipient)
+	if m.abandoned != 0 && deadline.Err() != nil {
+		m.closeErr = deadline.Err()
+	}
+	if m.file != os.Stdout {
+		if err := m.file.Close(); err != nil && m.closeErr == nil {
+			m.closeErr = err
+		}
+	}
+	m.out.logger.Info("mailbox closed", "mailbox", m.Filename, "written", m.written, "abandoned", m.abandoned)
+}
+
+func (m *Mailbox) recipient() (age.Recipient, error) {
+	return m.recip, nil
+}
+
+// Save checks the message (see Validators) and queues it for writing (see Overflow)
+func (m *Mailbox) Save(form Writable) error {
+	return m.SaveContext(context.Background(), form)
+}
+
+// SaveContext is Save, giving up when ctx is done while waiting for room
+// in the queue (see OverflowBlock), eg: with a timeout.
+func (m *Mailbox) SaveContext(ctx context.Context, form Writable) error {
+	if m.ctx == nil {
+		return ErrNotOpen
+	}
+	if err := validate(ctx, m.validators, form); err != nil {
+		return err
+	}
+	m.saving.RLock()
+	defer m.saving.RUnlock()
+	return m.out.enqueue(ctx, m.ctx, m.writer, m.Overflow, m.spool, form)
+}
+
+// Queued returns the number of messages waiting to be written
+func (m *Mailbox) Queued() int {
+	return len(m.writer)
+}
+
+// Close stops accepting messages, writes the queued messages,
+// then syncs and closes the mbox file (see Shutdown)
+func (m *Mailbox) Close() {
+	m.Shutdown(context.Background())
+}
+
+// Shutdown writes the queued messages until ctx is done, then closes the mbox file.
+// Messages left are abandoned (see OnError), the error is then ctx.Err().
+func (m *Mailbox) Shutdown(ctx context.Context) (written, abandoned int, err error) {
+	if m.cancel == nil {
+		return 0, 0, nil
+	}
+	if ctx == nil {
+		ctx = context.Background()
+	}
+	m.stopMu.Lock()
+	if m.stop == nil {
+		m.stop = ctx
+	}
+	m.stopMu.Unlock()
+	m.cancel()
+	m.wg.Wait()
+	return m.written, m.abandoned, m.closeErr
+}
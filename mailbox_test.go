@@ -0,0 +1,91 @@
+package mbox_test
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"filippo.io/age"
+	"github.com/aerth/mbox"
+)
+
+func TestMailbox(t *testing.T) {
+	dir := t.TempDir()
+	id, err := age.GenerateX25519Identity()
+	if err != nil {
+		t.Fatal(err)
+	}
+	plain := &mbox.Mailbox{Filename: filepath.Join(dir, "plain.mbox")}
+	secret := &mbox.Mailbox{Filename: filepath.Join(dir, "secret.mbox"), AgeRecipient: id.Recipient().String()}
+	for _, m := range []*mbox.Mailbox{plain, secret} {
+		if err := m.Open(nil); err != nil {
+			t.Fatal(err)
+		}
+		if err := m.Open(nil); err == nil {
+			t.Fatal("expected error opening mailbox twice")
+		}
+	}
+	if plain.Buffer != 0 {
+		t.Errorf("Open changed Buffer to %d", plain.Buffer)
+	}
+	for i := 0; i < 3; i++ {
+		plain.Save(&mbox.Form{From: "alice@localhost", Subject: "plain", Message: "hello"})
+	}
+	secret.Save(&mbox.Form{From: "alice@localhost", Subject: "secret", Message: "hello",
+		Headers: map[string]string{"x-phone": "555\r\nBcc: injected", "bad name": "skipped"}})
+	for _, m := range []*mbox.Mailbox{plain, secret} {
+		for m.Queued() != 0 {
+			time.Sleep(10 * time.Millisecond)
+		}
+		m.Close()
+	}
+	if err := plain.Save(&mbox.Form{Message: "closed"}); err == nil {
+		t.Error("expected error saving to a closed mailbox")
+	}
+
+	for name, want := range map[string]int{"plain.mbox": 3, "secret.mbox": 1} {
+		f, err := os.Open(filepath.Join(dir, name))
+		if err != nil {
+			t.Fatal(err)
+		}
+		entries, err := mbox.NewReader(f).ReadAll()
+		f.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(entries) != want {
+			t.Fatalf("%s: expected %d messages, got %d", name, want, len(entries))
+		}
+		if entries[0].Encrypted != (name == "secret.mbox") {
+			t.Fatalf("%s: unexpected encryption", name)
+		}
+	}
+
+	f, _ := os.Open(secret.Filename)
+	defer f.Close()
+	entry, _ := mbox.NewReader(f).Next()
+	dec, err := entry.Decrypt(id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	msg, err := dec.Mail()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := msg.Header.Get("X-Phone"); got != "555 Bcc: injected" {
+		t.Errorf("unexpected X-Phone header: %q", got)
+	}
+	if msg.Header.Get("Bcc") != "" || strings.Contains(string(dec.Raw), "bad name") {
+		t.Errorf("unexpected headers: %v", msg.Header)
+	}
+}
+
+func TestMailboxBadRecipient(t *testing.T) {
+	m := &mbox.Mailbox{Filename: filepath.Join(t.TempDir(), "x.mbox"), AgeRecipient: "age1invalid"}
+	if err := m.Open(nil); err == nil {
+		m.Close()
+		t.Fatal("expected error for invalid age recipient")
+	}
+}
@@ -48,20 +48,36 @@ import (
 	// input sanitization
 )
 
-// Form is a single email. No Attachments yet.
+// Form is a single email.
 type Form struct {
-	From     string    // may be empty "name <email>" format
-	Subject  string    // may be empty
-	Message  string    // the message string
-	Sent     time.Time // optional, when the message was sent
-	Received time.Time // optional, when the message was received (automatically set)
-	Body     []byte    // experimental: possible future use, attachments?
+	From        string            // may be empty "name <email>" format
+	Subject     string            // may be empty
+	Message     string            // the message string
+	Sent        time.Time         // optional, when the message was sent, the Date header (default the Headers Date, or Received)
+	Received    time.Time         // optional, when the message was received (automatically set)
+	Body        []byte            // experimental: possible future use, attachments?
+	MessageID   string            // optional, eg: <unique@localhost> (automatically set)
+	InReplyTo   string            // optional, the Message-ID this message replies to (the In-Reply-To header)
+	References  []string          // optional, the Message-IDs of the conversation, oldest first (see Threads)
+	HTML        string            // optional HTML version of Message, written as multipart/alternative
+	Attachments []Attachment      // optional, written as a MIME multipart message
+	Headers     map[string]string // optional extra headers, eg: X-Phone
+	Trace       []Trace           // optional, how the message arrived, most recent first (Received headers)
+	Flags       Flags             // optional, eg: FlagRead, the Status and X-Status headers (see SetFlags)
+}
+
+// Attachment is a file attached to a Form
+type Attachment struct {
+	Filename    string // file name shown to the reader
+	ContentType string // eg: image/png, default application/octet-stream
+	Data        []byte
 }
 
 var Version = "0.0.2-MIT"
 
-// ValidationLevel is the level of email validation during Loop() (see Normalize)
+// ValidationLevel is the level of email validation during Save, if Validators is nil
 // 0 = none, 1 = normalize, 2 = validate format, 3 = validate format and host
+// (see LevelValidators)
 var ValidationLevel = 1
 
 // Writable is an interface for writing to a file
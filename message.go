@@ -0,0 +1,205 @@
+package mbox
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"mime"
+	"mime/multipart"
+	"mime/quotedprintable"
+	"net/mail"
+	"net/textproto"
+	"strings"
+
+	"golang.org/x/text/encoding/htmlindex"
+)
+
+// ParseMessage reads a RFC 5322 message, eg: a .eml file, as a Form (see FormFromMail)
+func ParseMessage(r io.Reader) (*Form, error) {
+	br := bufio.NewReader(r)
+	if start, _ := br.Peek(len(fromPrefix)); bytes.Equal(start, fromPrefix) {
+		if _, err := br.ReadBytes('\n'); err != nil {
+			return nil, fmt.Errorf("parsing message: %w", err)
+		}
+	}
+	msg, err := mail.ReadMessage(br)
+	if err != nil {
+		return nil, fmt.Errorf("parsing message: %w", err)
+	}
+	return FormFromMail(msg)
+}
+
+// Form parses the raw entry as a Form (see FormFromMail)
+func (e *Entry) Form() (*Form, error) {
+	msg, err := e.Mail()
+	if err != nil {
+		return nil, err
+	}
+	return FormFromMail(msg)
+}
+
+// formHeaders are the headers kept in Form fields, or written by WriteTo
+// and writeMultipart, they are not copied to Form.Headers
+var formHeaders = map[string]bool{
+	"Return-Path":               true,
+	"Delivery-Date":             true,
+	"Received":                  true,
+	"Envelope-To":               true,
+	"From":                      true,
+	"Subject":                   true,
+	"Date":                      true,
+	"Message-Id":                true,
+	"In-Reply-To":               true,
+	"References":                true,
+	"Mime-Version":              true,
+	"Content-Type":              true,
+	"Content-Transfer-Encoding": true,
+	"Content-Disposition":       true,
+	"Status":                    true,
+	"X-Status":                  true,
+}
+
+// FormFromMail returns the message as a Form, reading its body: the first
+// text/plain and text/html parts are Message and HTML, other parts Attachments
+func FormFromMail(msg *mail.Message) (*Form, error) {
+	form := &Form{
+		From:       decodeWords(msg.Header.Get("From")),
+		Subject:    decodeWords(msg.Header.Get("Subject")),
+		MessageID:  strings.TrimSpace(msg.Header.Get("Message-Id")),
+		InReplyTo:  strings.Join(messageIDs(msg.Header.Get("In-Reply-To")), " "),
+		References: messageIDs(msg.Header.Get("References")),
+		Flags:      parseFlags(msg.Header.Get("Status"), msg.Header.Get("X-Status")),
+	}
+	if form.From == "" {
+		form.From = strings.TrimSuffix(strings.TrimPrefix(strings.TrimSpace(msg.Header.Get("Return-Path")), "<"), ">")
+	}
+	if sent, err := msg.Header.Date(); err == nil {
+		form.Sent = sent
+	}
+	if received, err := mail.ParseDate(msg.Header.Get("Delivery-Date")); err == nil {
+		form.Received = received
+	}
+	for _, received := range msg.Header["Received"] {
+		form.Trace = append(form.Trace, parseTrace(received))
+	}
+	for name, values := range msg.Header {
+		name = textproto.CanonicalMIMEHeaderKey(name)
+		if formHeaders[name] || len(values) == 0 {
+			continue
+		}
+		if form.Headers == nil {
+			form.Headers = map[string]string{}
+		}
+		form.Headers[name] = values[0]
+	}
+	if err := form.readPart(textproto.MIMEHeader(msg.Header), msg.Body); err != nil {
+		return form, fmt.Errorf("parsing message: %w", err)
+	}
+	return form, nil
+}
+
+// readPart adds a MIME part to the form, multipart bodies are walked recursively
+func (form *Form) readPart(h textproto.MIMEHeader, body io.Reader) error {
+	mediatype, params, err := mime.ParseMediaType(h.Get("Content-Type"))
+	if err != nil {
+		mediatype, params = "text/plain", map[string]string{}
+	}
+	if strings.HasPrefix(mediatype, "multipart/") && params["boundary"] != "" {
+		mr := multipart.NewReader(body, params["boundary"])
+		for {
+			p, err := mr.NextRawPart()
+			if err == io.EOF {
+				return nil
+			}
+			if err != nil {
+				return err
+			}
+			if err := form.readPart(p.Header, p); err != nil {
+				return err
+			}
+		}
+	}
+	data, err := io.ReadAll(transferDecoder(h.Get("Content-Transfer-Encoding"), body))
+	if err != nil {
+		return err
+	}
+	filename := params["name"]
+	disposition, dparams, err := mime.ParseMediaType(h.Get("Content-Disposition"))
+	if err == nil && dparams["filename"] != "" {
+		filename = dparams["filename"]
+	}
+	inline := disposition != "attachment" && filename == ""
+	switch {
+	case inline && mediatype == "text/plain" && form.Message == "":
+		form.Message = decodeText(data, params["charset"])
+		return nil
+	case inline && mediatype == "text/html" && form.HTML == "":
+		form.HTML = decodeText(data, params["charset"])
+		return nil
+	}
+	delete(params, "name")
+	form.Attachments = append(form.Attachments, Attachment{
+		Filename:    decodeWords(filename),
+		ContentType: mime.FormatMediaType(mediatype, params),
+		Data:        data,
+	})
+	return nil
+}
+
+// transferDecoder decodes a Content-Transfer-Encoding
+func transferDecoder(encoding string, r io.Reader) io.Reader {
+	switch strings.ToLower(strings.TrimSpace(encoding)) {
+	case "base64":
+		return base64.NewDecoder(base64.StdEncoding, r) // ignores line breaks
+	case "quoted-printable":
+		return quotedprintable.NewReader(r)
+	}
+	return r
+}
+
+// CharsetReader returns a reader converting from charset (eg: windows-1252) to UTF-8
+func CharsetReader(charset string, input io.Reader) (io.Reader, error) {
+	switch strings.ToLower(strings.TrimSpace(charset)) {
+	case "", "utf-8", "utf8", "us-ascii", "ascii":
+		return input, nil
+	}
+	enc, err := htmlindex.Get(charset)
+	if err != nil {
+		return nil, fmt.Errorf("unknown charset %q", charset)
+	}
+	return enc.NewDecoder().Reader(input), nil
+}
+
+// decodeText returns text in charset as UTF-8 with LF line endings.
+// Text in an unknown charset is returned as is.
+func decodeText(data []byte, charset string) string {
+	if r, err := CharsetReader(charset, bytes.NewReader(data)); err == nil {
+		if decoded, err := io.ReadAll(r); err == nil {
+			data = decoded
+		}
+	}
+	return strings.ReplaceAll(string(data), "\r\n", "\n")
+}
+
+var wordDecoder = &mime.WordDecoder{CharsetReader: CharsetReader}
+
+// decodeWords decodes RFC 2047 encoded words, eg: =?utf-8?q?hello?=
+func decodeWords(s string) string {
+	if dec, err := wordDecoder.DecodeHeader(s); err == nil {
+		return strings.TrimSpace(dec)
+	}
+	return strings.TrimSpace(s)
+}
+
+// ToMail returns the message as WriteTo would write it, without the mbox
+// "From " line and delivery headers
+func (form *Form) ToMail() (*mail.Message, error) {
+	f := *form
+	var b bytes.Buffer
+	if _, err := writeForm(&b, &f, unquotedOptions()); err != nil {
+		return nil, err
+	}
+	return mail.ReadMessage(bytes.NewReader(relayMessage(b.Bytes())))
+}
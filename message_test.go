@@ -0,0 +1,193 @@
+package mbox_test
+
+import (
+	"bytes"
+	"io"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/aerth/mbox"
+)
+
+func TestParseMessageRoundTrip(t *testing.T) {
+	png := []byte("\x89PNG\r\n\x1a\n" + string(bytes.Repeat([]byte{0, 1, 2, 3}, 100)))
+	form := mbox.Form{
+		From:     "Alice <alice@localhost>",
+		Subject:  "screenshot",
+		Message:  "see attached\n\nthanks",
+		HTML:     "<p>see attached</p>",
+		Received: time.Date(2024, 5, 1, 12, 30, 0, 0, time.UTC),
+		Headers:  map[string]string{"X-Order": "A-42", "Content-Type": "text/html"},
+		Attachments: []mbox.Attachment{
+			{Filename: "screen shot.png", ContentType: "image/png", Data: png},
+		},
+	}
+	buf := new(bytes.Buffer)
+	if _, err := form.WriteTo(buf); err != nil {
+		t.Fatal(err)
+	}
+	got, err := mbox.ParseMessage(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.From != form.From || got.Subject != form.Subject || got.MessageID != form.MessageID {
+		t.Errorf("unexpected header fields: %q %q %q", got.From, got.Subject, got.MessageID)
+	}
+	if strings.TrimSpace(got.Message) != form.Message || strings.TrimSpace(got.HTML) != form.HTML {
+		t.Errorf("unexpected text: %q %q", got.Message, got.HTML)
+	}
+	if !got.Received.Equal(form.Received) || !got.Sent.Equal(form.Received) {
+		t.Errorf("unexpected times: sent %v, received %v", got.Sent, got.Received)
+	}
+	if want := map[string]string{"X-Order": "A-42"}; !reflect.DeepEqual(got.Headers, want) {
+		t.Errorf("unexpected headers: %v", got.Headers)
+	}
+	if len(got.Attachments) != 1 {
+		t.Fatalf("expected 1 attachment, got %d", len(got.Attachments))
+	}
+	a := got.Attachments[0]
+	if a.Filename != "screen shot.png" || a.ContentType != "image/png" || !bytes.Equal(a.Data, png) {
+		t.Errorf("unexpected attachment: %q %q %d bytes", a.Filename, a.ContentType, len(a.Data))
+	}
+}
+
+const encodedMessage = "From: =?iso-8859-1?q?J=F6rg?= <jorg@example.com>\r\n" +
+	"To: Bob <bob@example.com>\r\n" +
+	"Subject: =?utf-8?b?w6l0w6k=?=\r\n" +
+	"Date: Wed, 1 May 2024 14:30:00 +0200\r\n" +
+	"Message-ID: <1@example.com>\r\n" +
+	"MIME-Version: 1.0\r\n" +
+	"Content-Type: multipart/mixed; boundary=outer\r\n" +
+	"\r\n" +
+	"--outer\r\n" +
+	"Content-Type: multipart/alternative; boundary=inner\r\n" +
+	"\r\n" +
+	"--inner\r\n" +
+	"Content-Type: text/plain; charset=windows-1252\r\n" +
+	"Content-Transfer-Encoding: quoted-printable\r\n" +
+	"\r\n" +
+	"Caf=E9 at 10=80, a long line that is =\r\n" +
+	"soft broken\r\n" +
+	"--inner\r\n" +
+	"Content-Type: text/html; charset=utf-8\r\n" +
+	"Content-Transfer-Encoding: base64\r\n" +
+	"\r\n" +
+	"PHA+Q2Fmw6k8L3A+\r\n" +
+	"--inner--\r\n" +
+	"--outer\r\n" +
+	"Content-Type: text/plain; charset=utf-8\r\n" +
+	"Content-Disposition: attachment; filename=\"=?utf-8?q?r=C3=A9sum=C3=A9.txt?=\"\r\n" +
+	"\r\n" +
+	"notes\r\n" +
+	"--outer\r\n" +
+	"Content-Type: message/rfc822\r\n" +
+	"\r\n" +
+	"Subject: forwarded\r\n" +
+	"\r\n" +
+	"hi\r\n" +
+	"--outer--\r\n"
+
+func TestParseMessageDecoding(t *testing.T) {
+	form, err := mbox.ParseMessage(strings.NewReader(encodedMessage))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if form.From != "Jörg <jorg@example.com>" || form.Subject != "été" || form.MessageID != "<1@example.com>" {
+		t.Errorf("unexpected header fields: %q %q %q", form.From, form.Subject, form.MessageID)
+	}
+	if want := time.Date(2024, 5, 1, 12, 30, 0, 0, time.UTC); !form.Sent.Equal(want) {
+		t.Errorf("expected sent %v, got %v", want, form.Sent)
+	}
+	if form.Headers["To"] != "Bob <bob@example.com>" {
+		t.Errorf("unexpected headers: %v", form.Headers)
+	}
+	if want := "Café at 10€, a long line that is soft broken"; form.Message != want {
+		t.Errorf("unexpected message %q, want %q", form.Message, want)
+	}
+	if form.HTML != "<p>Café</p>" {
+		t.Errorf("unexpected html %q", form.HTML)
+	}
+	if len(form.Attachments) != 2 {
+		t.Fatalf("expected 2 attachments, got %d", len(form.Attachments))
+	}
+	for i, want := range []mbox.Attachment{
+		{Filename: "résumé.txt", ContentType: "text/plain; charset=utf-8", Data: []byte("notes")},
+		{ContentType: "message/rfc822", Data: []byte("Subject: forwarded\r\n\r\nhi")},
+	} {
+		if !reflect.DeepEqual(form.Attachments[i], want) {
+			t.Errorf("attachment %d: got %+v, want %+v", i, form.Attachments[i], want)
+		}
+	}
+}
+
+func TestFormToMail(t *testing.T) {
+	form := mbox.Form{From: "alice@localhost", Subject: "hello", Message: "world"}
+	msg, err := form.ToMail()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if form.MessageID != "" || !form.Received.IsZero() {
+		t.Error("ToMail modified the form")
+	}
+	if msg.Header.Get("Return-Path") != "" || msg.Header.Get("Delivery-Date") != "" {
+		t.Errorf("unexpected delivery headers: %v", msg.Header)
+	}
+	body, _ := io.ReadAll(msg.Body)
+	if msg.Header.Get("From") != "alice@localhost" || string(body) != "world\n" {
+		t.Errorf("unexpected message: %v %q", msg.Header, body)
+	}
+	msg, _ = form.ToMail()
+	back, err := mbox.FormFromMail(msg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if back.From != form.From || back.Subject != form.Subject || back.Message != "world\n" {
+		t.Errorf("unexpected form: %+v", back)
+	}
+	if _, err := new(mbox.Form).ToMail(); err != mbox.ErrEmptyMessage {
+		t.Errorf("expected ErrEmptyMessage, got %v", err)
+	}
+}
+
+// decoded header values with line breaks can not add header lines or
+// begin a new message in the mbox file
+func TestParseMessageInjection(t *testing.T) {
+	raw := "From: =?utf-8?q?Alice=0AX-Injected:_yes?= <alice@localhost>\r\n" +
+		"Subject: =?utf-8?q?hi=0A=0AFrom_evil@x_Mon_Jan__1_00:00:00_2024=0ASubject:_fake?=\r\n" +
+		"Message-ID: <1@localhost>\r\n" +
+		"\r\n" +
+		"hello\r\n"
+	form, err := mbox.ParseMessage(strings.NewReader(raw))
+	if err != nil {
+		t.Fatal(err)
+	}
+	form.MessageID += "\nX-Injected: yes"
+	form.Trace = []mbox.Trace{{Text: "from evil\r\n\r\nFrom evil@x Mon Jan  1 00:00:00 2024"}}
+	var buf bytes.Buffer
+	if _, err := form.WriteTo(&buf); err != nil {
+		t.Fatal(err)
+	}
+	entries, err := mbox.NewReader(bytes.NewReader(buf.Bytes())).ReadAll()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 1 {
+		t.Fatalf("expected 1 entry, got %d:\n%s", len(entries), buf.Bytes())
+	}
+	msg, err := entries[0].Mail()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(msg.Header["Subject"]) != 1 || msg.Header.Get("X-Injected") != "" {
+		t.Errorf("header injected:\n%s", buf.Bytes())
+	}
+	if got := msg.Header.Get("Subject"); got != "hi  From evil@x Mon Jan  1 00:00:00 2024 Subject: fake" {
+		t.Errorf("Subject: %q", got)
+	}
+	body, _ := io.ReadAll(msg.Body)
+	if strings.TrimSpace(string(body)) != "hello" {
+		t.Errorf("body: %q", body)
+	}
+}
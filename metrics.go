@@ -0,0 +1,275 @@
+package mbox
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// Recorder receives measurements from the writer goroutine and Save,
+// eg: a Registry. Calls must return quickly.
+type Recorder interface {
+	// Queued is called after Save queues a message, with the number of
+	// queued messages and the queue size
+	Queued(mailbox string, queued, size int)
+	// Written is called after a message is written
+	Written(s Saved, queued int)
+	// Failed is called when a message can not be written
+	Failed(mailbox string, encrypted bool, queued int)
+	// Overflow is called when Save finds the queue full
+	Overflow(mailbox string, policy Overflow)
+}
+
+// Metrics, if set, receives measurements of Save and Loop (see Recorder).
+// Set before calling Open function.
+var Metrics Recorder
+
+// DurationBuckets are the default histogram buckets, in seconds
+var DurationBuckets = []float64{.0005, .001, .0025, .005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10}
+
+// Registry is a Recorder serving these metrics in the Prometheus text format:
+//
+//	mbox_messages_queued_total{mailbox}             messages queued by Save
+//	mbox_queue_length{mailbox}                      messages waiting to be written
+//	mbox_queue_size{mailbox}                        queue capacity
+//	mbox_messages_written_total{mailbox,encrypted}  messages written
+//	mbox_bytes_written_total{mailbox,encrypted}     bytes written
+//	mbox_write_duration_seconds{mailbox,encrypted}  time to write (and encrypt) a message
+//	mbox_write_errors_total{mailbox,encrypted}      messages that could not be written
+//	mbox_queue_overflows_total{mailbox,policy}      messages finding the queue full
+//
+// Programs add their own with Describe, Add, Set and Observe.
+type Registry struct {
+	mu       sync.Mutex
+	families map[string]*family
+}
+
+type family struct {
+	name, typ, help string
+	buckets         []float64
+	series          map[string]*series // by formatted labels
+}
+
+type series struct {
+	labels string // formatted, eg: {mailbox="my.mbox"}
+	value  float64
+	counts []uint64 // histogram bucket counts, not cumulative
+	sum    float64
+	count  uint64
+}
+
+var _ Recorder = (*Registry)(nil)
+
+// NewRegistry returns a Registry with the mbox metrics described
+func NewRegistry() *Registry {
+	r := &Registry{families: map[string]*family{}}
+	r.Describe("mbox_messages_queued_total", "counter", "Messages queued for writing.")
+	r.Describe("mbox_queue_length", "gauge", "Messages waiting to be written.")
+	r.Describe("mbox_queue_size", "gauge", "Maximum number of messages waiting to be written.")
+	r.Describe("mbox_messages_written_total", "counter", "Messages written to the mbox file.")
+	r.Describe("mbox_bytes_written_total", "counter", "Bytes written to the mbox file.")
+	r.Describe("mbox_write_duration_seconds", "histogram", "Time to write and encrypt a message.")
+	r.Describe("mbox_write_errors_total", "counter", "Messages that could not be written.")
+	r.Describe("mbox_queue_overflows_total", "counter", "Messages finding the queue full, by overflow policy.")
+	return r
+}
+
+// Describe sets the type (counter, gauge or histogram) and help text of a metric.
+// Histograms use DurationBuckets, unless buckets are given.
+func (r *Registry) Describe(name, typ, help string, buckets ...float64) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	f := r.family(name, typ)
+	if len(buckets) != 0 || f.typ != typ {
+		f.series = map[string]*series{} // bucket counts no longer match
+	}
+	if len(buckets) != 0 {
+		f.buckets = buckets
+	}
+	f.typ, f.help = typ, help
+}
+
+// family returns the metric family, creating it if needed. r.mu is held.
+func (r *Registry) family(name, typ string) *family {
+	if r.families == nil {
+		r.families = map[string]*family{}
+	}
+	f := r.families[name]
+	if f == nil {
+		f = &family{name: name, typ: typ, buckets: DurationBuckets, series: map[string]*series{}}
+		r.families[name] = f
+	}
+	return f
+}
+
+// get returns the series with the given label pairs. r.mu is held.
+func (r *Registry) get(name, typ string, labels []string) *series {
+	f := r.family(name, typ)
+	key := formatLabels(labels)
+	s := f.series[key]
+	if s == nil {
+		s = &series{labels: key}
+		if f.typ == "histogram" {
+			s.counts = make([]uint64, len(f.buckets))
+		}
+		f.series[key] = s
+	}
+	return s
+}
+
+// Add adds v to a counter, labels are name and value pairs
+func (r *Registry) Add(name string, v float64, labels ...string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.get(name, "counter", labels).value += v
+}
+
+// Set sets a gauge, labels are name and value pairs
+func (r *Registry) Set(name string, v float64, labels ...string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.get(name, "gauge", labels).value = v
+}
+
+// Observe adds v to a histogram, labels are name and value pairs.
+// Metrics described or used as a counter or gauge are left unchanged.
+func (r *Registry) Observe(name string, v float64, labels ...string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	f := r.family(name, "histogram")
+	if f.typ != "histogram" {
+		return
+	}
+	s := r.get(name, "histogram", labels)
+	for i, le := range f.buckets {
+		if v <= le {
+			s.counts[i]++
+			break
+		}
+	}
+	s.sum += v
+	s.count++
+}
+
+// Queued implements Recorder
+func (r *Registry) Queued(mailbox string, queued, size int) {
+	r.Add("mbox_messages_queued_total", 1, "mailbox", mailbox)
+	r.Set("mbox_queue_length", float64(queued), "mailbox", mailbox)
+	r.Set("mbox_queue_size", float64(size), "mailbox", mailbox)
+}
+
+// Written implements Recorder
+func (r *Registry) Written(s Saved, queued int) {
+	encrypted := strconv.FormatBool(s.Encrypted)
+	r.Add("mbox_messages_written_total", 1, "mailbox", s.Mailbox, "encrypted", encrypted)
+	r.Add("mbox_bytes_written_total", float64(s.Size), "mailbox", s.Mailbox, "encrypted", encrypted)
+	r.Observe("mbox_write_duration_seconds", s.Duration.Seconds(), "mailbox", s.Mailbox, "encrypted", encrypted)
+	r.Set("mbox_queue_length", float64(queued), "mailbox", s.Mailbox)
+}
+
+// Failed implements Recorder
+func (r *Registry) Failed(mailbox string, encrypted bool, queued int) {
+	r.Add("mbox_write_errors_total", 1, "mailbox", mailbox, "encrypted", strconv.FormatBool(encrypted))
+	r.Set("mbox_queue_length", float64(queued), "mailbox", mailbox)
+}
+
+// Overflow implements Recorder
+func (r *Registry) Overflow(mailbox string, policy Overflow) {
+	r.Add("mbox_queue_overflows_total", 1, "mailbox", mailbox, "policy", policy.String())
+}
+
+// WriteTo writes the metrics in the Prometheus text exposition format
+func (r *Registry) WriteTo(w io.Writer) (int64, error) {
+	var b bytes.Buffer
+	r.mu.Lock()
+	names := make([]string, 0, len(r.families))
+	for name := range r.families {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		f := r.families[name]
+		if len(f.series) == 0 {
+			continue
+		}
+		if f.help != "" {
+			fmt.Fprintf(&b, "# HELP %s %s\n", name, strings.ReplaceAll(f.help, "\n", " "))
+		}
+		fmt.Fprintf(&b, "# TYPE %s %s\n", name, f.typ)
+		keys := make([]string, 0, len(f.series))
+		for key := range f.series {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+		for _, key := range keys {
+			s := f.series[key]
+			if f.typ != "histogram" {
+				fmt.Fprintf(&b, "%s%s %s\n", name, s.labels, formatValue(s.value))
+				continue
+			}
+			var cumulative uint64
+			for i, le := range f.buckets {
+				cumulative += s.counts[i]
+				fmt.Fprintf(&b, "%s_bucket%s %d\n", name, withLabel(s.labels, "le", formatValue(le)), cumulative)
+			}
+			fmt.Fprintf(&b, "%s_bucket%s %d\n", name, withLabel(s.labels, "le", "+Inf"), s.count)
+			fmt.Fprintf(&b, "%s_sum%s %s\n", name, s.labels, formatValue(s.sum))
+			fmt.Fprintf(&b, "%s_count%s %d\n", name, s.labels, s.count)
+		}
+	}
+	r.mu.Unlock()
+	return b.WriteTo(w)
+}
+
+// ServeHTTP serves the metrics, eg: at /metrics
+func (r *Registry) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	r.WriteTo(w)
+}
+
+// formatLabels formats name and value pairs, eg: {mailbox="my.mbox"}
+func formatLabels(labels []string) string {
+	if len(labels) < 2 {
+		return ""
+	}
+	var b strings.Builder
+	b.WriteByte('{')
+	for i := 0; i+1 < len(labels); i += 2 {
+		if i > 0 {
+			b.WriteByte(',')
+		}
+		b.WriteString(labels[i] + `="` + escapeLabel(labels[i+1]) + `"`)
+	}
+	b.WriteByte('}')
+	return b.String()
+}
+
+// withLabel adds a label to formatted labels
+func withLabel(labels, name, value string) string {
+	if labels == "" {
+		return "{" + name + `="` + value + `"}`
+	}
+	return labels[:len(labels)-1] + "," + name + `="` + value + `"}`
+}
+
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+func escapeLabel(s string) string {
+	return labelEscaper.Replace(s)
+}
+
+func formatValue(v float64) string {
+	switch {
+	case math.IsInf(v, 1):
+		return "+Inf"
+	case math.IsInf(v, -1):
+		return "-Inf"
+	}
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
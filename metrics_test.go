@@ -0,0 +1,114 @@
+package mbox_test
+
+import (
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/aerth/mbox"
+)
+
+func TestRegistry(t *testing.T) {
+	reg := mbox.NewRegistry()
+	m := &mbox.Mailbox{Filename: filepath.Join(t.TempDir(), "metrics.mbox"), Buffer: 10, Metrics: reg}
+	if err := m.Open(nil); err != nil {
+		t.Fatal(err)
+	}
+	m.Save(&mbox.Form{From: "alice@localhost", Message: "one"})
+	m.Save(&mbox.Form{From: "alice@localhost", Message: "two"})
+	m.Save(&failingWritable{})
+	for m.Queued() != 0 {
+		time.Sleep(10 * time.Millisecond)
+	}
+	time.Sleep(20 * time.Millisecond) // the last message is written after it leaves the queue
+	m.Close()
+
+	rec := httptest.NewRecorder()
+	reg.ServeHTTP(rec, httptest.NewRequest("GET", "/metrics", nil))
+	if ct := rec.Header().Get("Content-Type"); !strings.HasPrefix(ct, "text/plain; version=0.0.4") {
+		t.Errorf("unexpected content type %q", ct)
+	}
+	out := rec.Body.String()
+	label := `mailbox="` + m.Filename + `"`
+	for _, want := range []string{
+		"# TYPE mbox_messages_queued_total counter\n",
+		"mbox_messages_queued_total{" + label + "} 3\n",
+		"mbox_queue_size{" + label + "} 10\n",
+		"mbox_queue_length{" + label + "} 0\n",
+		"mbox_messages_written_total{" + label + `,encrypted="false"} 2` + "\n",
+		"mbox_write_errors_total{" + label + `,encrypted="false"} 1` + "\n",
+		"# TYPE mbox_write_duration_seconds histogram\n",
+		"mbox_write_duration_seconds_bucket{" + label + `,encrypted="false",le="+Inf"} 2` + "\n",
+		"mbox_write_duration_seconds_count{" + label + `,encrypted="false"} 2` + "\n",
+	} {
+		if !strings.Contains(out, want) {
+			t.Errorf("expected %q in:\n%s", want, out)
+		}
+	}
+	if strings.Contains(out, "mbox_bytes_written_total{"+label+`,encrypted="false"} 0`) {
+		t.Errorf("expected bytes written:\n%s", out)
+	}
+}
+
+func TestRegistryCustom(t *testing.T) {
+	reg := new(mbox.Registry)
+	reg.Describe("requests_total", "counter", "Requests.")
+	reg.Add("requests_total", 1, "path", `/a"b\c`)
+	reg.Add("requests_total", 2, "path", `/a"b\c`)
+	reg.Set("up", 1)
+	reg.Describe("latency_seconds", "histogram", "Latency.", 0.1, 1)
+	reg.Observe("latency_seconds", 0.05)
+	reg.Observe("latency_seconds", 0.5)
+	reg.Observe("latency_seconds", 5)
+	var b strings.Builder
+	reg.WriteTo(&b)
+	want := `# HELP latency_seconds Latency.
+# TYPE latency_seconds histogram
+latency_seconds_bucket{le="0.1"} 1
+latency_seconds_bucket{le="1"} 2
+latency_seconds_bucket{le="+Inf"} 3
+latency_seconds_sum 5.55
+latency_seconds_count 3
+# HELP requests_total Requests.
+# TYPE requests_total counter
+requests_total{path="/a\"b\\c"} 3
+# TYPE up gauge
+up 1
+`
+	if b.String() != want {
+		t.Errorf("unexpected output:\n%s\nwant:\n%s", b.String(), want)
+	}
+}
+
+// Observe of a counter or gauge is ignored, a metric described again as a
+// histogram starts over
+func TestRegistryObserveType(t *testing.T) {
+	reg := new(mbox.Registry)
+	reg.Describe("requests_total", "counter", "Requests.")
+	reg.Add("requests_total", 1)
+	reg.Observe("requests_total", 0.5)
+	reg.Set("up", 1)
+	reg.Observe("up", 0.5)
+	reg.Add("converted", 1)
+	reg.Describe("converted", "histogram", "Converted.", 1)
+	reg.Observe("converted", 0.5)
+	var b strings.Builder
+	reg.WriteTo(&b)
+	want := `# HELP converted Converted.
+# TYPE converted histogram
+converted_bucket{le="1"} 1
+converted_bucket{le="+Inf"} 1
+converted_sum 0.5
+converted_count 1
+# HELP requests_total Requests.
+# TYPE requests_total counter
+requests_total 1
+# TYPE up gauge
+up 1
+`
+	if b.String() != want {
+		t.Errorf("unexpected output:\n%s\nwant:\n%s", b.String(), want)
+	}
+}
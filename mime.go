@@ -0,0 +1,227 @@
+package mbox
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/hex"
+	"io"
+	"mime"
+)
+
+// countWriter counts bytes written to w
+type countWriter struct {
+	w io.Writer
+	n int64
+}
+
+func (c *countWriter) Write(p []byte) (int, error) {
+	n, err := c.w.Write(p)
+	c.n += int64(n)
+	return n, err
+}
+
+// newBoundary returns a random MIME multipart boundary
+func newBoundary() (string, error) {
+	b := make([]byte, 15)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return "mbox-" + hex.EncodeToString(b), nil
+}
+
+// attachmentType returns a valid content type for an attachment
+func attachmentType(contenttype string) (string, map[string]string) {
+	mediatype, params, err := mime.ParseMediaType(contenttype)
+	if err != nil || contenttype == "" {
+		return "application/octet-stream", map[string]string{}
+	}
+	return mediatype, params
+}
+
+// content is the body of a message being written: the Form text, HTML and
+// attachments, followed by the readers of a StreamForm
+type content struct {
+	form     *Form
+	text     string             // the trimmed Form Message
+	reader   io.Reader          // optional, text written after the Form Message and Body
+	streams  []StreamAttachment // optional, attached after the Form Attachments
+	boundary func() (string, error)
+}
+
+// multipart reports whether the body is written as a MIME multipart message
+func (c *content) multipart() bool {
+	return len(c.form.Attachments) != 0 || len(c.streams) != 0 || c.form.HTML != ""
+}
+
+// writeMultipart writes the MIME headers and a multipart body: the text,
+// its HTML alternative and the attachments
+func (c *content) writeMultipart(w io.Writer) (int64, error) {
+	cw := &countWriter{w: w}
+	if _, err := io.WriteString(cw, "MIME-Version: 1.0\n"); err != nil {
+		return cw.n, err
+	}
+	if len(c.form.Attachments) == 0 && len(c.streams) == 0 {
+		err := c.writeAlternative(cw)
+		return cw.n, err
+	}
+	boundary, err := c.boundary()
+	if err != nil {
+		return cw.n, err
+	}
+	if _, err := io.WriteString(cw, "Content-Type: "+mime.FormatMediaType("multipart/mixed", map[string]string{"boundary": boundary})+"\n"+
+		"\nThis is a multi-part message in MIME format.\n"+
+		"\n--"+boundary+"\n"); err != nil {
+		return cw.n, err
+	}
+
+	// message text
+	if c.form.HTML != "" {
+		err = c.writeAlternative(cw)
+	} else {
+		err = c.writeText(cw)
+	}
+	if err != nil {
+		return cw.n, err
+	}
+
+	for _, a := range c.form.Attachments {
+		if err := writeAttachment(cw, boundary, a.Filename, a.ContentType, bytes.NewReader(a.Data)); err != nil {
+			return cw.n, err
+		}
+	}
+	for _, a := range c.streams {
+		if err := writeAttachment(cw, boundary, a.Filename, a.ContentType, a.Data); err != nil {
+			return cw.n, err
+		}
+	}
+	_, err = io.WriteString(cw, "\n--"+boundary+"--\n")
+	return cw.n, err
+}
+
+// writeAttachment writes an attachment part, base64 encoding data as it is read
+func writeAttachment(w io.Writer, boundary, filename, contenttype string, data io.Reader) error {
+	mediatype, params := attachmentType(contenttype)
+	disposition := map[string]string{}
+	if filename != "" {
+		params["name"] = filename
+		disposition["filename"] = filename
+	}
+	if _, err := io.WriteString(w, "\n--"+boundary+"\n"+
+		"Content-Type: "+mime.FormatMediaType(mediatype, params)+"\n"+
+		"Content-Disposition: "+mime.FormatMediaType("attachment", disposition)+"\n"+
+		"Content-Transfer-Encoding: base64\n\n"); err != nil {
+		return err
+	}
+	lw := &lineWriter{w: w, max: 76}
+	encoder := base64.NewEncoder(base64.StdEncoding, lw)
+	if data != nil {
+		if _, err := io.Copy(encoder, data); err != nil {
+			return err
+		}
+	}
+	if err := encoder.Close(); err != nil {
+		return err
+	}
+	_, err := io.WriteString(w, "\n")
+	return err
+}
+
+// lineWriter breaks the text written to w into lines of max bytes, eg: base64
+type lineWriter struct {
+	w   io.Writer
+	max int
+	col int // bytes written on the current line
+}
+
+func (l *lineWriter) Write(p []byte) (int, error) {
+	written := 0
+	for len(p) != 0 {
+		if l.col == l.max {
+			if _, err := io.WriteString(l.w, "\n"); err != nil {
+				return written, err
+			}
+			l.col = 0
+		}
+		n := min(l.max-l.col, len(p))
+		if _, err := l.w.Write(p[:n]); err != nil {
+			return written, err
+		}
+		l.col += n
+		written += n
+		p = p[n:]
+	}
+	return written, nil
+}
+
+// writeText writes the text/plain part headers and body
+func (c *content) writeText(w io.Writer) error {
+	if _, err := io.WriteString(w, "Content-Type: text/plain; charset=utf-8\n"+
+		"Content-Transfer-Encoding: 8bit\n\n"); err != nil {
+		return err
+	}
+	return c.writePlain(w)
+}
+
+// writePlain writes the message text: the Form Message, its Body and the
+// StreamForm Text, ending with a line break
+func (c *content) writePlain(w io.Writer) error {
+	if c.text != "" {
+		if _, err := io.WriteString(w, c.text+"\n"); err != nil {
+			return err
+		}
+	}
+	if _, err := w.Write(c.form.Body); err != nil {
+		return err
+	}
+	if c.reader == nil {
+		return nil
+	}
+	lw := &lastWriter{w: w}
+	if _, err := io.Copy(lw, c.reader); err != nil {
+		return err
+	}
+	if lw.n != 0 && lw.last != '\n' {
+		_, err := io.WriteString(w, "\n")
+		return err
+	}
+	return nil
+}
+
+// lastWriter remembers the last byte written to w
+type lastWriter struct {
+	w    io.Writer
+	n    int64
+	last byte
+}
+
+func (l *lastWriter) Write(p []byte) (int, error) {
+	n, err := l.w.Write(p)
+	if n != 0 {
+		l.last = p[n-1]
+		l.n += int64(n)
+	}
+	return n, err
+}
+
+// writeAlternative writes a multipart/alternative part with the message text
+// and its HTML version
+func (c *content) writeAlternative(w io.Writer) error {
+	boundary, err := c.boundary()
+	if err != nil {
+		return err
+	}
+	if _, err := io.WriteString(w, "Content-Type: "+mime.FormatMediaType("multipart/alternative", map[string]string{"boundary": boundary})+"\n"+
+		"\n--"+boundary+"\n"); err != nil {
+		return err
+	}
+	if err := c.writeText(w); err != nil {
+		return err
+	}
+	_, err = io.WriteString(w, "\n--"+boundary+"\n"+
+		"Content-Type: text/html; charset=utf-8\n"+
+		"Content-Transfer-Encoding: 8bit\n\n"+
+		c.form.HTML+"\n"+
+		"\n--"+boundary+"--\n")
+	return err
+}
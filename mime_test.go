@@ -0,0 +1,214 @@
+package mbox_test
+
+import (
+	"bytes"
+	"encoding/base64"
+	"io"
+	"mime"
+	"mime/multipart"
+	"strings"
+	"testing"
+
+	"github.com/aerth/mbox"
+)
+
+func TestAttachments(t *testing.T) {
+	png := []byte("\x89PNG\r\n\x1a\n" + string(bytes.Repeat([]byte{0, 1, 2, 3}, 100)))
+	form := mbox.Form{
+		From:    "Alice <alice@localhost>",
+		Subject: "screenshot",
+		Message: "see attached",
+		Attachments: []mbox.Attachment{
+			{Filename: "screen shot.png", ContentType: "image/png", Data: png},
+			{Filename: "notes.txt", Data: []byte("plain notes\n")},
+		},
+	}
+	buf := new(bytes.Buffer)
+	n, err := form.WriteTo(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != int64(buf.Len()) {
+		t.Errorf("WriteTo returned %d, wrote %d bytes", n, buf.Len())
+	}
+	entry, err := mbox.NewReader(buf).Next()
+	if err != nil {
+		t.Fatal(err)
+	}
+	msg, err := entry.Mail()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if msg.Header.Get("Subject") != "screenshot" || msg.Header.Get("MIME-Version") != "1.0" {
+		t.Fatalf("unexpected header: %v", msg.Header)
+	}
+	mediatype, params, err := mime.ParseMediaType(msg.Header.Get("Content-Type"))
+	if err != nil || mediatype != "multipart/mixed" {
+		t.Fatalf("unexpected content type: %q %v", mediatype, err)
+	}
+	mr := multipart.NewReader(msg.Body, params["boundary"])
+	var parts []*multipart.Part
+	var bodies [][]byte
+	for {
+		p, err := mr.NextRawPart()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		body, _ := io.ReadAll(p)
+		parts = append(parts, p)
+		bodies = append(bodies, body)
+	}
+	if len(parts) != 3 {
+		t.Fatalf("expected 3 parts, got %d", len(parts))
+	}
+	if string(bytes.TrimSpace(bodies[0])) != "see attached" {
+		t.Errorf("unexpected text part: %q", bodies[0])
+	}
+	for i, want := range []struct {
+		filename, contenttype string
+		data                  []byte
+	}{
+		{"screen shot.png", "image/png", png},
+		{"notes.txt", "application/octet-stream", []byte("plain notes\n")},
+	} {
+		p := parts[i+1]
+		if p.FileName() != want.filename {
+			t.Errorf("part %d: expected filename %q, got %q", i+1, want.filename, p.FileName())
+		}
+		if ct, _, _ := mime.ParseMediaType(p.Header.Get("Content-Type")); ct != want.contenttype {
+			t.Errorf("part %d: expected content type %q, got %q", i+1, want.contenttype, ct)
+		}
+		data, err := base64.StdEncoding.DecodeString(string(bodies[i+1]))
+		if err != nil {
+			t.Fatalf("part %d: %v", i+1, err)
+		}
+		if !bytes.Equal(data, want.data) {
+			t.Errorf("part %d: attachment data differs", i+1)
+		}
+	}
+}
+
+// the destination headers must not end the message header
+func TestDestinationHeader(t *testing.T) {
+	mbox.Destination = "me@localhost"
+	defer func() { mbox.Destination = "" }()
+	form := mbox.Form{From: "alice@localhost", Subject: "hello", Message: "world"}
+	buf := new(bytes.Buffer)
+	form.WriteTo(buf)
+	entry, err := mbox.NewReader(buf).Next()
+	if err != nil {
+		t.Fatal(err)
+	}
+	msg, err := entry.Mail()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if msg.Header.Get("Envelope-to") != "me@localhost" || msg.Header.Get("Subject") != "hello" {
+		t.Fatalf("unexpected header: %v", msg.Header)
+	}
+}
+
+// leafParts returns the content types and bodies of the leaf parts of a message
+func leafParts(t *testing.T, contenttype string, body io.Reader) (types []string, bodies []string) {
+	t.Helper()
+	mediatype, params, err := mime.ParseMediaType(contenttype)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(mediatype, "multipart/") {
+		b, _ := io.ReadAll(body)
+		return []string{mediatype}, []string{strings.TrimSpace(string(b))}
+	}
+	mr := multipart.NewReader(body, params["boundary"])
+	types = append(types, mediatype)
+	bodies = append(bodies, "")
+	for {
+		p, err := mr.NextRawPart()
+		if err == io.EOF {
+			return types, bodies
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		subtypes, subbodies := leafParts(t, p.Header.Get("Content-Type"), p)
+		types = append(types, subtypes...)
+		bodies = append(bodies, subbodies...)
+	}
+}
+
+func TestAlternative(t *testing.T) {
+	for _, tt := range []struct {
+		attachments []mbox.Attachment
+		types       []string
+	}{
+		{nil, []string{"multipart/alternative", "text/plain", "text/html"}},
+		{[]mbox.Attachment{{Filename: "a.txt", ContentType: "text/plain", Data: []byte("a")}},
+			[]string{"multipart/mixed", "multipart/alternative", "text/plain", "text/html", "text/plain"}},
+	} {
+		form := mbox.Form{
+			From:        "alice@localhost",
+			Subject:     "hello",
+			Message:     "Hello *world*",
+			HTML:        "<p>Hello <b>world</b></p>",
+			Attachments: tt.attachments,
+		}
+		buf := new(bytes.Buffer)
+		if _, err := form.WriteTo(buf); err != nil {
+			t.Fatal(err)
+		}
+		entry, err := mbox.NewReader(buf).Next()
+		if err != nil {
+			t.Fatal(err)
+		}
+		msg, err := entry.Mail()
+		if err != nil {
+			t.Fatal(err)
+		}
+		types, bodies := leafParts(t, msg.Header.Get("Content-Type"), msg.Body)
+		if strings.Join(types, " ") != strings.Join(tt.types, " ") {
+			t.Fatalf("expected parts %v, got %v", tt.types, types)
+		}
+		start := len(types) - len(tt.attachments) - 2
+		if bodies[start] != form.Message || bodies[start+1] != form.HTML {
+			t.Errorf("unexpected bodies: %q", bodies)
+		}
+	}
+}
+
+// shortWriter fails the write going past n bytes, and only that one
+type shortWriter struct {
+	n      int
+	failed bool
+}
+
+func (w *shortWriter) Write(p []byte) (int, error) {
+	if !w.failed && len(p) > w.n {
+		w.failed = true
+		return w.n, io.ErrShortWrite
+	}
+	w.n -= len(p)
+	return len(p), nil
+}
+
+// a failed write is returned, wherever it happens
+func TestWriteError(t *testing.T) {
+	form := mbox.Form{
+		From:        "alice@localhost",
+		Subject:     "hello",
+		Message:     "Hello *world*",
+		HTML:        "<p>Hello <b>world</b></p>",
+		Attachments: []mbox.Attachment{{Filename: "a.txt", ContentType: "text/plain", Data: []byte("a")}},
+	}
+	size, err := form.WriteTo(io.Discard)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for n := 0; n < int(size); n++ {
+		if _, err := form.WriteTo(&shortWriter{n: n}); err == nil {
+			t.Fatalf("write failing after %d of %d bytes: no error", n, size)
+		}
+	}
+}
@@ -0,0 +1,202 @@
+package mbox
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"time"
+)
+
+// Dialect is how message body lines beginning with "From " are quoted,
+// so they are not read as the "From " line of the next message
+type Dialect int
+
+const (
+	// MboxO quotes "From " lines as ">From "
+	MboxO Dialect = iota
+	// MboxRD also adds a ">" to lines beginning with ">From ", ">>From ", ...
+	// so readers can remove the quoting
+	MboxRD
+
+	// unquoted writes "From " lines as is, for messages that are not
+	// written to a mbox file, eg: relayed
+	unquoted Dialect = -1
+)
+
+func (d Dialect) String() string {
+	switch d {
+	case MboxO:
+		return "mboxo"
+	case MboxRD:
+		return "mboxrd"
+	}
+	return "unknown"
+}
+
+// MarshalText returns the dialect name: mboxo or mboxrd
+func (d Dialect) MarshalText() ([]byte, error) {
+	if d < MboxO || d > MboxRD {
+		return nil, fmt.Errorf("unknown mbox dialect %d", int(d))
+	}
+	return []byte(d.String()), nil
+}
+
+// UnmarshalText parses a dialect name: mboxo or mboxrd
+func (d *Dialect) UnmarshalText(text []byte) error {
+	for _, dialect := range []Dialect{MboxO, MboxRD} {
+		if string(text) == dialect.String() {
+			*d = dialect
+			return nil
+		}
+	}
+	return fmt.Errorf("unknown mbox dialect %q (mboxo or mboxrd)", text)
+}
+
+// Options control how a Form is written (see Form.WriteWith). Fixed Clock,
+// MessageID and Boundary functions give reproducible output, eg: for tests.
+type Options struct {
+	Clock     func() time.Time // Received time of messages without one, default time.Now
+	MessageID func() string    // Message-ID of messages without one, default random
+	Boundary  func() string    // MIME multipart boundaries, default random
+	Dialect   Dialect          // default MboxO
+
+	// Location is the time zone of the envelope and delivery times, default that
+	// of Received. Date keeps the time zone of the sender.
+	Location *time.Location
+
+	// Status writes Status and X-Status headers with room for every flag,
+	// also for new messages, so SetFlags updates them in place
+	Status bool
+}
+
+// DefaultOptions are used by Form.WriteTo, and by the writer goroutine
+// unless Mailbox.Options is set. Set before calling Open function.
+var DefaultOptions Options
+
+func (o *Options) now() time.Time {
+	if o.Clock != nil {
+		return o.Clock()
+	}
+	return time.Now()
+}
+
+// local returns t in the Location time zone
+func (o *Options) local(t time.Time) time.Time {
+	if o.Location != nil {
+		return t.In(o.Location)
+	}
+	return t
+}
+
+func (o *Options) messageID() (string, error) {
+	if o.MessageID != nil {
+		return o.MessageID(), nil
+	}
+	return newMessageID()
+}
+
+func (o *Options) boundary() (string, error) {
+	if o.Boundary != nil {
+		return o.Boundary(), nil
+	}
+	return newBoundary()
+}
+
+// unquotedOptions are DefaultOptions, not quoting "From " lines
+func unquotedOptions() *Options {
+	opts := DefaultOptions
+	opts.Dialect = unquoted
+	opts.Status = false
+	return &opts
+}
+
+// writeForm writes form with opts, or with its own WriteTo if it is not
+// a *Form or *StreamForm
+func writeForm(w io.Writer, form Writable, opts *Options) (int64, error) {
+	if opts == nil {
+		return form.WriteTo(w)
+	}
+	switch f := form.(type) {
+	case *Form:
+		return f.WriteWith(w, *opts)
+	case *StreamForm:
+		return f.WriteWith(w, *opts)
+	}
+	return form.WriteTo(w)
+}
+
+// quoteWriter quotes the lines written to w that begin with "From "
+// (see Dialect). Close writes a last line that may still need quoting.
+type quoteWriter struct {
+	w       io.Writer
+	dialect Dialect
+	line    []byte // start of the current line, until it is known to need quoting or not
+	mid     bool   // in a line known to need no (more) quoting
+}
+
+var quoteMark = []byte{'>'}
+
+func (q *quoteWriter) Write(p []byte) (int, error) {
+	for i := 0; i < len(p); {
+		if q.mid {
+			j := bytes.IndexByte(p[i:], '\n')
+			if j < 0 {
+				_, err := q.w.Write(p[i:])
+				return len(p), err
+			}
+			if _, err := q.w.Write(p[i : i+j+1]); err != nil {
+				return i, err
+			}
+			i += j + 1
+			q.mid = false
+			continue
+		}
+		q.line = append(q.line, p[i])
+		i++
+		quote, known := q.needsQuote()
+		if !known {
+			continue
+		}
+		if quote {
+			if _, err := q.w.Write(quoteMark); err != nil {
+				return i, err
+			}
+		}
+		_, err := q.w.Write(q.line)
+		q.mid = q.line[len(q.line)-1] != '\n'
+		q.line = q.line[:0]
+		if err != nil {
+			return i, err
+		}
+	}
+	return len(p), nil
+}
+
+// needsQuote reports whether the start of the line needs quoting,
+// and if that is known yet
+func (q *quoteWriter) needsQuote() (quote, known bool) {
+	rest := q.line
+	if q.dialect == unquoted {
+		return false, true
+	}
+	if q.dialect == MboxRD {
+		rest = bytes.TrimLeft(rest, ">")
+	}
+	if len(rest) >= len(fromPrefix) {
+		return bytes.HasPrefix(rest, fromPrefix), true
+	}
+	if len(rest) != 0 && !bytes.HasPrefix(fromPrefix, rest) {
+		return false, true
+	}
+	return false, false
+}
+
+// Close writes the rest of a line that was not ended
+func (q *quoteWriter) Close() error {
+	if len(q.line) == 0 {
+		return nil
+	}
+	_, err := q.w.Write(q.line)
+	q.line = q.line[:0]
+	return err
+}
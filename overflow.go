@@ -0,0 +1,260 @@
+package mbox
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/textproto"
+	"os"
+	"path/filepath"
+	"sort"
+
+	"filippo.io/age"
+)
+
+// Overflow is what Save does when the queue of messages waiting to be
+// written is full (see Writer and Mailbox.Buffer)
+type Overflow int
+
+const (
+	// OverflowBlock waits for room in the queue, until the Save context is done
+	OverflowBlock Overflow = iota
+	// OverflowDrop returns ErrQueueFull
+	OverflowDrop
+	// OverflowSpill writes the message to a spill directory, appended later,
+	// maybe out of order (see ErrSpillEncrypted)
+	OverflowSpill
+)
+
+func (o Overflow) String() string {
+	switch o {
+	case OverflowBlock:
+		return "block"
+	case OverflowDrop:
+		return "drop"
+	case OverflowSpill:
+		return "spill"
+	}
+	return "unknown"
+}
+
+// MarshalText returns the policy name: block, drop or spill
+func (o Overflow) MarshalText() ([]byte, error) {
+	if o < OverflowBlock || o > OverflowSpill {
+		return nil, fmt.Errorf("unknown overflow policy %d", int(o))
+	}
+	return []byte(o.String()), nil
+}
+
+// UnmarshalText parses a policy name: block, drop or spill
+func (o *Overflow) UnmarshalText(text []byte) error {
+	for _, policy := range []Overflow{OverflowBlock, OverflowDrop, OverflowSpill} {
+		if string(text) == policy.String() {
+			*o = policy
+			return nil
+		}
+	}
+	return fmt.Errorf("unknown overflow policy %q (block, drop or spill)", text)
+}
+
+// OverflowPolicy is what Save does when the Writer channel is full.
+// Set before calling Open function.
+var OverflowPolicy = OverflowBlock
+
+// SpillDir is the spill directory of OverflowSpill, created if missing.
+// Default is the mbox file name + ".spill". Set before calling Open function.
+var SpillDir string
+
+// enqueue sends form to the writer goroutine, following policy when the
+// writer channel is full, until ctx or the writer context (open) is done
+func (o *output) enqueue(ctx, open context.Context, writer chan Writable, policy Overflow, spill *spool, form Writable) error {
+	if ctx == nil {
+		ctx = context.Background()
+	}
+	if open.Err() != nil {
+		return ErrClosed
+	}
+	select {
+	case writer <- form:
+		o.sent(writer)
+		return nil
+	default:
+	}
+	o.logger.Warn("queue full", "mailbox", o.name, "size", cap(writer), "overflow", policy.String())
+	if o.metrics != nil {
+		o.metrics.Overflow(o.name, policy)
+	}
+	switch policy {
+	case OverflowDrop:
+		return ErrQueueFull
+	case OverflowSpill:
+		if spill != nil {
+			if err := spill.put(form, o.opts); err != nil {
+				return err
+			}
+			o.logger.Debug("message spilled", "mailbox", o.name, "dir", spill.dir)
+			return nil
+		}
+	}
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-open.Done():
+		return ErrClosed
+	case writer <- form:
+		o.sent(writer)
+		return nil
+	}
+}
+
+// sent logs and measures a message sent to the writer goroutine
+func (o *output) sent(writer chan Writable) {
+	o.logger.Debug("message queued", "mailbox", o.name, "queued", len(writer))
+	if o.metrics != nil {
+		o.metrics.Queued(o.name, len(writer), cap(writer))
+	}
+}
+
+// spool is the spill directory, one file per message
+type spool struct {
+	dir  string
+	wake chan struct{}
+}
+
+// openSpool creates the spill directory, messages spilled before a restart
+// are written first
+func openSpool(dir string) (*spool, error) {
+	if dir == "" {
+		return nil, errors.New("spill directory is required")
+	}
+	if err := os.MkdirAll(filepath.Join(dir, "failed"), 0700); err != nil {
+		return nil, err
+	}
+	s := &spool{dir: dir, wake: make(chan struct{}, 1)}
+	if names, _ := s.names(); len(names) != 0 {
+		s.wake <- struct{}{}
+	}
+	return s, nil
+}
+
+// put writes a message to the spill directory, as written by opts
+func (s *spool) put(form Writable, opts *Options) error {
+	tmp, err := os.CreateTemp(s.dir, ".spill*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name()) // after a successful rename, there is nothing to remove
+	if _, err := writeForm(tmp, form, opts); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	name, err := queueName()
+	if err != nil {
+		return err
+	}
+	if err := os.Rename(tmp.Name(), filepath.Join(s.dir, name)); err != nil {
+		return err
+	}
+	select {
+	case s.wake <- struct{}{}:
+	default:
+	}
+	return nil
+}
+
+// names returns the spilled message files, oldest first
+func (s *spool) names() ([]string, error) {
+	names, err := filepath.Glob(filepath.Join(s.dir, "*.eml"))
+	if err != nil {
+		return nil, err
+	}
+	sort.Strings(names)
+	return names, nil
+}
+
+// wakeup returns the channel signaled when messages are spilled,
+// nil (never ready) if s is nil
+func (s *spool) wakeup() <-chan struct{} {
+	if s == nil {
+		return nil
+	}
+	return s.wake
+}
+
+// drain writes the spilled messages, oldest first, until ctx is done
+func (s *spool) drain(ctx context.Context, out *output, recip func() (age.Recipient, error)) (written int) {
+	if s == nil {
+		return 0
+	}
+	names, err := s.names()
+	if err != nil {
+		out.logger.Error("spill directory", "dir", s.dir, "error", err)
+		return 0
+	}
+	for _, name := range names {
+		if ctx.Err() != nil {
+			return written
+		}
+		msg, err := readSpilled(name)
+		if err != nil {
+			out.logger.Error("spill directory", "dir", s.dir, "error", err)
+			return written
+		}
+		r, err := recip()
+		if err == nil {
+			err = out.deliver(msg, r)
+		} else {
+			out.fail(err, msg, 0, true)
+		}
+		if err != nil {
+			os.Rename(name, filepath.Join(s.dir, "failed", filepath.Base(name)))
+			continue
+		}
+		os.Remove(name)
+		written++
+	}
+	return written
+}
+
+// spilledMessage is a message in the spill directory, as written by
+// Form.WriteTo. Only its header is read, until it is written.
+type spilledMessage struct {
+	name                     string
+	messageID, from, subject string
+}
+
+func readSpilled(name string) (*spilledMessage, error) {
+	f, err := os.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	msg := &spilledMessage{name: name}
+	br := bufio.NewReader(f)
+	if start, _ := br.Peek(len(fromPrefix)); bytes.Equal(start, fromPrefix) {
+		br.ReadBytes('\n')
+	}
+	h, _ := textproto.NewReader(br).ReadMIMEHeader()
+	msg.messageID, msg.from, msg.subject = h.Get("Message-Id"), h.Get("From"), h.Get("Subject")
+	return msg, nil
+}
+
+// WriteTo writes the message as it was spilled
+func (m *spilledMessage) WriteTo(w io.Writer) (int64, error) {
+	f, err := os.Open(m.name)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+	return io.Copy(w, f)
+}
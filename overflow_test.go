@@ -0,0 +1,166 @@
+package mbox_test
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	"filippo.io/age"
+	"github.com/aerth/mbox"
+)
+
+// blockedMailbox opens a mailbox with a single slot queue, its writer
+// goroutine blocked in a hook after the first message until release is closed
+func blockedMailbox(t *testing.T, overflow mbox.Overflow) (m *mbox.Mailbox, saved chan mbox.Saved, release chan struct{}) {
+	t.Helper()
+	saved, release = make(chan mbox.Saved, 10), make(chan struct{})
+	m = &mbox.Mailbox{
+		Filename: filepath.Join(t.TempDir(), "overflow.mbox"),
+		Buffer:   1,
+		Overflow: overflow,
+		Hooks: []mbox.Hook{mbox.HookFunc(func(s mbox.Saved) {
+			<-release
+			saved <- s
+		})},
+	}
+	if err := m.Open(nil); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(m.Close)
+	if err := m.Save(&mbox.Form{From: "alice@localhost", Subject: "first", Message: "hello"}); err != nil {
+		t.Fatal(err)
+	}
+	for m.Queued() != 0 { // taken by the writer goroutine, now blocked
+		time.Sleep(time.Millisecond)
+	}
+	if err := m.Save(&mbox.Form{From: "alice@localhost", Subject: "second", Message: "hello"}); err != nil {
+		t.Fatal(err)
+	}
+	return m, saved, release
+}
+
+func TestOverflowBlock(t *testing.T) {
+	m, _, release := blockedMailbox(t, mbox.OverflowBlock)
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	err := m.SaveContext(ctx, &mbox.Form{From: "alice@localhost", Message: "third"})
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("expected deadline exceeded, got %v", err)
+	}
+	close(release)
+	ctx, cancel = context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := m.SaveContext(ctx, &mbox.Form{From: "alice@localhost", Message: "third"}); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestOverflowDrop(t *testing.T) {
+	m, _, release := blockedMailbox(t, mbox.OverflowDrop)
+	defer close(release)
+	err := m.Save(&mbox.Form{From: "alice@localhost", Message: "third"})
+	if !errors.Is(err, mbox.ErrQueueFull) {
+		t.Fatalf("expected ErrQueueFull, got %v", err)
+	}
+}
+
+func TestOverflowSpill(t *testing.T) {
+	m, saved, release := blockedMailbox(t, mbox.OverflowSpill)
+	third := &mbox.Form{From: "alice@localhost", Subject: "third", Message: "spilled"}
+	if err := m.Save(third); err != nil {
+		t.Fatal(err)
+	}
+	spilled, _ := filepath.Glob(filepath.Join(m.Filename+".spill", "*.eml"))
+	if len(spilled) != 1 {
+		t.Fatalf("expected 1 spilled message, got %d", len(spilled))
+	}
+	close(release)
+	var subjects []string
+	for i := 0; i < 3; i++ {
+		select {
+		case s := <-saved:
+			subjects = append(subjects, s.Subject)
+			if s.Subject == "third" && s.MessageID != third.MessageID {
+				t.Errorf("spilled message: expected Message-ID %s, got %s", third.MessageID, s.MessageID)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("timeout, saved %v", subjects)
+		}
+	}
+	sort.Strings(subjects)
+	if strings.Join(subjects, ",") != "first,second,third" {
+		t.Errorf("unexpected messages: %v", subjects)
+	}
+	if spilled, _ := filepath.Glob(filepath.Join(m.Filename+".spill", "*.eml")); len(spilled) != 0 {
+		t.Errorf("expected empty spill directory, got %v", spilled)
+	}
+	m.Close()
+	f, err := os.Open(m.Filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	entries, err := mbox.NewReader(f).ReadAll()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 3 {
+		t.Fatalf("expected 3 messages, got %d", len(entries))
+	}
+}
+
+func TestSpillAfterRestart(t *testing.T) {
+	m, _, release := blockedMailbox(t, mbox.OverflowSpill)
+	if err := m.Save(&mbox.Form{From: "alice@localhost", Subject: "third", Message: "spilled"}); err != nil {
+		t.Fatal(err)
+	}
+	close(release)
+	m.Close()
+	// the spilled message may or may not be written before Close,
+	// after opening again it is written
+	m2 := &mbox.Mailbox{Filename: m.Filename, Overflow: mbox.OverflowSpill}
+	if err := m2.Open(nil); err != nil {
+		t.Fatal(err)
+	}
+	defer m2.Close()
+	deadline := time.After(5 * time.Second)
+	for {
+		spilled, _ := filepath.Glob(filepath.Join(m.Filename+".spill", "*.eml"))
+		if len(spilled) == 0 {
+			break
+		}
+		select {
+		case <-deadline:
+			t.Fatalf("spilled messages not written: %v", spilled)
+		case <-time.After(10 * time.Millisecond):
+		}
+	}
+}
+
+// spilled messages would be stored unencrypted
+func TestSpillEncrypted(t *testing.T) {
+	id, err := age.GenerateX25519Identity()
+	if err != nil {
+		t.Fatal(err)
+	}
+	m := &mbox.Mailbox{Filename: filepath.Join(t.TempDir(), "secret.mbox"), Overflow: mbox.OverflowSpill, AgeRecipient: id.Recipient().String()}
+	if err := m.Open(nil); !errors.Is(err, mbox.ErrSpillEncrypted) {
+		t.Errorf("Mailbox.Open: expected ErrSpillEncrypted, got %v", err)
+	}
+	defer func(policy mbox.Overflow, recipient string) {
+		mbox.OverflowPolicy, mbox.AgeRecipient = policy, recipient
+	}(mbox.OverflowPolicy, mbox.AgeRecipient)
+	mbox.OverflowPolicy, mbox.AgeRecipient = mbox.OverflowSpill, id.Recipient().String()
+	if err := mbox.Open(nil, m.Filename); !errors.Is(err, mbox.ErrSpillEncrypted) {
+		mbox.Close()
+		t.Errorf("Open: expected ErrSpillEncrypted, got %v", err)
+	}
+	if _, err := os.Stat(m.Filename + ".spill"); !os.IsNotExist(err) {
+		t.Errorf("spill directory created: %v", err)
+	}
+}
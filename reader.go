@@ -0,0 +1,187 @@
+package mbox
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"io"
+	"net/mail"
+
+	"filippo.io/age"
+	"filippo.io/age/armor"
+)
+
+// encryptedMarker precedes each age encrypted message (see AgeRecipient)
+const encryptedMarker = "# Encrypted message (age+aerth/mbox):\n"
+
+// Entry is a single message read from an mbox file
+type Entry struct {
+	Offset    int64  // byte offset of the "From " line in the file
+	Envelope  string // the "From " line, without "From " and line ending
+	Raw       []byte // message headers and body, without the "From " line
+	Encrypted bool   // Raw is an age encrypted message, see Decrypt
+
+	raw int64 // offset of Raw in the file
+}
+
+// Mail parses the raw entry as a RFC 5322 message
+func (e *Entry) Mail() (*mail.Message, error) {
+	if e.Encrypted {
+		return nil, ErrEncrypted
+	}
+	return mail.ReadMessage(bytes.NewReader(e.Raw))
+}
+
+// Decrypt returns the decrypted entry, with the same Offset.
+// Entries that are not encrypted are returned as is.
+func (e *Entry) Decrypt(identities ...age.Identity) (*Entry, error) {
+	if !e.Encrypted {
+		return e, nil
+	}
+	var src io.Reader = bytes.NewReader(e.Raw)
+	if bytes.HasPrefix(e.Raw, []byte(armor.Header)) {
+		src = armor.NewReader(src)
+	}
+	plain, err := age.Decrypt(src, identities...)
+	if err != nil {
+		return nil, err
+	}
+	dec, err := NewReader(plain).Next()
+	if err == io.EOF {
+		return nil, errors.New("encrypted message is empty")
+	}
+	if err != nil {
+		return nil, err
+	}
+	dec.Offset = e.Offset
+	return dec, nil
+}
+
+// Reader reads entries from an mbox file, one at a time
+// Messages encrypted to an AgeRecipient are returned as Encrypted entries.
+type Reader struct {
+	r      *bufio.Reader
+	offset int64  // offset of the next unread byte
+	from   []byte // "From " or encrypted marker line already read, begins the next entry
+	err    error
+}
+
+// NewReader returns a Reader reading from r
+func NewReader(r io.Reader) *Reader {
+	return &Reader{r: bufio.NewReader(r)}
+}
+
+var fromPrefix = []byte("From ")
+
+// readLine returns the next line including its line ending
+func (r *Reader) readLine() ([]byte, error) {
+	line, err := r.r.ReadBytes('\n')
+	r.offset += int64(len(line))
+	if err == io.EOF && len(line) != 0 {
+		err = nil
+	}
+	return line, err
+}
+
+// isStart reports whether line begins a new entry
+func isStart(line []byte) bool {
+	return bytes.HasPrefix(line, fromPrefix) || string(line) == encryptedMarker
+}
+
+// Next returns the next entry, or io.EOF when there are no more entries.
+func (r *Reader) Next() (*Entry, error) {
+	if r.err != nil {
+		return nil, r.err
+	}
+	// find the first entry, skipping anything before it
+	for r.from == nil {
+		line, err := r.readLine()
+		if err != nil {
+			r.err = err
+			return nil, err
+		}
+		if isStart(line) {
+			r.from = line
+		}
+	}
+	entry := &Entry{Offset: r.offset - int64(len(r.from)), raw: r.offset}
+	if string(r.from) == encryptedMarker {
+		r.from = nil
+		return r.nextEncrypted(entry)
+	}
+	entry.Envelope = string(bytes.TrimRight(r.from[len(fromPrefix):], "\r\n"))
+	r.from = nil
+	var buf bytes.Buffer
+	blank := false // previous line was empty
+	for {
+		line, err := r.readLine()
+		if err != nil {
+			r.err = err
+			break
+		}
+		if blank && isStart(line) {
+			r.from = line
+			break
+		}
+		blank = len(bytes.TrimRight(line, "\r\n")) == 0
+		buf.Write(line)
+	}
+	if r.err != nil && r.err != io.EOF {
+		return nil, r.err
+	}
+	// the empty lines separating entries are not part of the message
+	raw := bytes.TrimRight(buf.Bytes(), "\r\n")
+	entry.Raw = append(raw, '\n')
+	return entry, nil
+}
+
+// nextEncrypted reads armored age data up to its end, or binary age data
+// (older files) up to the next marker or the end of the file
+func (r *Reader) nextEncrypted(entry *Entry) (*Entry, error) {
+	entry.Encrypted = true
+	var buf bytes.Buffer
+	armored := false
+	for {
+		line, err := r.readLine()
+		if err != nil {
+			r.err = err
+			break
+		}
+		if buf.Len() == 0 && string(bytes.TrimRight(line, "\r\n")) == armor.Header {
+			armored = true
+		}
+		if armored {
+			buf.Write(line)
+			if string(bytes.TrimRight(line, "\r\n")) == armor.Footer {
+				break
+			}
+			continue
+		}
+		if bytes.HasSuffix(line, []byte(encryptedMarker)) {
+			buf.Write(line[:len(line)-len(encryptedMarker)])
+			r.from = []byte(encryptedMarker)
+			break
+		}
+		buf.Write(line)
+	}
+	if r.err != nil && r.err != io.EOF {
+		return nil, r.err
+	}
+	entry.Raw = buf.Bytes()
+	return entry, nil
+}
+
+// ReadAll reads every remaining entry
+func (r *Reader) ReadAll() ([]*Entry, error) {
+	var entries []*Entry
+	for {
+		entry, err := r.Next()
+		if err == io.EOF {
+			return entries, nil
+		}
+		if err != nil {
+			return entries, err
+		}
+		entries = append(entries, entry)
+	}
+}
@@ -0,0 +1,55 @@
+package mbox_test
+
+import (
+	"bytes"
+	"io"
+	"strings"
+	"testing"
+
+	"github.com/aerth/mbox"
+)
+
+// TestReader writes a few messages and reads them back
+func TestReader(t *testing.T) {
+	buf := new(bytes.Buffer)
+	forms := []mbox.Form{
+		{From: "Alice <alice@localhost>", Subject: "one", Message: "first message"},
+		{From: "bob@localhost", Subject: "two", Message: "second message\n\nwith empty lines\n\n\n"},
+		{From: "Carol <carol@localhost>", Subject: "three", Message: "third"},
+	}
+	for i := range forms {
+		if _, err := forms[i].WriteTo(buf); err != nil {
+			t.Fatal(err)
+		}
+	}
+	written := buf.Len()
+	entries, err := mbox.NewReader(buf).ReadAll()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != len(forms) {
+		t.Fatalf("expected %d entries, got %d", len(forms), len(entries))
+	}
+	if entries[0].Offset != 0 {
+		t.Errorf("first entry offset: %d", entries[0].Offset)
+	}
+	for i, entry := range entries {
+		if i > 0 && (entry.Offset <= entries[i-1].Offset || entry.Offset >= int64(written)) {
+			t.Errorf("entry %d: bad offset %d", i, entry.Offset)
+		}
+		msg, err := entry.Mail()
+		if err != nil {
+			t.Fatalf("entry %d: %v", i, err)
+		}
+		if got := msg.Header.Get("Subject"); got != forms[i].Subject {
+			t.Errorf("entry %d: expected subject %q, got %q", i, forms[i].Subject, got)
+		}
+		body, err := io.ReadAll(msg.Body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got, want := string(body), strings.TrimSpace(forms[i].Message)+"\n"; got != want {
+			t.Errorf("entry %d: expected body %q, got %q", i, want, got)
+		}
+	}
+}
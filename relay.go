@@ -0,0 +1,299 @@
+package mbox
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"crypto/tls"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/smtp"
+	"net/textproto"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Sink receives each message written by the writer goroutine, eg: a Relay,
+// it should return quickly
+type Sink interface {
+	Send(form Writable) error
+}
+
+// Sinks receive the messages written by Loop (see Sink).
+// Set before calling Open function.
+var Sinks []Sink
+
+// runSinks sends form to each sink, logging errors to log.
+// A StreamForm was read while written, so it is not sent.
+func runSinks(sinks []Sink, form Writable, log *slog.Logger) {
+	if _, ok := form.(*StreamForm); ok && len(sinks) != 0 {
+		log.Warn("streamed message not sent to sinks")
+		return
+	}
+	for _, sink := range sinks {
+		if err := sink.Send(form); err != nil {
+			log.Error("sink failed", "error", err)
+		}
+	}
+}
+
+// Relay is a Sink forwarding messages through an SMTP smarthost, queued in Dir
+// (not encrypted, see ErrRelayEncrypted) and retried every Retry
+type Relay struct {
+	Addr      string        // smarthost, host:port
+	Auth      smtp.Auth     // optional, eg: smtp.PlainAuth
+	TLSConfig *tls.Config   // optional, for STARTTLS, default verifies the Addr host name
+	From      string        // envelope sender address
+	To        []string      // recipient addresses
+	Dir       string        // queue directory, created if missing
+	Retry     time.Duration // delay between attempts while the smarthost fails, default 1 minute
+	Timeout   time.Duration // for each SMTP session, default 1 minute
+
+	wake   chan struct{}
+	cancel context.CancelFunc
+	wg     sync.WaitGroup
+}
+
+var _ Sink = (*Relay)(nil)
+
+// hasRelay reports whether one of the sinks is a Relay
+func hasRelay(sinks []Sink) bool {
+	for _, sink := range sinks {
+		if _, ok := sink.(*Relay); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// Start creates the queue directory and starts sending queued messages,
+// until Close is called or ctx is done
+func (r *Relay) Start(ctx context.Context) error {
+	if r.Addr == "" || r.From == "" || len(r.To) == 0 || r.Dir == "" {
+		return errors.New("relay: Addr, From, To and Dir are required")
+	}
+	if err := os.MkdirAll(filepath.Join(r.Dir, "failed"), 0700); err != nil {
+		return err
+	}
+	if ctx == nil {
+		ctx = context.Background()
+	}
+	if r.Retry <= 0 {
+		r.Retry = time.Minute
+	}
+	if r.Timeout <= 0 {
+		r.Timeout = time.Minute
+	}
+	r.wake = make(chan struct{}, 1)
+	ctx, r.cancel = context.WithCancel(ctx)
+	r.wg.Add(1)
+	go r.loop(ctx)
+	return nil
+}
+
+// Close stops sending, queued messages stay in Dir
+func (r *Relay) Close() {
+	if r.cancel == nil {
+		return
+	}
+	r.cancel()
+	r.wg.Wait()
+}
+
+// Send queues a message for sending
+func (r *Relay) Send(form Writable) error {
+	var buf bytes.Buffer
+	if _, err := writeForm(&buf, form, unquotedOptions()); err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(r.Dir, ".queue*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name()) // after a successful rename, there is nothing to remove
+	if _, err := tmp.Write(relayMessage(buf.Bytes())); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	name, err := queueName()
+	if err != nil {
+		return err
+	}
+	if err := os.Rename(tmp.Name(), filepath.Join(r.Dir, name)); err != nil {
+		return err
+	}
+	select {
+	case r.wake <- struct{}{}:
+	default:
+	}
+	return nil
+}
+
+// Queued returns the names of the queued message files, oldest first
+func (r *Relay) Queued() ([]string, error) {
+	names, err := filepath.Glob(filepath.Join(r.Dir, "*.eml"))
+	if err != nil {
+		return nil, err
+	}
+	sort.Strings(names)
+	return names, nil
+}
+
+// queueName returns a new queue file name, sorted by time
+func queueName() (string, error) {
+	b := make([]byte, 4)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return strconv.FormatInt(time.Now().UnixNano(), 10) + "-" + hex.EncodeToString(b) + ".eml", nil
+}
+
+// relayMessage returns the message as written to the mbox file, without the
+// "From " line, the delivery headers and the trailing empty lines
+func relayMessage(msg []byte) []byte {
+	if bytes.HasPrefix(msg, fromPrefix) {
+		if i := bytes.IndexByte(msg, '\n'); i >= 0 {
+			msg = msg[i+1:]
+		}
+	}
+	var out bytes.Buffer
+	header := true
+	skip := false // skipping a delivery header, and its continuation lines
+	for _, line := range bytes.SplitAfter(msg, []byte("\n")) {
+		if header {
+			if len(bytes.TrimRight(line, "\r\n")) == 0 {
+				header = false
+			} else if line[0] != ' ' && line[0] != '\t' {
+				name, _, _ := bytes.Cut(line, []byte(":"))
+				switch textproto.CanonicalMIMEHeaderKey(string(name)) {
+				case "Return-Path", "Delivery-Date", "Envelope-To":
+					skip = true
+				default:
+					skip = false
+				}
+			}
+			if skip {
+				continue
+			}
+		}
+		out.Write(line)
+	}
+	return append(bytes.TrimRight(out.Bytes(), "\r\n"), '\n')
+}
+
+func (r *Relay) loop(ctx context.Context) {
+	defer r.wg.Done()
+	timer := time.NewTimer(0) // send messages queued before a restart
+	defer timer.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-r.wake:
+		case <-timer.C:
+		}
+		if !r.flush(ctx) {
+			timer.Reset(r.Retry)
+		}
+	}
+}
+
+// flush sends the queued messages, oldest first, and reports whether the queue is empty
+func (r *Relay) flush(ctx context.Context) bool {
+	names, err := r.Queued()
+	if err != nil {
+		logger(nil).Error("relay queue", "dir", r.Dir, "error", err)
+		return false
+	}
+	for _, name := range names {
+		if ctx.Err() != nil {
+			return false
+		}
+		msg, err := os.ReadFile(name)
+		if err != nil {
+			logger(nil).Error("relay queue", "dir", r.Dir, "error", err)
+			return false
+		}
+		err = r.send(msg)
+		var perm *textproto.Error
+		if errors.As(err, &perm) && perm.Code >= 500 {
+			logger(nil).Error("relay rejected message", "addr", r.Addr, "file", filepath.Base(name), "error", err)
+			os.Rename(name, filepath.Join(r.Dir, "failed", filepath.Base(name)))
+			continue
+		}
+		if err != nil {
+			logger(nil).Warn("relay failed", "addr", r.Addr, "file", filepath.Base(name), "retry", r.Retry, "error", err)
+			return false
+		}
+		if err := os.Remove(name); err != nil {
+			logger(nil).Error("relay queue", "dir", r.Dir, "error", err)
+			continue
+		}
+		logger(nil).Info("message relayed", "addr", r.Addr, "file", filepath.Base(name))
+	}
+	return true
+}
+
+// send sends a single message in a new SMTP session
+func (r *Relay) send(msg []byte) error {
+	conn, err := net.DialTimeout("tcp", r.Addr, r.Timeout)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(r.Timeout))
+	host, _, _ := net.SplitHostPort(r.Addr)
+	c, err := smtp.NewClient(conn, host)
+	if err != nil {
+		return err
+	}
+	defer c.Close()
+	if ok, _ := c.Extension("STARTTLS"); ok {
+		config := r.TLSConfig
+		if config == nil {
+			config = &tls.Config{ServerName: host}
+		}
+		if err := c.StartTLS(config); err != nil {
+			return err
+		}
+	}
+	if r.Auth != nil {
+		if err := c.Auth(r.Auth); err != nil {
+			return err
+		}
+	}
+	if err := c.Mail(r.From); err != nil {
+		return err
+	}
+	for _, to := range r.To {
+		if err := c.Rcpt(to); err != nil {
+			return fmt.Errorf("%s: %w", to, err)
+		}
+	}
+	w, err := c.Data()
+	if err != nil {
+		return err
+	}
+	if _, err := w.Write(msg); err != nil {
+		return err
+	}
+	if err := w.Close(); err != nil {
+		return err
+	}
+	c.Quit() // the message is accepted, even if quitting fails
+	return nil
+}
@@ -0,0 +1,230 @@
+package mbox_test
+
+import (
+	"bufio"
+	"errors"
+	"net"
+	"net/textproto"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"filippo.io/age"
+	"github.com/aerth/mbox"
+)
+
+// fakeSMTP is a minimal SMTP server recording the messages it accepts
+type fakeSMTP struct {
+	ln net.Listener
+
+	mu       sync.Mutex
+	reply    string // reply to MAIL FROM, eg: "451 try again later"
+	messages []fakeMail
+}
+
+type fakeMail struct {
+	From string
+	To   []string
+	Data string
+}
+
+func newFakeSMTP(t *testing.T) *fakeSMTP {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &fakeSMTP{ln: ln, reply: "250 ok"}
+	t.Cleanup(func() { ln.Close() })
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go s.serve(conn)
+		}
+	}()
+	return s
+}
+
+func (s *fakeSMTP) setReply(reply string) {
+	s.mu.Lock()
+	s.reply = reply
+	s.mu.Unlock()
+}
+
+func (s *fakeSMTP) received() []fakeMail {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]fakeMail(nil), s.messages...)
+}
+
+func (s *fakeSMTP) serve(conn net.Conn) {
+	defer conn.Close()
+	tp := textproto.NewConn(conn)
+	tp.PrintfLine("220 fake ESMTP")
+	var mail fakeMail
+	for {
+		line, err := tp.ReadLine()
+		if err != nil {
+			return
+		}
+		cmd := strings.ToUpper(strings.SplitN(line, " ", 2)[0])
+		switch cmd {
+		case "EHLO", "HELO":
+			tp.PrintfLine("250 fake")
+		case "MAIL":
+			s.mu.Lock()
+			reply := s.reply
+			s.mu.Unlock()
+			mail = fakeMail{From: line}
+			tp.PrintfLine("%s", reply)
+		case "RCPT":
+			mail.To = append(mail.To, line)
+			tp.PrintfLine("250 ok")
+		case "DATA":
+			tp.PrintfLine("354 go ahead")
+			data, err := tp.ReadDotBytes()
+			if err != nil {
+				return
+			}
+			mail.Data = string(data)
+			s.mu.Lock()
+			s.messages = append(s.messages, mail)
+			s.mu.Unlock()
+			tp.PrintfLine("250 queued")
+		case "QUIT":
+			tp.PrintfLine("221 bye")
+			return
+		default:
+			tp.PrintfLine("502 not implemented")
+		}
+	}
+}
+
+// waitFor polls cond for up to 5 seconds
+func waitFor(t *testing.T, what string, cond func() bool) {
+	t.Helper()
+	for deadline := time.Now().Add(5 * time.Second); !cond(); {
+		if time.Now().After(deadline) {
+			t.Fatalf("timeout waiting for %s", what)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+func TestRelay(t *testing.T) {
+	server := newFakeSMTP(t)
+	server.setReply("451 try again later")
+	dir := t.TempDir()
+	newRelay := func() *mbox.Relay {
+		return &mbox.Relay{
+			Addr:  server.ln.Addr().String(),
+			From:  "forms@localhost",
+			To:    []string{"team@localhost"},
+			Dir:   filepath.Join(dir, "queue"),
+			Retry: 10 * time.Millisecond,
+		}
+	}
+	relay := newRelay()
+	m := &mbox.Mailbox{Filename: filepath.Join(dir, "archive.mbox"), Sinks: []mbox.Sink{relay}}
+	if err := relay.Start(nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := m.Open(nil); err != nil {
+		t.Fatal(err)
+	}
+	m.Save(&mbox.Form{From: "Alice <alice@localhost>", Subject: "hello", Message: "From the contact form.\n.\nbye"})
+
+	// the relay is failing, the message stays queued
+	waitFor(t, "queued message", func() bool {
+		names, _ := relay.Queued()
+		return len(names) == 1
+	})
+	time.Sleep(30 * time.Millisecond)
+	m.Close()
+	relay.Close()
+	if len(server.received()) != 0 {
+		t.Fatal("unexpected message received")
+	}
+
+	// after a restart, the queued message is sent
+	server.setReply("250 ok")
+	relay = newRelay()
+	if err := relay.Start(nil); err != nil {
+		t.Fatal(err)
+	}
+	defer relay.Close()
+	waitFor(t, "relayed message", func() bool { return len(server.received()) == 1 })
+	waitFor(t, "empty queue", func() bool {
+		names, _ := relay.Queued()
+		return len(names) == 0
+	})
+	got := server.received()[0]
+	if got.From != "MAIL FROM:<forms@localhost>" || len(got.To) != 1 || got.To[0] != "RCPT TO:<team@localhost>" {
+		t.Errorf("unexpected envelope: %+v", got)
+	}
+	for _, want := range []string{"Subject: hello\n", "From: Alice <alice@localhost>\n", "Message-ID: <", "\n\nFrom the contact form.\n.\nbye\n"} {
+		if !strings.Contains(got.Data, want) {
+			t.Errorf("expected %q in relayed message:\n%s", want, got.Data)
+		}
+	}
+	for _, unwanted := range []string{"From alice@localhost", "Return-path:", "Delivery-date:"} {
+		if strings.Contains(got.Data, unwanted) {
+			t.Errorf("unexpected %q in relayed message:\n%s", unwanted, got.Data)
+		}
+	}
+
+	// the archived copy is the same message
+	archive, _ := os.ReadFile(m.Filename)
+	scanner := bufio.NewScanner(strings.NewReader(got.Data))
+	for scanner.Scan() {
+		if line := scanner.Text(); strings.HasPrefix(line, "Message-ID: ") && !strings.Contains(string(archive), line) {
+			t.Errorf("archive does not contain %q", line)
+		}
+	}
+}
+
+func TestRelayRejected(t *testing.T) {
+	server := newFakeSMTP(t)
+	server.setReply("550 no thanks")
+	relay := &mbox.Relay{Addr: server.ln.Addr().String(), From: "forms@localhost", To: []string{"team@localhost"}, Dir: t.TempDir(), Retry: time.Hour}
+	if err := relay.Start(nil); err != nil {
+		t.Fatal(err)
+	}
+	defer relay.Close()
+	relay.Send(&mbox.Form{From: "alice@localhost", Message: "hello"})
+	waitFor(t, "failed message", func() bool {
+		names, _ := filepath.Glob(filepath.Join(relay.Dir, "failed", "*.eml"))
+		queued, _ := relay.Queued()
+		return len(names) == 1 && len(queued) == 0
+	})
+	if err := (&mbox.Relay{}).Start(nil); err == nil {
+		t.Error("expected error starting relay without settings")
+	}
+}
+
+// queued messages would be stored unencrypted
+func TestRelayEncrypted(t *testing.T) {
+	id, err := age.GenerateX25519Identity()
+	if err != nil {
+		t.Fatal(err)
+	}
+	relay := &mbox.Relay{Dir: t.TempDir()}
+	m := &mbox.Mailbox{Filename: filepath.Join(t.TempDir(), "secret.mbox"), Sinks: []mbox.Sink{relay}, AgeRecipient: id.Recipient().String()}
+	if err := m.Open(nil); !errors.Is(err, mbox.ErrRelayEncrypted) {
+		t.Errorf("Mailbox.Open: expected ErrRelayEncrypted, got %v", err)
+	}
+	defer func(sinks []mbox.Sink, recipient string) {
+		mbox.Sinks, mbox.AgeRecipient = sinks, recipient
+	}(mbox.Sinks, mbox.AgeRecipient)
+	mbox.Sinks, mbox.AgeRecipient = m.Sinks, m.AgeRecipient
+	if err := mbox.Open(nil, m.Filename); !errors.Is(err, mbox.ErrRelayEncrypted) {
+		mbox.Close()
+		t.Errorf("Open: expected ErrRelayEncrypted, got %v", err)
+	}
+}
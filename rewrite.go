@@ -0,0 +1,201 @@
+package mbox
+
+import (
+	"io"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+)
+
+// Rewrite rewrites the mbox file, keeping only the entries for which keep returns true.
+// It returns the number of entries removed, writers wait while the file is locked.
+func Rewrite(filename string, keep func(*Entry) bool) (removed int, err error) {
+	return rewrite(filename, func(_ int, e *Entry) bool { return keep(e) })
+}
+
+// Match selects entries of a mbox file, by index (from 0) or content
+type Match func(index int, e *Entry) bool
+
+// ByIndex matches the entries at the given indexes
+func ByIndex(indexes ...int) Match {
+	return func(index int, _ *Entry) bool {
+		return slices.Contains(indexes, index)
+	}
+}
+
+// ByMessageID matches the entries with one of the Message-IDs, with or
+// without angle brackets. Encrypted entries never match.
+func ByMessageID(ids ...string) Match {
+	want := map[string]bool{}
+	for _, id := range ids {
+		want[strings.Trim(strings.TrimSpace(id), "<>")] = true
+	}
+	return func(_ int, e *Entry) bool {
+		msg, err := e.Mail()
+		if err != nil {
+			return false
+		}
+		return want[strings.Trim(strings.TrimSpace(msg.Header.Get("Message-Id")), "<>")]
+	}
+}
+
+// Deleted matches the entries marked deleted, eg: by a mail client
+// (see FlagDeleted)
+func Deleted(_ int, e *Entry) bool {
+	return e.Flags()&FlagDeleted != 0
+}
+
+// Expunge removes the entries of the mbox file selected by match, and
+// returns their number (see Rewrite)
+func Expunge(filename string, match Match) (removed int, err error) {
+	return rewrite(filename, func(index int, e *Entry) bool { return !match(index, e) })
+}
+
+// Compact removes the entries of the mbox file marked Deleted
+func Compact(filename string) (removed int, err error) {
+	return Expunge(filename, Deleted)
+}
+
+// change is how rewrite changes an entry: removed, or with the bytes
+// [start, end) of its Raw replaced by data
+type change struct {
+	remove     bool
+	start, end int
+	data       []byte
+}
+
+// removal is the change removing an entry
+var removal = &change{remove: true}
+
+// rewrite is Rewrite, with the entry index
+func rewrite(filename string, keep func(int, *Entry) bool) (removed int, err error) {
+	return edit(filename, os.O_RDONLY, func(index int, e *Entry) *change {
+		if keep(index, e) {
+			return nil
+		}
+		return removal
+	})
+}
+
+// edit changes the entries for which changes returns non-nil, in place
+// (opened with flag) if their length is kept, and returns their number
+func edit(filename string, flag int, changes func(int, *Entry) *change) (changed int, err error) {
+	f, err := os.OpenFile(filename, flag, 0)
+	if err != nil {
+		return 0, err
+	}
+	rewriting.Lock()
+	defer rewriting.Unlock()
+	f, err = lockPath(f, filename, flag)
+	defer f.Close() // unlocks, after the rename
+	if err != nil {
+		return 0, err
+	}
+	info, err := f.Stat()
+	if err != nil {
+		return 0, err
+	}
+
+	// byte ranges [start, end) to copy, or to replace with data
+	type span struct {
+		start, end int64
+		replace    bool
+		data       []byte
+	}
+	var spans []span
+	inPlace := true
+	r := NewReader(f)
+	var prev *Entry
+	var prevChange *change
+	var first int64 = -1
+	index := 0
+	for {
+		entry, err := r.Next()
+		if err != nil && err != io.EOF {
+			return 0, err
+		}
+		if prev != nil {
+			end := info.Size()
+			if entry != nil {
+				end = entry.Offset
+			}
+			switch c := prevChange; {
+			case c == nil:
+				spans = append(spans, span{start: prev.Offset, end: end})
+			case c.remove:
+				inPlace = false
+			default:
+				start, stop := prev.raw+int64(c.start), prev.raw+int64(c.end)
+				spans = append(spans, span{start: prev.Offset, end: start},
+					span{start: start, end: stop, replace: true, data: c.data},
+					span{start: stop, end: end})
+				inPlace = inPlace && len(c.data) == c.end-c.start
+			}
+		}
+		if err == io.EOF {
+			break
+		}
+		if first == -1 {
+			first = entry.Offset
+		}
+		prev, prevChange = entry, changes(index, entry)
+		index++
+		if prevChange != nil {
+			changed++
+		}
+	}
+	if changed == 0 {
+		return 0, nil
+	}
+	if inPlace {
+		for _, s := range spans {
+			if s.replace {
+				if _, err := f.WriteAt(s.data, s.start); err != nil {
+					return 0, err
+				}
+			}
+		}
+		if err := f.Sync(); err != nil {
+			return 0, err
+		}
+		return changed, nil
+	}
+	if first > 0 {
+		// keep anything before the first entry
+		spans = append([]span{{start: 0, end: first}}, spans...)
+	}
+
+	tmp, err := os.CreateTemp(filepath.Dir(filename), "."+filepath.Base(filename)+".tmp*")
+	if err != nil {
+		return 0, err
+	}
+	defer os.Remove(tmp.Name()) // after a successful rename, there is nothing to remove
+	for _, s := range spans {
+		var err error
+		if s.replace {
+			_, err = tmp.Write(s.data)
+		} else {
+			_, err = io.Copy(tmp, io.NewSectionReader(f, s.start, s.end-s.start))
+		}
+		if err != nil {
+			tmp.Close()
+			return 0, err
+		}
+	}
+	if err := tmp.Chmod(info.Mode().Perm()); err != nil {
+		tmp.Close()
+		return 0, err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return 0, err
+	}
+	if err := tmp.Close(); err != nil {
+		return 0, err
+	}
+	if err := os.Rename(tmp.Name(), filename); err != nil {
+		return 0, err
+	}
+	return changed, nil
+}
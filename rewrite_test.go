@@ -0,0 +1,281 @@
+package mbox_test
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"filippo.io/age"
+	"github.com/aerth/mbox"
+)
+
+func TestRewrite(t *testing.T) {
+	filename := filepath.Join(t.TempDir(), "rewrite.mbox")
+	buf := new(bytes.Buffer)
+	for i := 0; i < 5; i++ {
+		form := mbox.Form{From: "alice@localhost", Subject: "message " + strconv.Itoa(i), Message: "body " + strconv.Itoa(i)}
+		form.WriteTo(buf)
+	}
+	if err := os.WriteFile(filename, buf.Bytes(), 0640); err != nil {
+		t.Fatal(err)
+	}
+	removed, err := mbox.Rewrite(filename, func(e *mbox.Entry) bool {
+		msg, _ := e.Mail()
+		s := msg.Header.Get("Subject")
+		return s != "message 1" && s != "message 4"
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if removed != 2 {
+		t.Fatalf("expected 2 removed, got %d", removed)
+	}
+	info, err := os.Stat(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Mode().Perm() != 0640 {
+		t.Errorf("file mode not preserved: %v", info.Mode())
+	}
+	f, _ := os.Open(filename)
+	defer f.Close()
+	entries, err := mbox.NewReader(f).ReadAll()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var subjects []string
+	for _, e := range entries {
+		msg, _ := e.Mail()
+		subjects = append(subjects, msg.Header.Get("Subject"))
+	}
+	if got := len(subjects); got != 3 || subjects[0] != "message 0" || subjects[1] != "message 2" || subjects[2] != "message 3" {
+		t.Fatalf("unexpected messages after rewrite: %q", subjects)
+	}
+	matches, _ := filepath.Glob(filepath.Join(filepath.Dir(filename), ".*tmp*"))
+	if len(matches) != 0 {
+		t.Errorf("temporary files left behind: %v", matches)
+	}
+}
+
+// subjects returns the Subject of the entries of a mbox file
+func subjects(t *testing.T, filename string) []string {
+	t.Helper()
+	f, err := os.Open(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	entries, err := mbox.NewReader(f).ReadAll()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var subjects []string
+	for _, e := range entries {
+		msg, err := e.Mail()
+		if err != nil {
+			t.Fatal(err)
+		}
+		subjects = append(subjects, msg.Header.Get("Subject"))
+	}
+	return subjects
+}
+
+func TestExpunge(t *testing.T) {
+	filename := filepath.Join(t.TempDir(), "expunge.mbox")
+	buf := new(bytes.Buffer)
+	for i := 0; i < 6; i++ {
+		form := mbox.Form{From: "alice@localhost", Subject: "message " + strconv.Itoa(i), Message: "body",
+			MessageID: "<" + strconv.Itoa(i) + "@localhost>"}
+		if i == 5 {
+			form.Flags = mbox.FlagReplied | mbox.FlagDeleted
+		}
+		form.WriteTo(buf)
+	}
+	if err := os.WriteFile(filename, buf.Bytes(), 0600); err != nil {
+		t.Fatal(err)
+	}
+	for _, tc := range []struct {
+		match mbox.Match
+		want  string
+	}{
+		{mbox.ByIndex(0, 2), "message 1,message 3,message 4,message 5"},
+		{mbox.ByMessageID("3@localhost", "<404@localhost>"), "message 1,message 4,message 5"},
+		{mbox.Deleted, "message 1,message 4"},
+		{mbox.ByIndex(7), "message 1,message 4"},
+	} {
+		if _, err := mbox.Expunge(filename, tc.match); err != nil {
+			t.Fatal(err)
+		}
+		if got := strings.Join(subjects(t, filename), ","); got != tc.want {
+			t.Errorf("got %q, want %q", got, tc.want)
+		}
+	}
+	if removed, err := mbox.Compact(filename); removed != 0 || err != nil {
+		t.Errorf("expected nothing to compact, got %d, %v", removed, err)
+	}
+	if _, err := mbox.Compact(filename + ".missing"); !os.IsNotExist(err) {
+		t.Errorf("expected not exist error, got %v", err)
+	}
+}
+
+// the writer goroutine writes to the new file after a rewrite
+func TestExpungeMailbox(t *testing.T) {
+	saved := make(chan mbox.Saved, 10)
+	m := &mbox.Mailbox{
+		Filename: filepath.Join(t.TempDir(), "expunge.mbox"),
+		Hooks:    []mbox.Hook{mbox.HookFunc(func(s mbox.Saved) { saved <- s })},
+	}
+	if err := m.Open(nil); err != nil {
+		t.Fatal(err)
+	}
+	defer m.Close()
+	save := func(subject string) {
+		if err := m.Save(&mbox.Form{From: "alice@localhost", Subject: subject, Message: "hello"}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for i := 0; i < 3; i++ {
+		save("message " + strconv.Itoa(i))
+	}
+	for i := 0; i < 3; i++ {
+		<-saved
+	}
+	removed, err := mbox.Expunge(m.Filename, mbox.ByIndex(1))
+	if err != nil || removed != 1 {
+		t.Fatalf("expected 1 removed, got %d, %v", removed, err)
+	}
+	save("message 3")
+	if s := <-saved; s.Offset == 0 {
+		t.Errorf("unexpected offset %d", s.Offset)
+	}
+	m.Close()
+	if got := strings.Join(subjects(t, m.Filename), ","); got != "message 0,message 2,message 3" {
+		t.Errorf("unexpected messages: %q", got)
+	}
+}
+
+// plain messages written after encrypted ones are kept, eg: once
+// AgeRecipient is unset
+func TestExpungeEncrypted(t *testing.T) {
+	id, err := age.GenerateX25519Identity()
+	if err != nil {
+		t.Fatal(err)
+	}
+	filename := filepath.Join(t.TempDir(), "encrypted.mbox")
+	for i, recipient := range []string{id.Recipient().String(), "", id.Recipient().String(), ""} {
+		m := &mbox.Mailbox{Filename: filename, AgeRecipient: recipient}
+		if err := m.Open(nil); err != nil {
+			t.Fatal(err)
+		}
+		if err := m.Save(&mbox.Form{From: "alice@localhost", Subject: "message " + strconv.Itoa(i), Message: "hello"}); err != nil {
+			t.Fatal(err)
+		}
+		m.Close()
+	}
+	f, err := os.Open(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	entries, err := mbox.NewReader(f).ReadAll()
+	f.Close()
+	if err != nil || len(entries) != 4 {
+		t.Fatalf("expected 4 messages, got %d, %v", len(entries), err)
+	}
+	if dec, err := entries[2].Decrypt(id); err != nil || !strings.Contains(string(dec.Raw), "Subject: message 2") {
+		t.Errorf("decrypting: %v", err)
+	}
+	removed, err := mbox.Expunge(filename, func(_ int, e *mbox.Entry) bool { return e.Encrypted })
+	if err != nil || removed != 2 {
+		t.Fatalf("expected 2 removed, got %d, %v", removed, err)
+	}
+	if got := strings.Join(subjects(t, filename), ","); got != "message 1,message 3" {
+		t.Errorf("unexpected messages: %q", got)
+	}
+}
+
+// expungeRemoved removes the messages with a "remove" subject
+func expungeRemoved(filename string) (int, error) {
+	return mbox.Expunge(filename, func(_ int, e *mbox.Entry) bool {
+		msg, err := e.Mail()
+		return err == nil && strings.HasPrefix(msg.Header.Get("Subject"), "remove")
+	})
+}
+
+// TestExpungeProcess is run by TestExpungeWhileWriting as another process
+func TestExpungeProcess(t *testing.T) {
+	filename := os.Getenv("MBOX_TEST_EXPUNGE")
+	if filename == "" {
+		t.Skip("run by TestExpungeWhileWriting")
+	}
+	if _, err := expungeRemoved(filename); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// a Mailbox keeps writing while the mbox file is rewritten, by this process
+// and by another one (eg: mboxtool): no message is lost
+func TestExpungeWhileWriting(t *testing.T) {
+	m := &mbox.Mailbox{Filename: filepath.Join(t.TempDir(), "busy.mbox")}
+	if err := m.Open(nil); err != nil {
+		t.Fatal(err)
+	}
+	defer m.Close()
+	const count = 200
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; i < count; i++ {
+			subject := "keep " + strconv.Itoa(i)
+			if i%2 == 1 {
+				subject = "remove " + strconv.Itoa(i)
+			}
+			if err := m.Save(&mbox.Form{From: "alice@localhost", Subject: subject, Message: "hello"}); err != nil {
+				t.Error(err)
+				return
+			}
+			time.Sleep(time.Millisecond)
+		}
+	}()
+	for process := false; ; process = !process {
+		var err error
+		if process && runtime.GOOS != "windows" && runtime.GOOS != "plan9" {
+			cmd := exec.Command(os.Args[0], "-test.run=^TestExpungeProcess$")
+			cmd.Env = append(os.Environ(), "MBOX_TEST_EXPUNGE="+m.Filename)
+			if out, cerr := cmd.CombinedOutput(); cerr != nil {
+				err = fmt.Errorf("%v: %s", cerr, out)
+			}
+		} else {
+			_, err = expungeRemoved(m.Filename)
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		select {
+		case <-done:
+		default:
+			continue
+		}
+		break
+	}
+	if _, _, err := m.Shutdown(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := expungeRemoved(m.Filename); err != nil {
+		t.Fatal(err)
+	}
+	var want []string
+	for i := 0; i < count; i += 2 {
+		want = append(want, "keep "+strconv.Itoa(i))
+	}
+	if got := subjects(t, m.Filename); strings.Join(got, ",") != strings.Join(want, ",") {
+		t.Errorf("got %d messages, want %d:\n%q", len(got), len(want), got)
+	}
+}
@@ -0,0 +1,60 @@
+package mbox
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+
+	"filippo.io/age"
+)
+
+// finish writes pending (if not nil), the queued and spilled messages until
+// deadline is done, then syncs the file
+func (o *output) finish(deadline context.Context, pending Writable, writer chan Writable, spill *spool, recip func() (age.Recipient, error)) (written, abandoned int) {
+	r, rerr := recip()
+	encrypted := r != nil || rerr != nil
+	for {
+		form := pending
+		pending = nil
+		if form == nil {
+			select {
+			case form = <-writer:
+			default:
+			}
+		}
+		if form == nil {
+			if deadline.Err() == nil {
+				written += spill.drain(deadline, o, recip)
+			}
+			if err := syncFile(o.file); err != nil {
+				o.logger.Error("sync", "mailbox", o.name, "error", err)
+			}
+			return written, abandoned
+		}
+		if err := deadline.Err(); err != nil {
+			abandoned++
+			o.fail(fmt.Errorf("shutdown: %w", err), form, 0, encrypted)
+			continue
+		}
+		err := rerr
+		if err == nil {
+			err = o.deliver(form, r)
+		} else {
+			o.fail(err, form, 0, encrypted)
+		}
+		if err != nil {
+			abandoned++
+			continue
+		}
+		written++
+	}
+}
+
+// syncFile commits w to stable storage, if it is a file other than os.Stdout
+func syncFile(w io.Writer) error {
+	if f, ok := w.(*os.File); ok && f != os.Stdout {
+		return f.Sync()
+	}
+	return nil
+}
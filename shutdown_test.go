@@ -0,0 +1,95 @@
+package mbox_test
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/aerth/mbox"
+)
+
+func countEntries(t *testing.T, filename string) int {
+	t.Helper()
+	f, err := os.Open(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	entries, err := mbox.NewReader(f).ReadAll()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return len(entries)
+}
+
+func TestShutdownDrains(t *testing.T) {
+	m := &mbox.Mailbox{Filename: filepath.Join(t.TempDir(), "drain.mbox")}
+	if err := m.Open(nil); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 50; i++ {
+		if err := m.Save(&mbox.Form{From: "alice@localhost", Message: "hello"}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	written, abandoned, err := m.Shutdown(context.Background())
+	if err != nil || abandoned != 0 {
+		t.Fatalf("expected nothing abandoned, got %d, %v", abandoned, err)
+	}
+	if n := countEntries(t, m.Filename); n != 50 {
+		t.Fatalf("expected 50 messages, got %d (%d written by shutdown)", n, written)
+	}
+	if err := m.Save(&mbox.Form{Message: "closed"}); err == nil {
+		t.Error("expected error saving to a closed mailbox")
+	}
+}
+
+func TestShutdownDeadline(t *testing.T) {
+	var mu sync.Mutex
+	var failed []error
+	release := make(chan struct{})
+	m := &mbox.Mailbox{
+		Filename: filepath.Join(t.TempDir(), "deadline.mbox"),
+		Hooks: []mbox.Hook{mbox.HookFunc(func(s mbox.Saved) {
+			<-release
+		})},
+		OnError: func(err error, form mbox.Writable) {
+			mu.Lock()
+			failed = append(failed, err)
+			mu.Unlock()
+		},
+	}
+	if err := m.Open(nil); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 5; i++ {
+		if err := m.Save(&mbox.Form{From: "alice@localhost", Message: "hello"}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for m.Queued() != 4 { // the first message is blocked in the hook
+		time.Sleep(time.Millisecond)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	time.AfterFunc(50*time.Millisecond, func() { close(release) })
+	written, abandoned, err := m.Shutdown(ctx)
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("expected deadline exceeded, got %v", err)
+	}
+	if written != 0 || abandoned != 4 {
+		t.Errorf("expected 0 written and 4 abandoned, got %d and %d", written, abandoned)
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	if len(failed) != 4 || !errors.Is(failed[0], context.DeadlineExceeded) {
+		t.Errorf("expected 4 OnError calls, got %v", failed)
+	}
+	if n := countEntries(t, m.Filename); n != 1 {
+		t.Errorf("expected 1 message, got %d", n)
+	}
+}
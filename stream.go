@@ -0,0 +1,56 @@
+package mbox
+
+import (
+	"io"
+	"strings"
+)
+
+// StreamForm is a Form whose text and attachments are read while it is written.
+// The readers are read once by the writer goroutine, then closed: they must stay
+// readable after Save returns, eg: files, not a HTTP request body.
+type StreamForm struct {
+	Form                       // header fields, and the text and attachments written first
+	Text    io.Reader          // optional, message text written after Form.Message
+	Streams []StreamAttachment // optional, attached after Form.Attachments
+}
+
+// StreamAttachment is an attachment of a StreamForm
+type StreamAttachment struct {
+	Filename    string    // file name shown to the reader
+	ContentType string    // eg: image/png, default application/octet-stream
+	Data        io.Reader // closed after writing, if it is an io.Closer
+}
+
+var _ Writable = (*StreamForm)(nil)
+
+// WriteTo writes the form to a mbox file with DefaultOptions (see WriteWith)
+func (s *StreamForm) WriteTo(w io.Writer) (int64, error) {
+	return s.WriteWith(w, DefaultOptions)
+}
+
+// WriteWith writes the form to a mbox file as Form.WriteWith, reading Text
+// and Streams, then closes them
+func (s *StreamForm) WriteWith(w io.Writer, opts Options) (int64, error) {
+	defer s.close()
+	if s.empty() {
+		return 0, ErrEmptyMessage
+	}
+	return s.Form.write(w, opts, &content{form: &s.Form, text: strings.TrimSpace(s.Message), reader: s.Text, streams: s.Streams})
+}
+
+// empty reports whether the form and its readers are empty
+func (s *StreamForm) empty() bool {
+	return s.Form.empty() && s.Text == nil && len(s.Streams) == 0
+}
+
+// close closes the readers that are io.Closers
+func (s *StreamForm) close() {
+	if closer, ok := s.Text.(io.Closer); ok {
+		closer.Close()
+	}
+	for _, a := range s.Streams {
+		if closer, ok := a.Data.(io.Closer); ok {
+			closer.Close()
+		}
+	}
+}
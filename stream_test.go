@@ -0,0 +1,210 @@
+package mbox_test
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"testing/iotest"
+
+	"github.com/aerth/mbox"
+)
+
+// closeReader records that it was closed
+type closeReader struct {
+	io.Reader
+	closed bool
+}
+
+func (r *closeReader) Close() error {
+	r.closed = true
+	return nil
+}
+
+// a StreamForm is written as the Form with the same content,
+// however its readers split the data
+func TestStreamForm(t *testing.T) {
+	png := bytes.Repeat([]byte{0x89, 'P', 'N', 'G', 0, 1, 2, 3}, 100)
+	form := mbox.Form{From: "alice@localhost", Subject: "stream", Message: "first\nFrom the form\n" + quotedLines,
+		HTML:        "<p>hello</p>",
+		Attachments: []mbox.Attachment{{Filename: "a.png", ContentType: "image/png", Data: png}, {Filename: "empty.txt"}}}
+	var want bytes.Buffer
+	if _, err := form.WriteWith(&want, *goldenOptions(mbox.MboxRD)); err != nil {
+		t.Fatal(err)
+	}
+
+	text := &closeReader{Reader: iotest.OneByteReader(strings.NewReader("From the form\n" + quotedLines))}
+	data := &closeReader{Reader: iotest.HalfReader(bytes.NewReader(png))}
+	stream := &mbox.StreamForm{
+		Form: mbox.Form{From: "alice@localhost", Subject: "stream", Message: "first", HTML: "<p>hello</p>"},
+		Text: text,
+		Streams: []mbox.StreamAttachment{
+			{Filename: "a.png", ContentType: "image/png", Data: data},
+			{Filename: "empty.txt", Data: strings.NewReader("")},
+		},
+	}
+	var got bytes.Buffer
+	n, err := stream.WriteWith(&got, *goldenOptions(mbox.MboxRD))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != int64(got.Len()) {
+		t.Errorf("WriteWith returned %d, wrote %d bytes", n, got.Len())
+	}
+	if !bytes.Equal(got.Bytes(), want.Bytes()) {
+		t.Errorf("unexpected output:\n%s\nwant:\n%s", got.Bytes(), want.Bytes())
+	}
+	if !text.closed || !data.closed {
+		t.Error("readers not closed")
+	}
+	if _, err := new(mbox.StreamForm).WriteTo(io.Discard); err != mbox.ErrEmptyMessage {
+		t.Errorf("expected ErrEmptyMessage, got %v", err)
+	}
+}
+
+// patternReader reads n bytes of lines, without keeping them in memory
+type patternReader struct {
+	n    int64
+	line []byte
+	off  int
+}
+
+func (r *patternReader) Read(p []byte) (int, error) {
+	if r.n <= 0 {
+		return 0, io.EOF
+	}
+	if int64(len(p)) > r.n {
+		p = p[:r.n]
+	}
+	for i := range p {
+		p[i] = r.line[r.off]
+		r.off = (r.off + 1) % len(r.line)
+	}
+	r.n -= int64(len(p))
+	return len(p), nil
+}
+
+// streamCheck fails the reads running more than maxLag bytes ahead of the
+// writes, and the writes of more than maxWrite bytes: the data is streamed,
+// not held in memory
+type streamCheck struct {
+	read, written    int64
+	maxLag, maxWrite int
+}
+
+func (s *streamCheck) Write(p []byte) (int, error) {
+	if len(p) > s.maxWrite {
+		return 0, fmt.Errorf("write of %d bytes", len(p))
+	}
+	s.written += int64(len(p))
+	return len(p), nil
+}
+
+// reader returns r, counting the bytes read
+func (s *streamCheck) reader(r io.Reader) io.Reader {
+	return readerFunc(func(p []byte) (int, error) {
+		n, err := r.Read(p)
+		s.read += int64(n)
+		if lag := s.read - s.written; lag > int64(s.maxLag) {
+			return n, fmt.Errorf("read %d bytes ahead of the writes", lag)
+		}
+		return n, err
+	})
+}
+
+type readerFunc func([]byte) (int, error)
+
+func (f readerFunc) Read(p []byte) (int, error) { return f(p) }
+
+func TestStreamFormMemory(t *testing.T) {
+	const size = 32 << 20
+	check := &streamCheck{maxLag: 1 << 20, maxWrite: 64 << 10}
+	stream := &mbox.StreamForm{
+		Form: mbox.Form{From: "alice@localhost", Subject: "large"},
+		Text: check.reader(&patternReader{n: size, line: []byte("From here, a line of text to quote\n")}),
+		Streams: []mbox.StreamAttachment{
+			{Filename: "large.bin", Data: check.reader(&patternReader{n: size, line: []byte{0, 1, 2, 3, 4, 5, 6}})},
+		},
+	}
+	n, err := stream.WriteTo(check)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n < 2*size || check.read != 2*size {
+		t.Errorf("expected more than %d bytes, read %d and wrote %d", 2*size, check.read, n)
+	}
+}
+
+// streamForm returns a StreamForm with a file attachment
+func streamForm(t *testing.T) (*mbox.StreamForm, *os.File) {
+	t.Helper()
+	filename := filepath.Join(t.TempDir(), "notes.txt")
+	if err := os.WriteFile(filename, []byte("From the notes\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	f, err := os.Open(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &mbox.StreamForm{
+		Form:    mbox.Form{From: "alice@localhost", Subject: "streamed"},
+		Text:    strings.NewReader("From a file\n"),
+		Streams: []mbox.StreamAttachment{{Filename: "notes.txt", ContentType: "text/plain", Data: f}},
+	}, f
+}
+
+// checkStreamed checks the last message of a mbox file is the streamForm
+func checkStreamed(t *testing.T, filename string, count int) {
+	t.Helper()
+	f, err := os.Open(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	entries, err := mbox.NewReader(f).ReadAll()
+	if err != nil || len(entries) != count {
+		t.Fatalf("expected %d messages, got %d (%v)", count, len(entries), err)
+	}
+	form, err := entries[count-1].Form()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if form.Subject != "streamed" || form.Message != ">From a file\n" || len(form.Attachments) != 1 ||
+		string(form.Attachments[0].Data) != "From the notes\n" {
+		t.Errorf("unexpected message: %+v", form)
+	}
+}
+
+func TestMailboxStreamForm(t *testing.T) {
+	m := &mbox.Mailbox{Filename: filepath.Join(t.TempDir(), "stream.mbox")}
+	if err := m.Open(nil); err != nil {
+		t.Fatal(err)
+	}
+	form, f := streamForm(t)
+	if err := m.Save(form); err != nil {
+		t.Fatal(err)
+	}
+	m.Close()
+	if err := f.Close(); err == nil {
+		t.Error("attachment file not closed")
+	}
+	checkStreamed(t, m.Filename, 1)
+}
+
+func TestSpillStreamForm(t *testing.T) {
+	m, _, release := blockedMailbox(t, mbox.OverflowSpill)
+	form, f := streamForm(t)
+	if err := m.Save(form); err != nil {
+		t.Fatal(err)
+	}
+	// read while spilled, not when written to the mbox file
+	if err := f.Close(); err == nil {
+		t.Error("attachment file not closed")
+	}
+	close(release)
+	m.Close()
+	checkStreamed(t, m.Filename, 3)
+}
@@ -0,0 +1,264 @@
+package mbox
+
+import (
+	"sort"
+	"strings"
+	"time"
+)
+
+// Thread is a message and its replies, a conversation when it is a root
+// returned by Threads
+type Thread struct {
+	Entry     *Entry    // nil for a message the replies refer to, missing from the mbox file
+	Index     int       // of Entry in the entries given to Threads, -1 if Entry is nil
+	MessageID string    // eg: <unique@localhost>
+	Subject   string    // decoded, empty if Entry is nil
+	From      string    // decoded, empty if Entry is nil
+	Date      time.Time // the Date header, zero if Entry is nil
+	Replies   []*Thread // in mbox file order
+
+	parent *Thread
+}
+
+// Walk calls fn for the thread and its replies, depth first, with their
+// depth: 0 for t, 1 for its replies, ...
+func (t *Thread) Walk(fn func(t *Thread, depth int)) {
+	t.walk(fn, 0)
+}
+
+func (t *Thread) walk(fn func(*Thread, int), depth int) {
+	fn(t, depth)
+	for _, reply := range t.Replies {
+		reply.walk(fn, depth+1)
+	}
+}
+
+// Threads groups the entries into conversations, in mbox file order, by their
+// Message-ID, In-Reply-To and References headers, and "Re:" subjects (JWZ).
+// Encrypted entries are threads of their own (see Entry.Decrypt).
+func Threads(entries []*Entry) []*Thread {
+	ids := map[string]*Thread{}
+	var all []*Thread
+	get := func(id string) *Thread {
+		t := ids[id]
+		if t == nil {
+			t = &Thread{Index: -1, MessageID: id}
+			ids[id] = t
+			all = append(all, t)
+		}
+		return t
+	}
+	for i, e := range entries {
+		t, refs := newThread(i, e)
+		// the message may be known from the references of another one
+		if known := ids[t.MessageID]; known != nil && known.Entry == nil {
+			known.Entry, known.Index, known.Subject, known.From, known.Date = t.Entry, t.Index, t.Subject, t.From, t.Date
+			t = known
+		} else {
+			if t.MessageID != "" && known == nil {
+				ids[t.MessageID] = t
+			}
+			all = append(all, t) // a duplicate Message-ID is another message
+		}
+		// each reference is a reply to the previous one, unless already known
+		var parent *Thread
+		for _, id := range refs {
+			ref := get(id)
+			if parent != nil && ref.parent == nil && !parent.descends(ref) {
+				parent.add(ref)
+			}
+			parent = ref
+		}
+		// the message itself knows best who its parent is
+		if t.parent != nil {
+			t.parent.remove(t)
+		}
+		if parent != nil && !parent.descends(t) {
+			parent.add(t)
+		}
+	}
+	var roots []*Thread
+	for _, t := range all {
+		if t.parent == nil {
+			roots = append(roots, t)
+		}
+	}
+	roots = groupBySubject(prune(roots, true))
+	sortThreads(roots)
+	return roots
+}
+
+// newThread returns the thread of entry i, and the Message-IDs it refers to,
+// the In-Reply-To one last
+func newThread(i int, e *Entry) (*Thread, []string) {
+	t := &Thread{Entry: e, Index: i}
+	msg, err := e.Mail()
+	if err != nil {
+		return t, nil
+	}
+	h := msg.Header
+	if ids := messageIDs(h.Get("Message-Id")); len(ids) != 0 {
+		t.MessageID = ids[0]
+	}
+	t.Subject = decodeWords(h.Get("Subject"))
+	t.From = decodeWords(h.Get("From"))
+	t.Date, _ = h.Date()
+	refs := messageIDs(h.Get("References"))
+	if inReplyTo := messageIDs(h.Get("In-Reply-To")); len(inReplyTo) != 0 {
+		refs = append(refs, inReplyTo[0])
+	}
+	// without loops to the message itself
+	kept := refs[:0]
+	for _, id := range refs {
+		if id != t.MessageID && (len(kept) == 0 || kept[len(kept)-1] != id) {
+			kept = append(kept, id)
+		}
+	}
+	return t, kept
+}
+
+// descends reports whether t is ancestor, or one of its replies
+func (t *Thread) descends(ancestor *Thread) bool {
+	for ; t != nil; t = t.parent {
+		if t == ancestor {
+			return true
+		}
+	}
+	return false
+}
+
+// add makes reply a reply of t
+func (t *Thread) add(reply *Thread) {
+	reply.parent = t
+	t.Replies = append(t.Replies, reply)
+}
+
+// remove removes a reply of t
+func (t *Thread) remove(reply *Thread) {
+	for i, r := range t.Replies {
+		if r == reply {
+			t.Replies = append(t.Replies[:i], t.Replies[i+1:]...)
+			break
+		}
+	}
+	reply.parent = nil
+}
+
+// prune removes the empty threads (nil Entry), their replies take their place
+// except under a root with more than one
+func prune(threads []*Thread, root bool) []*Thread {
+	var kept []*Thread
+	for _, t := range threads {
+		t.Replies = prune(t.Replies, false)
+		switch {
+		case t.Entry != nil, root && len(t.Replies) > 1:
+			kept = append(kept, t)
+		default:
+			for _, reply := range t.Replies {
+				reply.parent = t.parent
+			}
+			kept = append(kept, t.Replies...)
+		}
+	}
+	return kept
+}
+
+// groupBySubject makes the roots with a "Re:" subject replies of the first
+// root with the same subject, preferably not a reply itself
+func groupBySubject(roots []*Thread) []*Thread {
+	subjects := map[string]*Thread{}
+	for _, replies := range []bool{false, true} {
+		for _, t := range roots {
+			if subject, reply := t.baseSubject(); subject != "" && reply == replies && subjects[subject] == nil {
+				subjects[subject] = t
+			}
+		}
+	}
+	var kept []*Thread
+	for _, t := range roots {
+		subject, reply := t.baseSubject()
+		if first := subjects[subject]; reply && first != nil && first != t {
+			first.add(t)
+			continue
+		}
+		kept = append(kept, t)
+	}
+	return kept
+}
+
+// baseSubject returns the subject of the thread without "Re:", "Fwd:" and
+// "[list]" prefixes, and whether it began with "Re:"
+func (t *Thread) baseSubject() (subject string, reply bool) {
+	for t.Entry == nil && len(t.Replies) != 0 {
+		t = t.Replies[0]
+	}
+	subject = strings.TrimSpace(t.Subject)
+	if subject == NoSubjectLine {
+		return "", false
+	}
+	for {
+		lower := strings.ToLower(subject)
+		switch {
+		case strings.HasPrefix(lower, "re:"):
+			subject, reply = subject[3:], true
+		case strings.HasPrefix(lower, "fw:"):
+			subject = subject[3:]
+		case strings.HasPrefix(lower, "fwd:"):
+			subject = subject[4:]
+		case strings.HasPrefix(subject, "[") && strings.Contains(subject, "]"):
+			subject = subject[strings.Index(subject, "]")+1:]
+		default:
+			return strings.ToLower(strings.Join(strings.Fields(subject), " ")), reply
+		}
+		subject = strings.TrimSpace(subject)
+	}
+}
+
+// sortThreads sorts the threads and their replies by their first message
+func sortThreads(threads []*Thread) int {
+	first := make(map[*Thread]int, len(threads))
+	for _, t := range threads {
+		first[t] = sortThreads(t.Replies)
+		if t.Entry != nil && (t.Index < first[t] || first[t] < 0) {
+			first[t] = t.Index
+		}
+	}
+	sort.SliceStable(threads, func(i, j int) bool { return first[threads[i]] < first[threads[j]] })
+	if len(threads) == 0 {
+		return -1
+	}
+	return first[threads[0]]
+}
+
+// messageIDs returns the Message-IDs of a header, eg: References. Words
+// with an @ outside angle brackets are taken as Message-IDs too.
+func messageIDs(value string) []string {
+	var ids []string
+	for value != "" {
+		start := strings.IndexAny(value, "<(")
+		if start < 0 {
+			start = len(value)
+		}
+		for _, word := range strings.Fields(value[:start]) {
+			if strings.Contains(word, "@") {
+				ids = append(ids, "<"+word+">")
+			}
+		}
+		if start == len(value) {
+			break
+		}
+		closing := ">"
+		if value[start] == '(' {
+			closing = ")" // a comment
+		}
+		end := strings.Index(value[start:], closing)
+		if end < 0 {
+			break
+		}
+		if id := value[start : start+end+1]; closing == ">" && len(id) > 2 && !strings.ContainsAny(id, " \t\r\n") {
+			ids = append(ids, id)
+		}
+		value = value[start+end+1:]
+	}
+	return ids
+}
@@ -0,0 +1,131 @@
+package mbox_test
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+
+	"github.com/aerth/mbox"
+)
+
+// threadEntries writes the forms to a mbox and reads them back
+func threadEntries(t *testing.T, forms ...mbox.Form) []*mbox.Entry {
+	t.Helper()
+	var buf bytes.Buffer
+	opts := goldenOptions(mbox.MboxO)
+	for _, form := range forms {
+		if _, err := form.WriteWith(&buf, *opts); err != nil {
+			t.Fatal(err)
+		}
+	}
+	entries, err := mbox.NewReader(&buf).ReadAll()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return entries
+}
+
+// drawThreads returns the subjects of the threads, indented by depth,
+// "-" for a missing message
+func drawThreads(threads []*mbox.Thread) string {
+	var b strings.Builder
+	for _, thread := range threads {
+		thread.Walk(func(t *mbox.Thread, depth int) {
+			subject := t.Subject
+			if t.Entry == nil {
+				subject = "-"
+			}
+			b.WriteString(strings.Repeat("  ", depth) + subject + "\n")
+		})
+	}
+	return b.String()
+}
+
+func TestThreads(t *testing.T) {
+	entries := threadEntries(t,
+		mbox.Form{From: "alice@localhost", Subject: "help", Message: "it is broken", MessageID: "<1@localhost>"},
+		mbox.Form{From: "bob@localhost", Subject: "contact", Message: "hello", MessageID: "<2@localhost>"},
+		mbox.Form{From: "support@localhost", Subject: "Re: help", Message: "try again", MessageID: "<3@localhost>",
+			InReplyTo: "<1@localhost>", References: []string{"<1@localhost>"}},
+		// the reply of a reply missing from the mbox file
+		mbox.Form{From: "alice@localhost", Subject: "Re: Re: help", Message: "still broken", MessageID: "<5@localhost>",
+			References: []string{"<1@localhost>", "<3@localhost>", "<4@localhost>"}},
+		// same subject, not a reply
+		mbox.Form{From: "carol@localhost", Subject: "contact", Message: "hi", MessageID: "<6@localhost>"},
+		// a reply without references
+		mbox.Form{From: "support@localhost", Subject: "RE: [support] Contact", Message: "hi bob", MessageID: "<7@localhost>"},
+		// replies to a message missing from the mbox file, In-Reply-To only
+		mbox.Form{From: "dave@localhost", Subject: "Re: party", Message: "yes", MessageID: "<9@localhost>", InReplyTo: "<8@localhost>"},
+		mbox.Form{From: "erin@localhost", Subject: "Re: party", Message: "no", MessageID: "<10@localhost>", InReplyTo: "8@localhost"},
+		mbox.Form{From: "frank@localhost", Subject: "Re: lunch", Message: "ok", MessageID: "<12@localhost>", InReplyTo: "<11@localhost>"},
+	)
+	want := `help
+  Re: help
+    Re: Re: help
+contact
+  RE: [support] Contact
+contact
+-
+  Re: party
+  Re: party
+Re: lunch
+`
+	threads := mbox.Threads(entries)
+	if got := drawThreads(threads); got != want {
+		t.Errorf("got:\n%s\nwant:\n%s", got, want)
+	}
+	if reply := threads[0].Replies[0]; reply.Index != 2 || reply.MessageID != "<3@localhost>" || reply.From != "support@localhost" || reply.Date.IsZero() {
+		t.Errorf("unexpected reply: %+v", reply)
+	}
+	if missing := threads[3]; missing.Index != -1 || missing.MessageID != "<8@localhost>" {
+		t.Errorf("unexpected missing message: %+v", missing)
+	}
+}
+
+// loops and duplicate Message-IDs do not lose messages
+func TestThreadsLoops(t *testing.T) {
+	entries := threadEntries(t,
+		mbox.Form{From: "alice@localhost", Subject: "a", Message: "a", MessageID: "<a@localhost>", References: []string{"<b@localhost>"}},
+		mbox.Form{From: "alice@localhost", Subject: "b", Message: "b", MessageID: "<b@localhost>", References: []string{"<a@localhost>"}},
+		mbox.Form{From: "alice@localhost", Subject: "c", Message: "c", MessageID: "<c@localhost>", References: []string{"<c@localhost>"}},
+		mbox.Form{From: "alice@localhost", Subject: "c again", Message: "c", MessageID: "<c@localhost>"},
+	)
+	want := `b
+  a
+c
+c again
+`
+	if got := drawThreads(mbox.Threads(entries)); got != want {
+		t.Errorf("got:\n%s\nwant:\n%s", got, want)
+	}
+}
+
+func TestFormReferences(t *testing.T) {
+	form := mbox.Form{From: "alice@localhost", Subject: "Re: help", Message: "thanks", InReplyTo: "3@localhost",
+		References: []string{"<1@localhost>", "<3@localhost>\r\nX-Injected: yes"}}
+	msg, err := form.ToMail()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := msg.Header.Get("In-Reply-To"); got != "<3@localhost>" {
+		t.Errorf("In-Reply-To: %q", got)
+	}
+	if got := msg.Header.Get("X-Injected"); got != "" {
+		t.Errorf("header injected: %q", got)
+	}
+	parsed, err := mbox.FormFromMail(msg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if parsed.InReplyTo != "<3@localhost>" || strings.Join(parsed.References, " ") != "<1@localhost> <3@localhost>" {
+		t.Errorf("got %q, %q", parsed.InReplyTo, parsed.References)
+	}
+	if len(parsed.Headers) != 0 {
+		t.Errorf("unexpected headers: %v", parsed.Headers)
+	}
+	// from Headers, eg: forms written before InReplyTo and References
+	form = mbox.Form{From: "alice@localhost", Message: "thanks", Headers: map[string]string{"in-reply-to": "<3@localhost>"}}
+	if msg, err = form.ToMail(); err != nil || msg.Header.Get("In-Reply-To") != "<3@localhost>" {
+		t.Errorf("In-Reply-To from Headers: %q, %v", msg.Header.Get("In-Reply-To"), err)
+	}
+}
@@ -0,0 +1,146 @@
+package mbox
+
+import (
+	"net"
+	"net/mail"
+	"os"
+	"strings"
+	"time"
+)
+
+// Trace describes how a message arrived, eg: from a HTTP client or a SMTP
+// peer. It is written as a Received header (RFC 5321 section 4.4):
+//
+//	Received: from mail.example.com ([192.0.2.1]) by mx.example.org with ESMTP
+//	 id 42 for <me@example.org>; Wed, 01 May 2024 12:30:05 +0000
+type Trace struct {
+	From string    // client host name, eg: the SMTP HELO name, optional
+	IP   string    // client address, eg: 192.0.2.1 or 2001:db8::1
+	By   string    // receiving host, default the host name
+	With string    // protocol, eg: HTTP, HTTPS, ESMTP, ESMTPS
+	ID   string    // optional, eg: a queue id
+	For  string    // optional recipient address
+	Time time.Time // default the Form Received time
+
+	// Text is a Received header read from a message (see FormFromMail),
+	// written as is
+	Text string
+}
+
+// String returns the Received header value, without the Time if it is zero
+func (t Trace) String() string {
+	if t.Text != "" {
+		return t.Text
+	}
+	var clauses []string
+	ip := t.IP
+	if ip != "" {
+		if strings.Contains(ip, ":") {
+			ip = "IPv6:" + ip
+		}
+		ip = "[" + ip + "]"
+	}
+	switch {
+	case t.From != "" && ip != "":
+		clauses = append(clauses, "from "+t.From+" ("+ip+")")
+	case t.From != "":
+		clauses = append(clauses, "from "+t.From)
+	case ip != "":
+		clauses = append(clauses, "from "+ip)
+	}
+	by := t.By
+	if by == "" {
+		by = hostname()
+	}
+	clauses = append(clauses, "by "+by)
+	if t.With != "" {
+		clauses = append(clauses, "with "+t.With)
+	}
+	if t.ID != "" {
+		clauses = append(clauses, "id "+t.ID)
+	}
+	if t.For != "" {
+		clauses = append(clauses, "for <"+strings.Trim(t.For, "<>")+">")
+	}
+	s := strings.Join(strings.Fields(strings.Join(clauses, " ")), " ")
+	if !t.Time.IsZero() {
+		s += "; " + t.Time.Format(time.RFC1123Z)
+	}
+	return s
+}
+
+// PeerIP returns the IP address of a connection peer, eg: for Trace.IP
+// from a SMTP connection RemoteAddr
+func PeerIP(addr net.Addr) string {
+	switch a := addr.(type) {
+	case *net.TCPAddr:
+		return a.IP.String()
+	case nil:
+		return ""
+	}
+	host, _, err := net.SplitHostPort(addr.String())
+	if err != nil {
+		return addr.String()
+	}
+	return host
+}
+
+// parseTrace reads the clauses of a Received header, keeping it as Text
+func parseTrace(value string) Trace {
+	t := Trace{Text: strings.Join(strings.Fields(value), " ")}
+	clauses := t.Text
+	if i := strings.LastIndexByte(clauses, ';'); i >= 0 {
+		if date, err := mail.ParseDate(strings.TrimSpace(clauses[i+1:])); err == nil {
+			t.Time = date
+		}
+		clauses = clauses[:i]
+	}
+	fields := strings.Fields(clauses)
+	for i := 0; i+1 < len(fields); i++ {
+		value := fields[i+1]
+		switch strings.ToLower(fields[i]) {
+		case "from":
+			t.From = value
+			if strings.HasPrefix(value, "[") {
+				t.From, t.IP = "", addressLiteral(value)
+			} else if i+2 < len(fields) && strings.HasPrefix(fields[i+2], "(") {
+				comment := strings.Join(fields[i+2:], " ")
+				if end := strings.IndexByte(comment, ')'); end > 0 {
+					comment = comment[:end]
+				}
+				if start := strings.IndexByte(comment, '['); start >= 0 {
+					t.IP = addressLiteral(comment[start:])
+				}
+			}
+		case "by":
+			t.By = value
+		case "with":
+			t.With = value
+		case "id":
+			t.ID = value
+		case "for":
+			t.For = strings.Trim(value, "<>")
+		default:
+			continue
+		}
+		i++
+	}
+	return t
+}
+
+// addressLiteral returns the address of a literal, eg: [IPv6:2001:db8::1]
+func addressLiteral(s string) string {
+	if end := strings.IndexByte(s, ']'); end > 0 {
+		s = s[:end]
+	}
+	return strings.TrimPrefix(strings.TrimPrefix(s, "["), "IPv6:")
+}
+
+// hostname returns the host name, or localhost
+func hostname() string {
+	host, err := os.Hostname()
+	if err != nil || host == "" {
+		return "localhost"
+	}
+	return host
+}
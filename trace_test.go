@@ -0,0 +1,91 @@
+package mbox_test
+
+import (
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/aerth/mbox"
+)
+
+func TestTraceString(t *testing.T) {
+	when := time.Date(2024, 5, 1, 12, 30, 5, 0, time.UTC)
+	for _, tc := range []struct {
+		trace mbox.Trace
+		want  string
+	}{
+		{mbox.Trace{IP: "192.0.2.1", By: "forms.example.com", With: "HTTP", Time: when},
+			"from [192.0.2.1] by forms.example.com with HTTP; Wed, 01 May 2024 12:30:05 +0000"},
+		{mbox.Trace{From: "mail.example.com", IP: "2001:db8::1", By: "mx", With: "ESMTP", ID: "q1", For: "<me@example.com>"},
+			"from mail.example.com ([IPv6:2001:db8::1]) by mx with ESMTP id q1 for <me@example.com>"},
+		{mbox.Trace{From: "bad\r\nBcc: injected", By: "mx"},
+			"from bad Bcc: injected by mx"},
+		{mbox.Trace{Text: "from a by b; Wed, 01 May 2024 12:30:05 +0000", By: "ignored"},
+			"from a by b; Wed, 01 May 2024 12:30:05 +0000"},
+	} {
+		if got := tc.trace.String(); got != tc.want {
+			t.Errorf("got %q, want %q", got, tc.want)
+		}
+	}
+}
+
+func TestParseTrace(t *testing.T) {
+	msg := "Received: from mail.example.com (mail.example.com [192.0.2.1])\r\n" +
+		"\tby mx.example.org (Postfix) with ESMTPS id 4Vx for <me@example.org>;\r\n" +
+		"\tWed, 1 May 2024 14:30:05 +0200 (CEST)\r\n" +
+		"Received: from [IPv6:2001:db8::1] by mail.example.com with HTTP; Wed, 01 May 2024 12:29:00 +0000\r\n" +
+		"From: alice@example.com\r\n" +
+		"Subject: hello\r\n" +
+		"\r\n" +
+		"world\r\n"
+	form, err := mbox.ParseMessage(strings.NewReader(msg))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(form.Trace) != 2 {
+		t.Fatalf("expected 2 traces, got %d", len(form.Trace))
+	}
+	got := form.Trace[0]
+	if got.From != "mail.example.com" || got.IP != "192.0.2.1" || got.By != "mx.example.org" ||
+		got.With != "ESMTPS" || got.ID != "4Vx" || got.For != "me@example.org" {
+		t.Errorf("unexpected trace: %+v", got)
+	}
+	if want := time.Date(2024, 5, 1, 12, 30, 5, 0, time.UTC); !got.Time.Equal(want) {
+		t.Errorf("expected time %v, got %v", want, got.Time)
+	}
+	if !strings.HasPrefix(got.String(), "from mail.example.com (mail.example.com [192.0.2.1]) by mx.example.org (Postfix)") {
+		t.Errorf("the header text is not kept: %q", got.String())
+	}
+	if got := form.Trace[1]; got.From != "" || got.IP != "2001:db8::1" || got.With != "HTTP" {
+		t.Errorf("unexpected trace: %+v", got)
+	}
+	if _, ok := form.Headers["Received"]; ok {
+		t.Error("Received is also in Headers")
+	}
+
+	// written again in the same order
+	m, err := form.ToMail()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if received := m.Header["Received"]; len(received) != 2 || received[1] != form.Trace[1].Text {
+		t.Errorf("unexpected Received headers: %q", received)
+	}
+}
+
+func TestPeerIP(t *testing.T) {
+	for _, tc := range []struct {
+		addr net.Addr
+		want string
+	}{
+		{&net.TCPAddr{IP: net.ParseIP("192.0.2.1"), Port: 25}, "192.0.2.1"},
+		{&net.TCPAddr{IP: net.ParseIP("2001:db8::1"), Port: 25}, "2001:db8::1"},
+		{&net.UnixAddr{Name: "/run/smtp.sock", Net: "unix"}, "/run/smtp.sock"},
+		{nil, ""},
+	} {
+		if got := mbox.PeerIP(tc.addr); got != tc.want {
+			t.Errorf("%v: got %q, want %q", tc.addr, got, tc.want)
+		}
+	}
+}
@@ -0,0 +1,243 @@
+package mbox
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/mail"
+	"strings"
+
+	"github.com/goware/emailx"
+)
+
+// Validator checks, and may normalize, a message before Save queues it
+type Validator interface {
+	Validate(ctx context.Context, form *Form) error
+}
+
+// ValidatorFunc is a function used as a Validator
+type ValidatorFunc func(ctx context.Context, form *Form) error
+
+// Validate calls f
+func (f ValidatorFunc) Validate(ctx context.Context, form *Form) error {
+	return f(ctx, form)
+}
+
+// Validators check the messages saved by Save, default LevelValidators(ValidationLevel).
+// Set before calling Open function.
+var Validators []Validator
+
+// LevelValidators returns the validators of a ValidationLevel:
+// 0 = none, 1 = NormalizeAddress, 2 = and RequireAddress,
+// 3 = and CheckMailHost with the default resolver
+func LevelValidators(level int) []Validator {
+	var v []Validator
+	if level > 0 {
+		v = append(v, NormalizeAddress{})
+	}
+	if level > 1 {
+		v = append(v, RequireAddress{})
+	}
+	if level > 2 {
+		v = append(v, CheckMailHost{})
+	}
+	return v
+}
+
+// packageValidators returns Validators, or the ValidationLevel validators
+func packageValidators() []Validator {
+	if Validators != nil {
+		return Validators
+	}
+	return LevelValidators(ValidationLevel)
+}
+
+// validate runs the validators on form, if it is a *Form or *StreamForm
+func validate(ctx context.Context, validators []Validator, form Writable) error {
+	var f *Form
+	switch form := form.(type) {
+	case *Form:
+		if form.empty() {
+			return ErrEmptyMessage
+		}
+		f = form
+	case *StreamForm:
+		if form.empty() {
+			return ErrEmptyMessage
+		}
+		f = &form.Form
+	default:
+		return nil
+	}
+	for _, v := range validators {
+		if err := v.Validate(ctx, f); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// parseFrom returns the display name and address of a From header
+func parseFrom(from string) (name, addr string, err error) {
+	from = strings.TrimSpace(from)
+	if from == "" {
+		return "", "", &ErrInvalidAddress{Address: from, Reason: ErrNoAddress}
+	}
+	a, err := mail.ParseAddress(from)
+	if err != nil {
+		if !strings.Contains(from, "@") {
+			return "", "", &ErrInvalidAddress{Address: from, Reason: ErrNoAddress}
+		}
+		return "", "", &ErrInvalidAddress{Address: from, Reason: ErrAddressSyntax, Cause: err}
+	}
+	return a.Name, a.Address, nil
+}
+
+// NormalizeAddress lowercases and trims the From address, keeping the display name
+type NormalizeAddress struct{}
+
+func (NormalizeAddress) Validate(ctx context.Context, form *Form) error {
+	name, addr, err := parseFrom(form.From)
+	if err != nil {
+		return nil
+	}
+	from := strings.TrimSpace(form.From)
+	normal := emailx.Normalize(addr)
+	// only the address is replaced, the last one: a display name may contain an address
+	if i := strings.LastIndex(from, addr); i >= 0 {
+		form.From = from[:i] + normal + from[i+len(addr):]
+	} else {
+		form.From = (&mail.Address{Name: name, Address: normal}).String()
+	}
+	return nil
+}
+
+// RequireAddress rejects messages without a valid From address:
+// a local part and a domain with at least two labels (or an address literal).
+type RequireAddress struct{}
+
+func (RequireAddress) Validate(ctx context.Context, form *Form) error {
+	_, addr, err := parseFrom(form.From)
+	if err != nil {
+		return err
+	}
+	local, domain, _ := strings.Cut(addr, "@")
+	if local == "" || !validDomain(domain) {
+		return &ErrInvalidAddress{Address: addr, Reason: ErrAddressSyntax}
+	}
+	return nil
+}
+
+// validDomain reports whether domain is a host name with at least two labels,
+// or an address literal, eg: [192.0.2.1]
+func validDomain(domain string) bool {
+	if strings.HasPrefix(domain, "[") && strings.HasSuffix(domain, "]") {
+		return net.ParseIP(strings.TrimPrefix(domain[1:len(domain)-1], "IPv6:")) != nil
+	}
+	labels := strings.Split(domain, ".")
+	if len(labels) < 2 || len(domain) > 253 {
+		return false
+	}
+	for _, label := range labels {
+		if label == "" || len(label) > 63 || label[0] == '-' || label[len(label)-1] == '-' {
+			return false
+		}
+		for _, c := range label {
+			if !(c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || c == '-' || c > 0x7f) {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// Resolver looks up DNS records, eg: net.DefaultResolver, or a fake in tests
+type Resolver interface {
+	LookupMX(ctx context.Context, name string) ([]*net.MX, error)
+	LookupHost(ctx context.Context, host string) ([]string, error)
+}
+
+// CheckMailHost rejects From domains without MX nor address records, or with a null MX.
+// Temporary lookup errors are ignored.
+type CheckMailHost struct {
+	Resolver Resolver // default net.DefaultResolver
+}
+
+func (c CheckMailHost) Validate(ctx context.Context, form *Form) error {
+	_, addr, err := parseFrom(form.From)
+	if err != nil {
+		return nil
+	}
+	_, domain, _ := strings.Cut(addr, "@")
+	if strings.HasPrefix(domain, "[") {
+		return nil // address literal
+	}
+	resolver := c.Resolver
+	if resolver == nil {
+		resolver = net.DefaultResolver
+	}
+	mx, err := resolver.LookupMX(ctx, domain)
+	if err == nil && len(mx) != 0 {
+		if len(mx) == 1 && (mx[0].Host == "." || mx[0].Host == "") {
+			return &ErrInvalidAddress{Address: addr, Reason: ErrNoMailHost, Cause: errors.New("null MX")}
+		}
+		return nil
+	}
+	if err != nil && !notFound(err) {
+		return nil
+	}
+	hosts, err := resolver.LookupHost(ctx, domain)
+	if err == nil && len(hosts) != 0 {
+		return nil
+	}
+	if err != nil && !notFound(err) {
+		return nil
+	}
+	return &ErrInvalidAddress{Address: addr, Reason: ErrNoMailHost, Cause: err}
+}
+
+// notFound reports whether err is a DNS "no such host" error
+func notFound(err error) bool {
+	var dnsErr *net.DNSError
+	return errors.As(err, &dnsErr) && dnsErr.IsNotFound
+}
+
+// DisposableDomains are well known disposable email domains, blocked by
+// BlockDomains if its list is empty
+var DisposableDomains = []string{
+	"10minutemail.com",
+	"dispostable.com",
+	"getnada.com",
+	"guerrillamail.com",
+	"mailinator.com",
+	"maildrop.cc",
+	"sharklasers.com",
+	"temp-mail.org",
+	"trashmail.com",
+	"yopmail.com",
+}
+
+// BlockDomains rejects messages from addresses in Domains, or their subdomains.
+// The default is DisposableDomains.
+type BlockDomains struct {
+	Domains []string
+}
+
+func (b BlockDomains) Validate(ctx context.Context, form *Form) error {
+	_, addr, err := parseFrom(form.From)
+	if err != nil {
+		return nil
+	}
+	domains := b.Domains
+	if len(domains) == 0 {
+		domains = DisposableDomains
+	}
+	_, domain, _ := strings.Cut(strings.ToLower(addr), "@")
+	for _, d := range domains {
+		d = strings.ToLower(strings.TrimPrefix(d, "@"))
+		if domain == d || strings.HasSuffix(domain, "."+d) {
+			return &ErrInvalidAddress{Address: addr, Reason: ErrDisposableAddress}
+		}
+	}
+	return nil
+}
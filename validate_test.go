@@ -0,0 +1,140 @@
+package mbox_test
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/mail"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/aerth/mbox"
+)
+
+// fakeResolver answers from maps, other names are not found
+type fakeResolver struct {
+	mx    map[string][]*net.MX
+	hosts map[string][]string
+	err   error // returned for every lookup, if set
+}
+
+func (r fakeResolver) LookupMX(ctx context.Context, name string) ([]*net.MX, error) {
+	if r.err != nil {
+		return nil, r.err
+	}
+	if mx, ok := r.mx[name]; ok {
+		return mx, nil
+	}
+	return nil, &net.DNSError{Err: "no such host", Name: name, IsNotFound: true}
+}
+
+func (r fakeResolver) LookupHost(ctx context.Context, host string) ([]string, error) {
+	if r.err != nil {
+		return nil, r.err
+	}
+	if addrs, ok := r.hosts[host]; ok {
+		return addrs, nil
+	}
+	return nil, &net.DNSError{Err: "no such host", Name: host, IsNotFound: true}
+}
+
+func TestValidators(t *testing.T) {
+	resolver := fakeResolver{
+		mx: map[string][]*net.MX{
+			"example.com": {{Host: "mx.example.com.", Pref: 10}},
+			"null.test":   {{Host: ".", Pref: 0}},
+		},
+		hosts: map[string][]string{"implicit.test": {"192.0.2.1"}},
+	}
+	temporary := fakeResolver{err: &net.DNSError{Err: "timeout", Name: "example.org", IsTimeout: true}}
+	tests := []struct {
+		validator mbox.Validator
+		from      string
+		want      error  // nil to accept
+		normal    string // From after validation, if accepted
+	}{
+		{mbox.NormalizeAddress{}, "Alice Smith <Alice@Example.COM>", nil, "Alice Smith <alice@example.com>"},
+		{mbox.NormalizeAddress{}, "Dr. Bob <BOB@example.com>", nil, "Dr. Bob <bob@example.com>"},
+		{mbox.NormalizeAddress{}, " Carol@Example.com ", nil, "carol@example.com"},
+		{mbox.NormalizeAddress{}, "Just A Name", nil, "Just A Name"},
+		{mbox.NormalizeAddress{}, `"Doe, John" <John@Example.COM>`, nil, `"Doe, John" <john@example.com>`},
+		{mbox.NormalizeAddress{}, `"Bob \"the\" Builder" <Bob@Example.com>`, nil, `"Bob \"the\" Builder" <bob@example.com>`},
+		{mbox.NormalizeAddress{}, "=?utf-8?q?J=C3=B6rg?= <J@X.com>", nil, "=?utf-8?q?J=C3=B6rg?= <j@x.com>"},
+		{mbox.NormalizeAddress{}, `"Dave@Example.com" <Dave@Example.com>`, nil, `"Dave@Example.com" <dave@example.com>`},
+		{mbox.NormalizeAddress{}, "Erin@Example.com (Erin)", nil, "erin@example.com (Erin)"},
+		{mbox.RequireAddress{}, "Alice <alice@example.com>", nil, "Alice <alice@example.com>"},
+		{mbox.RequireAddress{}, "a@[192.0.2.1]", nil, "a@[192.0.2.1]"},
+		{mbox.RequireAddress{}, "", mbox.ErrNoAddress, ""},
+		{mbox.RequireAddress{}, "Just A Name", mbox.ErrNoAddress, ""},
+		{mbox.RequireAddress{}, "alice@", mbox.ErrAddressSyntax, ""},
+		{mbox.RequireAddress{}, "alice@localhost", mbox.ErrAddressSyntax, ""},
+		{mbox.RequireAddress{}, "alice@-bad-.com", mbox.ErrAddressSyntax, ""},
+		{mbox.CheckMailHost{Resolver: resolver}, "alice@example.com", nil, "alice@example.com"},
+		{mbox.CheckMailHost{Resolver: resolver}, "alice@implicit.test", nil, "alice@implicit.test"},
+		{mbox.CheckMailHost{Resolver: resolver}, "alice@nowhere.test", mbox.ErrNoMailHost, ""},
+		{mbox.CheckMailHost{Resolver: resolver}, "alice@null.test", mbox.ErrNoMailHost, ""},
+		{mbox.CheckMailHost{Resolver: temporary}, "alice@example.org", nil, "alice@example.org"},
+		{mbox.BlockDomains{}, "spam@mailinator.com", mbox.ErrDisposableAddress, ""},
+		{mbox.BlockDomains{}, "spam@eu.Mailinator.com", mbox.ErrDisposableAddress, ""},
+		{mbox.BlockDomains{}, "alice@notmailinator.com", nil, "alice@notmailinator.com"},
+		{mbox.BlockDomains{Domains: []string{"example.com"}}, "alice@example.com", mbox.ErrDisposableAddress, ""},
+	}
+	for _, tt := range tests {
+		form := &mbox.Form{From: tt.from}
+		err := tt.validator.Validate(context.Background(), form)
+		if tt.want == nil {
+			if err != nil {
+				t.Errorf("%T %q: unexpected error %v", tt.validator, tt.from, err)
+			} else if form.From != tt.normal {
+				t.Errorf("%T %q: expected From %q, got %q", tt.validator, tt.from, tt.normal, form.From)
+			}
+			continue
+		}
+		var addrErr *mbox.ErrInvalidAddress
+		if !errors.Is(err, tt.want) || !errors.As(err, &addrErr) {
+			t.Errorf("%T %q: expected %v, got %v", tt.validator, tt.from, tt.want, err)
+		}
+	}
+}
+
+func TestMailboxValidators(t *testing.T) {
+	m := &mbox.Mailbox{
+		Filename:   filepath.Join(t.TempDir(), "validated.mbox"),
+		Validators: []mbox.Validator{mbox.NormalizeAddress{}, mbox.RequireAddress{}, mbox.BlockDomains{}},
+	}
+	if err := m.Open(nil); err != nil {
+		t.Fatal(err)
+	}
+	defer m.Close()
+	form := &mbox.Form{From: "Alice Smith <Alice@Example.com>", Message: "hello"}
+	if err := m.Save(form); err != nil {
+		t.Fatal(err)
+	}
+	if form.From != "Alice Smith <alice@example.com>" {
+		t.Errorf("unexpected From: %q", form.From)
+	}
+	err := m.Save(&mbox.Form{From: "spam@yopmail.com", Message: "hello"})
+	if !errors.Is(err, mbox.ErrDisposableAddress) {
+		t.Errorf("expected ErrDisposableAddress, got %v", err)
+	}
+	if m.Queued() > 1 {
+		t.Errorf("rejected message was queued")
+	}
+}
+
+// the normalized From is still one address, with the same display name
+func TestNormalizeAddressName(t *testing.T) {
+	for _, from := range []string{`"Doe, John" <John@Example.COM>`, "=?utf-8?q?J=C3=B6rg?= <J@X.com>", `"Fred Bloggs"@Example.COM`} {
+		before, err := mail.ParseAddress(from)
+		if err != nil {
+			t.Fatal(err)
+		}
+		form := &mbox.Form{From: from}
+		mbox.NormalizeAddress{}.Validate(context.Background(), form)
+		after, err := mail.ParseAddressList(form.From)
+		if err != nil || len(after) != 1 || after[0].Name != before.Name || after[0].Address != strings.ToLower(before.Address) {
+			t.Errorf("%s: got %q, %v", from, form.From, err)
+		}
+	}
+}
@@ -2,21 +2,26 @@ package mbox
 
 import (
 	"context"
-	"errors"
+	"crypto/rand"
+	"encoding/hex"
 	"fmt"
 	"io"
-	"log"
+	"log/slog"
+	"net/mail"
+	"net/textproto"
 	"os"
+	"sort"
+	"strconv"
 	"strings"
 	"sync"
 	"time"
 
 	"filippo.io/age"
-	"github.com/goware/emailx"
+	"filippo.io/age/armor"
 )
 
 // Writer channel is used to write emails to the mbox file one at a time
-// Set before calling Open function.
+// Set before calling Open function, eg: with a larger buffer.
 // Channel is not closed by this package. (see Close function)
 var Writer = make(chan Writable, 100)
 
@@ -33,16 +38,46 @@ func SetContext(ctx context.Context, cancel context.CancelFunc) {
 
 var wg sync.WaitGroup
 
+// spilled is the spill directory of OverflowSpill, nil for other policies
+var spilled *spool
+
+// saving is read locked by Save, while sending to the Writer channel
+var saving sync.RWMutex
+
+// shutdown is the state of the last Shutdown
+var shutdown struct {
+	sync.Mutex
+	deadline           context.Context
+	written, abandoned int
+	err                error
+}
+
 // Open mbox file, rw+create+append mode ( step 1 )
 // If file is empty, we use os.Stdout
 // use Close() to stop Loop goroutine
 func Open(ctx context.Context, file string) (err error) {
 	if mainctx != nil && mainctx.Err() == nil {
-		panic("mail file is already open")
+		return ErrAlreadyOpen
 	}
 	if ctx == nil {
 		ctx = context.Background()
 	}
+	spilled = nil
+	if OverflowPolicy == OverflowSpill && AgeRecipient != "" {
+		return ErrSpillEncrypted
+	}
+	if hasRelay(Sinks) && AgeRecipient != "" {
+		return ErrRelayEncrypted
+	}
+	if OverflowPolicy == OverflowSpill {
+		dir := SpillDir
+		if dir == "" && file != "" {
+			dir = file + ".spill"
+		}
+		if spilled, err = openSpool(dir); err != nil {
+			return err
+		}
+	}
 	if file == "" {
 		MailWriteCloser = os.Stdout
 	} else {
@@ -52,6 +87,9 @@ func Open(ctx context.Context, file string) (err error) {
 			return err
 		}
 	}
+	shutdown.Lock()
+	shutdown.deadline, shutdown.written, shutdown.abandoned, shutdown.err = nil, 0, 0, nil
+	shutdown.Unlock()
 	mainctx, cancelwrite = context.WithCancel(ctx)
 	// Writer receives one email at a time
 	wg.Add(1)
@@ -75,8 +113,8 @@ var Separator func(io.Writer)
 // Example: "me@localhost" or empty string
 var Destination = ""
 
-// Loop goroutine closes the mbox file when context is finished,
-// then calls donefn (wg.Wait() for example)
+// Loop goroutine writes the queued messages and closes the mbox file when
+// context is finished (see Shutdown), then calls donefn (wg.Done() for example)
 func Loop(incoming chan Writable, mailout io.WriteCloser, donefn func()) {
 	if donefn == nil {
 		donefn = func() {}
@@ -84,60 +122,230 @@ func Loop(incoming chan Writable, mailout io.WriteCloser, donefn func()) {
 	for {
 		select {
 		case <-mainctx.Done():
-			cancelwrite()
-			mailout.Close()
-			donefn()
+			finishLoop(nil, incoming, mailout, donefn)
 			return
 		case form := <-incoming:
-			if AgeRecipient == "" {
-				_, err := form.WriteTo(mailout)
-				if err != nil {
-					log.Printf("error writing to mbox, please restart the program: %v", err)
-				}
-				if Separator != nil {
-					Separator(mailout)
-				}
-				continue
+			if mainctx.Err() != nil {
+				finishLoop(form, incoming, mailout, donefn)
+				return
 			}
-			if AgeRecipient != "" {
-				recip, err := age.ParseX25519Recipient(AgeRecipient)
-				if err != nil {
-					cancelwrite()
-					mailout.Close()
-					donefn()
-					panic(err.Error())
-				}
-				if Separator == nil {
-					fmt.Fprintf(mailout, "# Encrypted message (age+aerth/mbox):\n")
-				}
-				encryptor, err := age.Encrypt(mailout, recip)
-				if err != nil {
-					log.Printf("error writing to mbox, please restart the program: %v", err)
-					continue
-				}
-				_, err = form.WriteTo(encryptor)
-				if err != nil {
-					log.Printf("error writing to mbox, please restart the program: %v", err)
-					continue
-				}
-				if err := encryptor.Close(); err != nil {
-					log.Printf("error writing to mbox, please restart the program: %v", err)
-					continue
-				}
-				if Separator != nil {
-					Separator(mailout)
-				}
+			out := globalOutput(&mailout, func() int { return len(incoming) })
+			recip, err := globalRecipient()
+			if err != nil {
+				// never write the message unencrypted
+				out.fail(err, form, 0, true)
 				continue
 			}
+			out.deliver(form, recip)
+		case <-spilled.wakeup():
+			spilled.drain(mainctx, globalOutput(&mailout, func() int { return len(incoming) }), globalRecipient)
+		}
+	}
+}
+
+// finishLoop writes pending (if not nil) and the queued messages,
+// until the Shutdown deadline, then closes the file and calls donefn
+func finishLoop(pending Writable, incoming chan Writable, mailout io.WriteCloser, donefn func()) {
+	saving.Lock() // wait for Save calls in progress, new ones fail
+	saving.Unlock()
+	shutdown.Lock()
+	deadline := shutdown.deadline
+	shutdown.Unlock()
+	if deadline == nil {
+		deadline = context.Background()
+	}
+	out := globalOutput(&mailout, func() int { return len(incoming) })
+	written, abandoned := out.finish(deadline, pending, incoming, spilled, globalRecipient)
+	cancelwrite()
+	err := mailout.Close()
+	if abandoned != 0 && deadline.Err() != nil {
+		err = deadline.Err()
+	}
+	out.logger.Info("mailbox closed", "mailbox", out.name, "written", written, "abandoned", abandoned)
+	shutdown.Lock()
+	shutdown.written, shutdown.abandoned, shutdown.err = written, abandoned, err
+	shutdown.Unlock()
+	donefn()
+}
+
+// globalOutput returns the output of Loop, with the current package settings.
+// The mbox file is replaced in mailout when it is opened again.
+func globalOutput(mailout *io.WriteCloser, queued func() int) *output {
+	opts := DefaultOptions
+	return &output{name: fileName(*mailout), file: *mailout, hooks: Hooks, sinks: Sinks, logger: logger(nil), onError: OnError,
+		metrics: Metrics, queued: queued, opts: &opts,
+		replaced: func(f *os.File) { *mailout = f }}
+}
+
+// globalRecipient parses AgeRecipient, nil if empty
+func globalRecipient() (age.Recipient, error) {
+	if AgeRecipient == "" {
+		return nil, nil
+	}
+	recip, err := age.ParseX25519Recipient(AgeRecipient)
+	if err != nil {
+		return nil, fmt.Errorf("invalid AgeRecipient: %w", err)
+	}
+	return recip, nil
+}
+
+// output is where the writer goroutine writes messages, and who it tells about it
+type output struct {
+	name    string // mbox file name, if known
+	file    io.Writer
+	hooks   []Hook
+	sinks   []Sink
+	logger  *slog.Logger
+	onError func(error, Writable)
+	metrics Recorder   // optional
+	queued  func() int // messages waiting to be written
+	opts    *Options   // how a *Form is written
+
+	// replaced, if set, is called with the file opened again when the mbox
+	// file was replaced (see Rewrite)
+	replaced func(*os.File)
+}
+
+// deliver writes a single message, encrypted to recip if not nil, then logs
+// the result and notifies the hooks and sinks (or OnError, on failure)
+func (o *output) deliver(form Writable, recip age.Recipient) error {
+	start := time.Now()
+	unlock, err := o.lock()
+	if err != nil {
+		err = &WriteError{Mailbox: o.name, Offset: -1, Err: err}
+		o.fail(err, form, 0, recip != nil)
+		return err
+	}
+	offset := fileOffset(o.file)
+	n, err := writeMessage(o.file, form, recip, o.opts)
+	unlock()
+	if err != nil {
+		err = &WriteError{Mailbox: o.name, Offset: offset, Written: n, Err: err}
+		o.fail(err, form, n, recip != nil)
+		return err
+	}
+	s := newSaved(o.name, offset, n, form, recip != nil, start)
+	o.logger.Info("message written",
+		"mailbox", s.Mailbox,
+		"offset", s.Offset,
+		"bytes", s.Size,
+		"duration", s.Duration,
+		"encrypted", s.Encrypted,
+		"message_id", s.MessageID)
+	if o.metrics != nil {
+		o.metrics.Written(s, o.queued())
+	}
+	runHooks(o.hooks, s)
+	runSinks(o.sinks, form, o.logger)
+	return nil
+}
+
+// lock locks the mbox file while a message is written, opening it again if
+// it was replaced (see Rewrite). Only files with a name are locked.
+func (o *output) lock() (unlock func(), err error) {
+	rewriting.RLock()
+	f, ok := o.file.(*os.File)
+	if !ok || f == os.Stdout || o.name == "" {
+		return rewriting.RUnlock, nil
+	}
+	locked, err := lockPath(f, o.name, os.O_RDWR|os.O_CREATE|os.O_APPEND)
+	if locked != f {
+		o.logger.Info("mbox file replaced, opened again", "mailbox", o.name)
+		o.file = locked
+		if o.replaced != nil {
+			o.replaced(locked)
+		}
+	}
+	if err != nil {
+		rewriting.RUnlock()
+		return nil, err
+	}
+	return func() {
+		funlock(locked)
+		rewriting.RUnlock()
+	}, nil
+}
+
+// fail reports a message that was not written, or only partially (n bytes)
+func (o *output) fail(err error, form Writable, n int64, encrypted bool) {
+	o.logger.Error("message not written",
+		"mailbox", o.name,
+		"bytes", n,
+		"encrypted", encrypted,
+		"error", err)
+	if o.metrics != nil {
+		o.metrics.Failed(o.name, encrypted, o.queued())
+	}
+	if o.onError != nil {
+		o.onError(err, form)
+	}
+	if s, ok := form.(*StreamForm); ok {
+		s.close() // eg: abandoned, never written
+	}
+}
 
+// writeMessage writes a single message, encrypted to recip if not nil, and the Separator
+func writeMessage(mailout io.Writer, form Writable, recip age.Recipient, opts *Options) (int64, error) {
+	cw := &countWriter{w: mailout}
+	if recip == nil {
+		_, err := writeForm(cw, form, opts)
+		if err != nil {
+			return cw.n, err
+		}
+		if Separator != nil {
+			Separator(cw)
 		}
+		return cw.n, nil
+	}
+	if Separator == nil {
+		fmt.Fprint(cw, encryptedMarker)
+	}
+	// armored, so the reader finds its end
+	armored := armor.NewWriter(cw)
+	encryptor, err := age.Encrypt(armored, recip)
+	if err != nil {
+		return cw.n, err
+	}
+	if _, err := writeForm(encryptor, form, opts); err != nil {
+		return cw.n, err
 	}
+	if err := encryptor.Close(); err != nil {
+		return cw.n, err
+	}
+	if err := armored.Close(); err != nil {
+		return cw.n, err
+	}
+	if Separator != nil {
+		Separator(cw)
+	}
+	return cw.n, nil
 }
 
-// Close the mbox file when finished (not always necessary)
+// Close stops accepting messages, writes the queued messages,
+// then syncs and closes the mbox file (see Shutdown)
 func Close() {
+	Shutdown(context.Background())
+}
+
+// Shutdown writes the queued messages until ctx is done, then closes the mbox file.
+// Messages left are abandoned (see OnError), the error is then ctx.Err().
+func Shutdown(ctx context.Context) (written, abandoned int, err error) {
+	if cancelwrite == nil {
+		return 0, 0, nil
+	}
+	if ctx == nil {
+		ctx = context.Background()
+	}
+	shutdown.Lock()
+	if shutdown.deadline == nil {
+		shutdown.deadline = ctx
+	}
+	shutdown.Unlock()
 	cancelwrite()
 	wg.Wait()
+	shutdown.Lock()
+	defer shutdown.Unlock()
+	return shutdown.written, shutdown.abandoned, shutdown.err
 }
 
 func NewMessage(name, email, subject, message string) Form {
@@ -154,66 +362,60 @@ func NewMessage(name, email, subject, message string) Form {
 	return msg
 }
 
-// Save assigns Received time and sends an entire email to the writer.
+// Save checks the message (see Validators) and sends an entire email to the writer.
+// When the Writer channel is full, see OverflowPolicy.
 func Save(form Writable) error {
-	if MailWriteCloser == nil {
-		panic("MailWriteCloser is nil, use Open()")
+	return SaveContext(context.Background(), form)
+}
+
+// SaveContext is Save, giving up when ctx is done while waiting for room
+// in the Writer channel (see OverflowBlock), eg: with a timeout.
+func SaveContext(ctx context.Context, form Writable) error {
+	if MailWriteCloser == nil || mainctx == nil {
+		return ErrNotOpen
 	}
-	select {
-	case <-mainctx.Done():
-		return mainctx.Err()
-	case Writer <- form:
+	if err := validate(ctx, packageValidators(), form); err != nil {
+		return err
 	}
-	return nil
+	opts := DefaultOptions
+	out := &output{name: fileName(MailWriteCloser), logger: logger(nil), metrics: Metrics, opts: &opts}
+	saving.RLock()
+	defer saving.RUnlock()
+	return out.enqueue(ctx, mainctx, Writer, OverflowPolicy, spilled, form)
 }
 
-// Normalize capitalization of email address
+// Normalize runs the ValidationLevel validators on form (see LevelValidators)
 //
-// see also: ValidationLevel (set 3 for full validation, 0 for none)
+// Deprecated: Save runs the Validators, set them instead of ValidationLevel.
 func (form *Form) Normalize() error {
-	if ValidationLevel == 0 {
-		return nil
-	}
-
-	// lvl 1 Normalize email address capitalization
-	form.From = emailx.Normalize(form.From)
-
-	if ValidationLevel > 1 {
-		// lvl 2
-		if form.From == "@" || form.From == " " || !strings.ContainsAny(form.From, "@") {
-			return errors.New("email is empty or not valid")
-		}
-
-		if ValidationLevel > 2 {
-			// lvl 3
-			err := emailx.Validate(form.From)
-			if err != nil {
-				if err == emailx.ErrInvalidFormat {
-					return errors.New("email is not valid format.")
-				}
-				if err == emailx.ErrUnresolvableHost {
-					return errors.New("email is not valid format.")
-				}
-				return fmt.Errorf("email validation error: %v", err)
-			}
-		}
-	}
-
-	return nil
+	return validate(context.Background(), LevelValidators(ValidationLevel), form)
 }
 
 var NoSubjectLine = "[No Subject]" // default subject line if none is provided
 var NoFromLine = "Unknown"         // default from line if none is provided
 
-// Write form to mbox file
-// TODO see RFC1123Z, RFC3339, RFC5322
+// WriteTo writes the form to a mbox file with DefaultOptions (see WriteWith)
 func (form *Form) WriteTo(w io.Writer) (int64, error) {
-	fm := strings.TrimSpace(form.Message)
-	if fm == "" && len(form.Body) == 0 && form.Subject == "" && form.From == "" {
-		return 0, errors.New("too many empty fields (message, body, subject, from)")
+	return form.WriteWith(w, DefaultOptions)
+}
+
+// headerLine replaces the line breaks of header values with spaces
+var headerLine = strings.NewReplacer("\r\n", " ", "\r", " ", "\n", " ")
+
+// WriteWith writes the form to a mbox file, setting the Received time,
+// Message-ID, From and Subject if empty (see Options)
+func (form *Form) WriteWith(w io.Writer, opts Options) (int64, error) {
+	if form.empty() {
+		return 0, ErrEmptyMessage
 	}
+	return form.write(w, opts, &content{form: form, text: strings.TrimSpace(form.Message)})
+}
+
+// write writes the header of the form, and the body c
+func (form *Form) write(w io.Writer, opts Options, c *content) (int64, error) {
+	c.boundary = opts.boundary
 	if form.Received.IsZero() {
-		form.Received = time.Now().UTC()
+		form.Received = opts.now()
 	}
 	if form.From == "" {
 		form.From = NoFromLine
@@ -221,73 +423,181 @@ func (form *Form) WriteTo(w io.Writer) (int64, error) {
 	if form.Subject == "" {
 		form.Subject = NoSubjectLine
 	}
-	if er := form.Normalize(); er != nil {
-		return 0, er
+	if form.MessageID == "" {
+		id, err := opts.messageID()
+		if err != nil {
+			return 0, err
+		}
+		form.MessageID = id
 	}
-	mailtime := form.Received.Format("Mon Jan 2 15:04:05.99999 2006")
-	mailtime2 := form.Received.Format("Mon, 2 Jan 2006 15:04:05.99999 -0700")
+	sent := form.origination()
+	received := opts.local(form.Received)
+
+	// header values are written on one line, they can not add header
+	// lines or begin a message
+	from, subject := headerLine.Replace(form.From), headerLine.Replace(form.Subject)
+	destination := headerLine.Replace(Destination)
 
 	space := string([]byte{0x20})
 	// try and extract email address from From
-	fromaddr := form.From
+	fromaddr := from
 	if strings.Contains(fromaddr, "<") {
 		fromaddr = strings.Split(fromaddr, "<")[1]
 		fromaddr = strings.Split(fromaddr, ">")[0]
 	} else if strings.Contains(fromaddr, " ") {
 		fromaddr = strings.Replace(fromaddr, " ", "_", -1) // experimental: replace spaces with underscores
 	}
-	var x int64
-	var n2 int
+	cw := &countWriter{w: w}
 	lines := []string{
-		"From" + space + strings.Replace(fromaddr, " ", "+", -1) + space + mailtime,
-		"Return-path: <" + form.From + ">",
-		"Delivery-date: " + mailtime2,
-		"To: " + Destination, // skips if Destination is empty
-		"Envelope-to: " + Destination + "\n",
-		"Subject: " + form.Subject,
-		"From: " + form.From,
-		"Date: " + mailtime2,
+		"From" + space + strings.Replace(fromaddr, " ", "+", -1) + space + received.Format(time.ANSIC),
+		"Return-path: <" + fromaddr + ">",
 	}
+	for _, t := range form.Trace {
+		if t.Time.IsZero() {
+			t.Time = received
+		}
+		lines = append(lines, "Received: "+headerLine.Replace(t.String()))
+	}
+	lines = append(lines,
+		"Delivery-date: "+received.Format(time.RFC1123Z),
+		"To: "+destination, // skips if Destination is empty
+		"Envelope-to: "+destination,
+		"Subject: "+subject,
+		"From: "+from,
+		"Date: "+sent.Format(time.RFC1123Z),
+		"Message-ID: "+headerLine.Replace(form.MessageID),
+		"In-Reply-To: "+form.inReplyTo(),
+		"References: "+strings.Join(form.references(), "\n "), // folded, one per line
+	)
+	lines = append(lines, form.extraHeaders()...)
 	for _, line := range lines {
 		if strings.HasSuffix(strings.TrimSpace(line), ":") {
 			continue // skip empty destination and other empty lines
 		}
-		n2, err := w.Write([]byte(line + "\n"))
-		x += int64(n2)
-		if err != nil {
-			return x, err
+		if _, err := io.WriteString(cw, line+"\n"); err != nil {
+			return cw.n, err
+		}
+	}
+	if form.Flags != 0 || opts.Status {
+		// padded, so any flag can be set in place
+		status := fmt.Sprintf("Status: %-2s\nX-Status: %-3s\n", form.Flags.status(), form.Flags.xstatus())
+		if _, err := io.WriteString(cw, status); err != nil {
+			return cw.n, err
 		}
 	}
 
-	// end header
-	n2, err := w.Write([]byte{'\n'})
-	x += int64(n2)
-	if err != nil {
-		return x, err
+	body := &quoteWriter{w: cw, dialect: opts.Dialect}
+	if c.multipart() {
+		// MIME headers, end header, multipart body
+		if _, err := c.writeMultipart(body); err != nil {
+			return cw.n, err
+		}
+	} else {
+		// end header
+		if _, err := cw.Write([]byte{'\n'}); err != nil {
+			return cw.n, err
+		}
+		// message, and experimental Body
+		if err := c.writePlain(body); err != nil {
+			return cw.n, err
+		}
 	}
+	if err := body.Close(); err != nil {
+		return cw.n, err
+	}
+	// end message
+	_, err := cw.Write([]byte("\n\n\n"))
+	return cw.n, err
+}
 
-	// write message
-	if fm != "" {
-		n2, err = w.Write([]byte(fm + "\n"))
-		x += int64(n2)
-		if err != nil {
-			return x, err
+// origination returns when the message was sent: Sent, or the Date in
+// Headers (eg: supplied by a client), or Received
+func (form *Form) origination() time.Time {
+	if !form.Sent.IsZero() {
+		return form.Sent
+	}
+	for name, value := range form.Headers {
+		if textproto.CanonicalMIMEHeaderKey(name) != "Date" {
+			continue
+		}
+		if date, err := mail.ParseDate(strings.TrimSpace(value)); err == nil {
+			return date
 		}
 	}
+	return form.Received
+}
 
-	// experimental: attachments
-	if len(form.Body) != 0 {
-		n2, err = w.Write(form.Body)
-		x += int64(n2)
-		if err != nil {
-			return x, err
+// inReplyTo returns the Message-IDs of InReplyTo, or of the In-Reply-To in Headers
+func (form *Form) inReplyTo() string {
+	value := form.InReplyTo
+	if value == "" {
+		value = form.header("In-Reply-To")
+	}
+	return strings.Join(messageIDs(value), " ")
+}
+
+// references returns the Message-IDs of References, or of the References in Headers
+func (form *Form) references() []string {
+	value := strings.Join(form.References, " ")
+	if value == "" {
+		value = form.header("References")
+	}
+	return messageIDs(value)
+}
+
+// header returns the value of a header in Headers, whatever the case of its name
+func (form *Form) header(name string) string {
+	for key, value := range form.Headers {
+		if textproto.CanonicalMIMEHeaderKey(key) == name {
+			return value
 		}
 	}
-	// end message
-	n2, err = w.Write([]byte("\n\n\n"))
-	x += int64(n2)
-	if err != nil {
-		return x, err
+	return ""
+}
+
+// empty reports whether the message, body, HTML, subject and from are all empty
+func (form *Form) empty() bool {
+	return strings.TrimSpace(form.Message) == "" && len(form.Body) == 0 && form.HTML == "" && form.Subject == "" && form.From == ""
+}
+
+// extraHeaders returns the Headers lines, sorted by name, skipping invalid
+// names and those written from the Form fields
+func (form *Form) extraHeaders() []string {
+	names := make([]string, 0, len(form.Headers))
+	for name := range form.Headers {
+		key := textproto.CanonicalMIMEHeaderKey(name)
+		if !validHeaderName(name) || formHeaders[key] || key == "To" && Destination != "" {
+			continue
+		}
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	lines := make([]string, len(names))
+	for i, name := range names {
+		value := strings.Join(strings.Fields(form.Headers[name]), " ")
+		lines[i] = textproto.CanonicalMIMEHeaderKey(name) + ": " + value
+	}
+	return lines
+}
+
+// validHeaderName reports whether name is a valid header field name (RFC 5322)
+func validHeaderName(name string) bool {
+	if name == "" {
+		return false
+	}
+	for _, c := range name {
+		if c <= ' ' || c > '~' || c == ':' {
+			return false
+		}
+	}
+	return true
+}
+
+// newMessageID returns a new unique Message-ID, eg: <lxyz.0123456789abcdef@hostname>
+func newMessageID() (string, error) {
+	b := make([]byte, 8)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
 	}
-	return x, err
+	return "<" + strconv.FormatInt(time.Now().UnixNano(), 36) + "." + hex.EncodeToString(b) + "@" + hostname() + ">", nil
 }